@@ -0,0 +1,357 @@
+package sqlite
+
+/*
+#include "sqlite3.h"
+*/
+import "C"
+
+import (
+	"fmt"
+	"strings"
+)
+
+// SQLITE_MAX_VARIABLE_NUMBER, which limits how many rows fit in a single
+// multi-row INSERT
+const maxVariables = 200
+
+// SQLITE_MAX_SQL_LENGTH, which also limits how many rows fit in a single
+// multi-row INSERT (with wide tables or long names)
+const maxSQLLength = 5000
+
+type BulkConflict int
+
+const (
+	// Fail on constraint violations (see BulkConfig.OnError)
+	BulkAbort BulkConflict = iota
+
+	// INSERT OR IGNORE
+	BulkIgnore
+
+	// INSERT OR REPLACE
+	BulkReplace
+
+	// INSERT ... ON CONFLICT (ConflictColumns) DO UPDATE, setting every
+	// other column to the inserted value
+	BulkUpsert
+)
+
+// The rows for BulkInsert. Values can return the same slice for every row.
+type RowSource interface {
+	Next() bool
+	Values() []any
+	Error() error
+}
+
+type BulkConfig struct {
+	// Rows per INSERT statement. Defaults to (and is capped at) as many rows
+	// as fit in SQLITE_MAX_VARIABLE_NUMBER (200) parameters and in
+	// SQLITE_MAX_SQL_LENGTH (5000 bytes) of SQL.
+	BatchRows int
+
+	// Rows per savepoint, 0 inserts everything in a single savepoint. Outside
+	// of a transaction, each savepoint is committed when it's released.
+	CommitEvery int
+
+	Conflict BulkConflict
+
+	// The conflict target (e.g. the primary key) for BulkUpsert
+	ConflictColumns []string
+
+	// Called after each batch with the number of rows inserted so far
+	OnProgress func(inserted int)
+
+	// Called with a row which failed to insert (row is its 0-based position
+	// in the source). Returning nil skips the row and continues, returning an
+	// error stops the insert. Without OnError, the insert stops with a
+	// BulkError. Not called for an error which rolled back the transaction
+	// (e.g. RAISE(ROLLBACK) in a trigger), which always stops the insert.
+	OnError func(row int, values []any, err error) error
+}
+
+// Returned by BulkInsert for a row which failed to insert. Row is the row's
+// 0-based position in the source.
+type BulkError struct {
+	Row   int
+	error error
+}
+
+func (e BulkError) Unwrap() error {
+	return e.error
+}
+
+func (e BulkError) Error() string {
+	return fmt.Sprintf("%s (row: %d)", e.error.Error(), e.Row)
+}
+
+type bulkInsert struct {
+	conn      Conn
+	columns   int
+	batchRows int
+	config    BulkConfig
+	batch     *Stmt
+	single    *Stmt
+	row       int
+
+	// the values of the batch's rows, and where each row ends within them
+	values   []any
+	ends     []int
+	inserted int
+}
+
+// Inserts the rows from src into table, preparing a single multi-row INSERT
+// statement which is reused for every batch of rows. A batch which fails is
+// rolled back and retried row by row, so that errors are reported for the
+// specific row (a failed statement doesn't affect the transaction, unless it
+// rolls it back, which stops the insert). Rows are inserted within
+// savepoints, so it can be called within a transaction. Returns the number
+// of rows inserted (for BulkIgnore, including ignored rows). On error, the
+// current savepoint is rolled back, but those released before it (see
+// CommitEvery) aren't, and the returned count only includes their rows.
+func (c Conn) BulkInsert(table string, columns []string, src RowSource, config BulkConfig) (int, error) {
+	count := len(columns)
+	if count == 0 || count > maxVariables {
+		return 0, Error{Code: CodeMisuse, Message: fmt.Sprintf("bulk insert requires between 1 and %d columns", maxVariables)}
+	}
+	if config.Conflict == BulkUpsert && len(config.ConflictColumns) == 0 {
+		return 0, Error{Code: CodeMisuse, Message: "bulk upsert requires conflict columns"}
+	}
+
+	batchRows := maxVariables / count
+	// each row adds "(?,...,?)," to the statement
+	if n := (maxSQLLength - len(bulkSQL(table, columns, 0, config)) + 1) / (2*count + 2); n < batchRows {
+		batchRows = n
+	}
+	if n := config.BatchRows; n > 0 && n < batchRows {
+		batchRows = n
+	}
+	if batchRows < 1 {
+		// a single row doesn't fit either, preparing it will fail
+		batchRows = 1
+	}
+
+	b := &bulkInsert{
+		conn:      c,
+		columns:   count,
+		batchRows: batchRows,
+		config:    config,
+		values:    make([]any, 0, batchRows*count),
+		ends:      make([]int, 0, batchRows),
+	}
+	defer b.close()
+
+	var err error
+	if b.single, err = c.Prepare(s2b(bulkSQL(table, columns, 1, config))); err != nil {
+		return 0, err
+	}
+	if batchRows > 1 {
+		if b.batch, err = c.Prepare(s2b(bulkSQL(table, columns, batchRows, config))); err != nil {
+			return 0, err
+		}
+	}
+
+	done := false
+	for !done {
+		committed := b.inserted
+		err := c.Savepoint(func() error {
+			for n := 0; config.CommitEvery == 0 || n < config.CommitEvery; {
+				limit := batchRows
+				if every := config.CommitEvery; every > 0 && every-n < limit {
+					limit = every - n
+				}
+
+				b.values, b.ends = b.values[:0], b.ends[:0]
+				for len(b.ends) < limit && src.Next() {
+					// copied, since the source can reuse Values
+					b.values = append(b.values, src.Values()...)
+					b.ends = append(b.ends, len(b.values))
+				}
+				if err := src.Error(); err != nil {
+					return err
+				}
+				rows := len(b.ends)
+				if rows == 0 {
+					done = true
+					return nil
+				}
+
+				if err := b.insert(); err != nil {
+					return err
+				}
+				n += rows
+				if progress := config.OnProgress; progress != nil {
+					progress(b.inserted)
+				}
+				if rows < limit {
+					done = true
+					return nil
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			// the savepoint's rows were rolled back
+			return committed, err
+		}
+	}
+	return b.inserted, nil
+}
+
+func (b *bulkInsert) insert() error {
+	rows := len(b.ends)
+	if b.batch != nil && rows == b.batchRows && b.aligned() {
+		// in its own savepoint, so that the rows inserted before the failing
+		// one (e.g. with OR FAIL) aren't kept, and inserted again below
+		err := b.conn.Savepoint(func() error {
+			return b.batch.Exec(b.values...)
+		})
+		if err == nil {
+			b.row += rows
+			b.inserted += rows
+			return nil
+		}
+		if b.rolledBack() {
+			// the batch's rows can't be retried outside of the transaction (and
+			// which of them failed isn't known)
+			return err
+		}
+	}
+
+	// a partial batch, or a batch which failed: insert row by row
+	start := 0
+	for _, end := range b.ends {
+		values := b.values[start:end]
+		start = end
+		row := b.row
+		b.row += 1
+
+		var err error
+		if len(values) != b.columns {
+			err = Error{Code: CodeMisuse, Message: fmt.Sprintf("expected %d values, got %d", b.columns, len(values))}
+		} else {
+			err = b.single.Exec(values...)
+		}
+		if err == nil {
+			b.inserted += 1
+			continue
+		}
+
+		onError := b.config.OnError
+		if onError == nil || b.rolledBack() {
+			return BulkError{Row: row, error: err}
+		}
+		if err := onError(row, values, err); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Whether the failed statement rolled back the transaction, in which case
+// continuing would insert the remaining rows outside of it.
+func (b *bulkInsert) rolledBack() bool {
+	return C.sqlite3_get_autocommit(b.single.db) != 0
+}
+
+// Whether every row of the batch has a value for each column
+func (b *bulkInsert) aligned() bool {
+	for i, end := range b.ends {
+		if end != (i+1)*b.columns {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bulkInsert) close() {
+	if stmt := b.batch; stmt != nil {
+		stmt.Close()
+	}
+	if stmt := b.single; stmt != nil {
+		stmt.Close()
+	}
+}
+
+func bulkSQL(table string, columns []string, rows int, config BulkConfig) string {
+	var sb strings.Builder
+	switch config.Conflict {
+	case BulkIgnore:
+		sb.WriteString("insert or ignore into ")
+	case BulkReplace:
+		sb.WriteString("insert or replace into ")
+	default:
+		sb.WriteString("insert into ")
+	}
+	sb.WriteString(QuoteIdentifier(table))
+
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = QuoteIdentifier(column)
+	}
+	sb.WriteString(" (")
+	sb.WriteString(strings.Join(quoted, ","))
+	sb.WriteString(") values ")
+
+	params := "(" + strings.Repeat("?,", len(columns)-1) + "?)"
+	for i := 0; i < rows; i++ {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(params)
+	}
+
+	if config.Conflict == BulkUpsert {
+		target := make([]string, len(config.ConflictColumns))
+		for i, column := range config.ConflictColumns {
+			target[i] = QuoteIdentifier(column)
+		}
+
+		var set []string
+		for i, column := range columns {
+			if !containsFold(config.ConflictColumns, column) {
+				set = append(set, quoted[i]+" = excluded."+quoted[i])
+			}
+		}
+
+		sb.WriteString(" on conflict (")
+		sb.WriteString(strings.Join(target, ","))
+		if len(set) == 0 {
+			sb.WriteString(") do nothing")
+		} else {
+			sb.WriteString(") do update set ")
+			sb.WriteString(strings.Join(set, ", "))
+		}
+	}
+	return sb.String()
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+type rowSlice struct {
+	rows [][]any
+	next int
+}
+
+// A RowSource over rows already in memory.
+func RowSlice(rows [][]any) RowSource {
+	return &rowSlice{rows: rows, next: -1}
+}
+
+func (r *rowSlice) Next() bool {
+	r.next += 1
+	return r.next < len(r.rows)
+}
+
+func (r *rowSlice) Values() []any {
+	return r.rows[r.next]
+}
+
+func (r *rowSlice) Error() error {
+	return nil
+}
@@ -0,0 +1,126 @@
+package sqlite
+
+// Primary result codes. The low 8 bits of any (extended) code.
+const (
+	CodeOK         = 0
+	CodeError      = 1
+	CodeInternal   = 2
+	CodePerm       = 3
+	CodeAbort      = 4
+	CodeBusy       = 5
+	CodeLocked     = 6
+	CodeNoMem      = 7
+	CodeReadOnly   = 8
+	CodeInterrupt  = 9
+	CodeIOErr      = 10
+	CodeCorrupt    = 11
+	CodeNotFound   = 12
+	CodeFull       = 13
+	CodeCantOpen   = 14
+	CodeProtocol   = 15
+	CodeEmpty      = 16
+	CodeSchema     = 17
+	CodeTooBig     = 18
+	CodeConstraint = 19
+	CodeMismatch   = 20
+	CodeMisuse     = 21
+	CodeNoLFS      = 22
+	CodeAuth       = 23
+	CodeFormat     = 24
+	CodeRange      = 25
+	CodeNotADB     = 26
+	CodeNotice     = 27
+	CodeWarning    = 28
+	CodeRow        = 100
+	CodeDone       = 101
+)
+
+// Extended result codes. Error.Primary() maps these back to their primary code.
+const (
+	CodeErrorMissingCollSeq = CodeError | (1 << 8)
+	CodeErrorRetry          = CodeError | (2 << 8)
+	CodeErrorSnapshot       = CodeError | (3 << 8)
+
+	CodeIOErrRead              = CodeIOErr | (1 << 8)
+	CodeIOErrShortRead         = CodeIOErr | (2 << 8)
+	CodeIOErrWrite             = CodeIOErr | (3 << 8)
+	CodeIOErrFsync             = CodeIOErr | (4 << 8)
+	CodeIOErrDirFsync          = CodeIOErr | (5 << 8)
+	CodeIOErrTruncate          = CodeIOErr | (6 << 8)
+	CodeIOErrFstat             = CodeIOErr | (7 << 8)
+	CodeIOErrUnlock            = CodeIOErr | (8 << 8)
+	CodeIOErrRdLock            = CodeIOErr | (9 << 8)
+	CodeIOErrDelete            = CodeIOErr | (10 << 8)
+	CodeIOErrBlocked           = CodeIOErr | (11 << 8)
+	CodeIOErrNoMem             = CodeIOErr | (12 << 8)
+	CodeIOErrAccess            = CodeIOErr | (13 << 8)
+	CodeIOErrCheckReservedLock = CodeIOErr | (14 << 8)
+	CodeIOErrLock              = CodeIOErr | (15 << 8)
+	CodeIOErrClose             = CodeIOErr | (16 << 8)
+	CodeIOErrDirClose          = CodeIOErr | (17 << 8)
+	CodeIOErrShmOpen           = CodeIOErr | (18 << 8)
+	CodeIOErrShmSize           = CodeIOErr | (19 << 8)
+	CodeIOErrShmLock           = CodeIOErr | (20 << 8)
+	CodeIOErrShmMap            = CodeIOErr | (21 << 8)
+	CodeIOErrSeek              = CodeIOErr | (22 << 8)
+	CodeIOErrDeleteNoEnt       = CodeIOErr | (23 << 8)
+	CodeIOErrMmap              = CodeIOErr | (24 << 8)
+	CodeIOErrGetTempPath       = CodeIOErr | (25 << 8)
+	CodeIOErrConvPath          = CodeIOErr | (26 << 8)
+	CodeIOErrVnode             = CodeIOErr | (27 << 8)
+	CodeIOErrAuth              = CodeIOErr | (28 << 8)
+	CodeIOErrBeginAtomic       = CodeIOErr | (29 << 8)
+	CodeIOErrCommitAtomic      = CodeIOErr | (30 << 8)
+	CodeIOErrRollbackAtomic    = CodeIOErr | (31 << 8)
+	CodeIOErrData              = CodeIOErr | (32 << 8)
+	CodeIOErrCorruptFS         = CodeIOErr | (33 << 8)
+
+	CodeLockedSharedCache = CodeLocked | (1 << 8)
+	CodeLockedVTab        = CodeLocked | (2 << 8)
+
+	CodeBusyRecovery = CodeBusy | (1 << 8)
+	CodeBusySnapshot = CodeBusy | (2 << 8)
+	CodeBusyTimeout  = CodeBusy | (3 << 8)
+
+	CodeCantOpenNoTempDir = CodeCantOpen | (1 << 8)
+	CodeCantOpenIsDir     = CodeCantOpen | (2 << 8)
+	CodeCantOpenFullPath  = CodeCantOpen | (3 << 8)
+	CodeCantOpenConvPath  = CodeCantOpen | (4 << 8)
+	CodeCantOpenDirtyWAL  = CodeCantOpen | (5 << 8)
+	CodeCantOpenSymlink   = CodeCantOpen | (6 << 8)
+
+	CodeCorruptVTab     = CodeCorrupt | (1 << 8)
+	CodeCorruptSequence = CodeCorrupt | (2 << 8)
+	CodeCorruptIndex    = CodeCorrupt | (3 << 8)
+
+	CodeReadOnlyRecovery  = CodeReadOnly | (1 << 8)
+	CodeReadOnlyCantLock  = CodeReadOnly | (2 << 8)
+	CodeReadOnlyRollback  = CodeReadOnly | (3 << 8)
+	CodeReadOnlyDBMoved   = CodeReadOnly | (4 << 8)
+	CodeReadOnlyCantInit  = CodeReadOnly | (5 << 8)
+	CodeReadOnlyDirectory = CodeReadOnly | (6 << 8)
+
+	CodeAbortRollback = CodeAbort | (2 << 8)
+
+	CodeConstraintCheck      = CodeConstraint | (1 << 8)
+	CodeConstraintCommitHook = CodeConstraint | (2 << 8)
+	CodeConstraintForeignKey = CodeConstraint | (3 << 8)
+	CodeConstraintFunction   = CodeConstraint | (4 << 8)
+	CodeConstraintNotNull    = CodeConstraint | (5 << 8)
+	CodeConstraintPrimaryKey = CodeConstraint | (6 << 8)
+	CodeConstraintTrigger    = CodeConstraint | (7 << 8)
+	CodeConstraintUnique     = CodeConstraint | (8 << 8)
+	CodeConstraintVTab       = CodeConstraint | (9 << 8)
+	CodeConstraintRowID      = CodeConstraint | (10 << 8)
+	CodeConstraintPinned     = CodeConstraint | (11 << 8)
+	CodeConstraintDataType   = CodeConstraint | (12 << 8)
+
+	CodeNoticeRecoverWAL      = CodeNotice | (1 << 8)
+	CodeNoticeRecoverRollback = CodeNotice | (2 << 8)
+
+	CodeWarningAutoIndex = CodeWarning | (1 << 8)
+
+	CodeAuthUser = CodeAuth | (1 << 8)
+
+	CodeOKLoadPermanently = CodeOK | (1 << 8)
+)
@@ -74,149 +74,25 @@ package sqlite
 // Fix "_localtime32(0): not defined" linker error.
 #cgo windows,386 CFLAGS: -D_localtime32=localtime
 
+#include <stdlib.h>
 #include "sqlite3.h"
-#include <strings.h>
 
 static int enable_defensive(sqlite3 *db) {
 	return sqlite3_db_config(db, SQLITE_DBCONFIG_DEFENSIVE, 1, (void*)0);
 }
 
-static int sqlkite_user_stmt(sqlite3_context *context, const char *sql, sqlite3_stmt **stmt) {
-	int rc;
-	sqlite3 *db = sqlite3_context_db_handle(context);
-
-	rc = sqlite3_prepare_v2(db, sql, -1, stmt, 0);
-	if (rc != SQLITE_OK) {
-		const char* errMsg = sqlite3_mprintf("sqlkite_user.prepare - %s", sqlite3_errmsg(db));
-		sqlite3_result_error(context, errMsg, -1);
-		sqlite3_free((void *)errMsg);
-		return rc;
-	}
-
-	rc = sqlite3_step(*stmt);
-	if (rc == SQLITE_ROW) {
-		return rc;
-	}
-	if (rc == SQLITE_DONE) {
-		// this is fine, but we can close stmt for the caller
-		sqlite3_finalize(*stmt);
-		return rc;
-	}
-
-	// an error
-	sqlite3_finalize(*stmt);
-	const char* errMsg = sqlite3_mprintf("sqlkite_user.step - %s", sqlite3_errmsg(db));
-	sqlite3_result_error(context, errMsg, -1);
-	sqlite3_free((void *)errMsg);
-	return rc;
-}
-
-static void sqlkite_user_result(sqlite3_context *context, const char *sql){
-	sqlite3_stmt *stmt;
-
-	// Will sqlite3_result_error if needed, and finalize stmt unless there's a row
-	int rc = sqlkite_user_stmt(context, sql, &stmt);
-
-	if (rc == SQLITE_ROW) {
-		size_t len = sqlite3_column_bytes(stmt, 0);
-		const char *value = (const char*)sqlite3_column_text(stmt, 0);
-		sqlite3_result_text(context, value, len, SQLITE_TRANSIENT);
-		sqlite3_finalize(stmt);
-	} else if (rc == SQLITE_DONE) {
-		sqlite3_result_null(context);
-	}
-}
-
-static char *sqlkite_user_value(sqlite3_context *context, const char *sql){
-	sqlite3_stmt *stmt;
-	char *value = NULL;
-
-	// Will sqlite3_result_error if needed, and finalize stmt unless there's a row
-	int rc = sqlkite_user_stmt(context, sql, &stmt);
-	if (rc == SQLITE_ROW) {
-		size_t len = sqlite3_column_bytes(stmt, 0);
-		if (len != 0) {
-			value = (char*)sqlite3_malloc64(len);
-			if (value) {
-				memcpy(value, sqlite3_column_text(stmt, 0), len);
-			} else {
-				sqlite3_result_error_nomem(context);
-			}
-		}
-		sqlite3_finalize(stmt);
-	}
-	return value;
-}
-
-static void sqlkite_assert_value(sqlite3_context *context, const char *sql, int argc, sqlite3_value **argv){
-	if (sqlite3_value_type(argv[0]) != SQLITE_TEXT) {
-		sqlite3_result_error(context, "sqlkite_assert requires a text argument", -1);
-		return;
-	}
-
-	int valid = -1;
-	const char *actual = sqlkite_user_value(context, sql);
-	if (actual) {
-		const char *target = (const char*)sqlite3_value_text(argv[0]);
-		valid = sqlite3_stricmp(actual, target);
-		sqlite3_free((void *)actual);
-	}
-
-	if (valid != 0) {
-		sqlite3_result_error(context, "sqlkite_row_access", -1);
-	}
-}
-
-static void sqlkite_user_id(sqlite3_context *context, int argc, sqlite3_value **argv){
-	return sqlkite_user_result(context, "select user_id from sqlkite_user");
-}
-
-static void sqlkite_user_role(sqlite3_context *context, int argc, sqlite3_value **argv){
-	return sqlkite_user_result(context, "select role from sqlkite_user");
-}
-
-static void sqlkite_assert_user_id(sqlite3_context *context, int argc, sqlite3_value **argv){
-	sqlkite_assert_value(context, "select user_id from sqlkite_user", argc, argv);
-}
-
-static void sqlkite_assert_user_role(sqlite3_context *context, int argc, sqlite3_value **argv){
-	sqlkite_assert_value(context, "select role from sqlkite_user", argc, argv);
-}
-
 static char *sqlkite_escape_literal(char *value){
 	return sqlite3_mprintf("%Q", value);
 }
-
-static int registerFunctions(sqlite3 *db) {
-	int rc;
-	rc = sqlite3_create_function(db, "sqlkite_user_id", 0, SQLITE_UTF8, NULL, &sqlkite_user_id, NULL, NULL);
-	if (rc != SQLITE_OK) {
-		return rc;
-	}
-
-	rc = sqlite3_create_function(db, "sqlkite_user_role", 0, SQLITE_UTF8, NULL, &sqlkite_user_role, NULL, NULL);
-	if (rc != SQLITE_OK) {
-		return rc;
-	}
-
-	rc = sqlite3_create_function(db, "sqlkite_assert_user_id", 1, SQLITE_UTF8, NULL, &sqlkite_assert_user_id, NULL, NULL);
-	if (rc != SQLITE_OK) {
-		return rc;
-	}
-
-	rc = sqlite3_create_function(db, "sqlkite_assert_user_role", 1, SQLITE_UTF8, NULL, &sqlkite_assert_user_role, NULL, NULL);
-	if (rc != SQLITE_OK) {
-		return rc;
-	}
-	return SQLITE_OK;
-}
 */
 import "C"
 
 import (
+	"bytes"
 	"errors"
 	"os"
 	"reflect"
+	"strings"
 	"time"
 	"unsafe"
 )
@@ -227,7 +103,13 @@ var (
 	txCommit         = cStr(Terminate("commit"))
 	txRollback       = cStr(Terminate("rollback"))
 
+	spBegin    = cStr(Terminate("savepoint sqlite_sp"))
+	spRelease  = cStr(Terminate("release sqlite_sp"))
+	spRollback = cStr(Terminate("rollback to sqlite_sp"))
+
 	ErrNoRows = errors.New("no rows in result set")
+
+	errMultipleStatements = Error{Code: CodeMisuse, Message: "sql has more than one statement (see Script)"}
 )
 
 func init() {
@@ -245,7 +127,43 @@ func Terminate(sql string) string {
 }
 
 type Conn struct {
-	db *C.sqlite3
+	db                   *C.sqlite3
+	sqlkite              sqlkite
+	stmtCache            *stmtCache
+	timeFormat           TimeFormat
+	debugRaw             bool
+	prepareErrorArgTypes bool
+}
+
+// The outcome of a statement executed by ExecR, captured right after it
+// completed. RowsAffected is 0 for statements which didn't insert, update or
+// delete anything (sqlite3_changes would report the previous statement's
+// count). LastInsertRowID is as SQLite reports it: the rowid of the most
+// recent successful insert on the connection.
+type ExecResult struct {
+	LastInsertRowID int64
+	RowsAffected    int64
+}
+
+type Config struct {
+	// How time.Time values are bound and how numeric columns are interpreted
+	// when scanning into a time.Time. Defaults to TimeUnix.
+	TimeFormat TimeFormat
+
+	// When true, RawBytes and unsafe strings are copies which get overwritten
+	// with RawBufferPoison once the statement moves on. Meant for tests, to
+	// catch code that uses them past their lifetime.
+	DebugRawBuffers bool
+
+	// The number of prepared statements to cache, by SQL, for the Exec*, Row*
+	// and Rows* methods. Statements returned by Prepare are never cached.
+	// 0 (the default) disables the cache.
+	StmtCacheSize int
+
+	// When true, PrepareError.Error() includes the types (never the values) of
+	// the arguments that were given along with the SQL. Also enabled for every
+	// connection by the package-level PrepareErrorArgTypes.
+	PrepareErrorArgTypes bool
 }
 
 func Memory() (Conn, error) {
@@ -253,13 +171,24 @@ func Memory() (Conn, error) {
 }
 
 func EscapeLiteral(value string) string {
-	str := C.sqlkite_escape_literal(C.CString(value))
+	cValue := C.CString(value)
+	str := C.sqlkite_escape_literal(cValue)
+	C.free(unsafe.Pointer(cValue))
 	escaped := C.GoString(str)
 	C.sqlite3_free(unsafe.Pointer(str))
 	return escaped
 }
 
+// Quotes a table, column or other identifier for use in SQL.
+func QuoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
 func Open(name string, create bool) (Conn, error) {
+	return OpenConfig(name, create, Config{})
+}
+
+func OpenConfig(name string, create bool, config Config) (Conn, error) {
 	name = Terminate(name)
 
 	flags := C.SQLITE_OPEN_READWRITE | C.SQLITE_OPEN_EXRESCODE
@@ -284,17 +213,41 @@ func Open(name string, create bool) (Conn, error) {
 		return Conn{}, err
 	}
 
-	if rc := C.registerFunctions(db); rc != C.SQLITE_OK {
+	sqlkite, rc := registerSqlkite(db)
+	if rc != C.SQLITE_OK {
 		err := errorFromCode(db, rc)
 		C.sqlite3_close_v2(db)
 		return Conn{}, err
 	}
 
-	return Conn{db: db}, nil
+	if rc := registerList(db); rc != C.SQLITE_OK {
+		err := errorFromCode(db, rc)
+		unregisterSqlkite(db)
+		C.sqlite3_close_v2(db)
+		return Conn{}, err
+	}
+
+	var cache *stmtCache
+	if size := config.StmtCacheSize; size > 0 {
+		cache = newStmtCache(size)
+	}
+
+	return Conn{
+		db:                   db,
+		sqlkite:              sqlkite,
+		stmtCache:            cache,
+		timeFormat:           config.TimeFormat,
+		debugRaw:             config.DebugRawBuffers,
+		prepareErrorArgTypes: config.PrepareErrorArgTypes || PrepareErrorArgTypes,
+	}, nil
 }
 
 func (c *Conn) Close() error {
+	if cache := c.stmtCache; cache != nil {
+		cache.close()
+	}
 	if db := c.db; db != nil {
+		unregisterSqlkite(db)
 		if rc := C.sqlite3_close_v2(db); rc != C.SQLITE_OK {
 			return errorFromCode(db, rc)
 		}
@@ -306,40 +259,111 @@ func (c Conn) Prepare(sql []byte, args ...any) (*Stmt, error) {
 	return c.PrepareArr(sql, args)
 }
 
+// Prepares a single statement. SQL with more than one statement is an error
+// (see Script).
 func (c Conn) PrepareArr(sql []byte, args []any) (*Stmt, error) {
+	s, n, err := c.prepare(sql, args)
+	if err != nil || s == nil {
+		return nil, err
+	}
+	if hasMore(sql[n:]) {
+		s.Close()
+		return nil, errMultipleStatements
+	}
+	if err := s.bindArgs(args); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Prepares the first statement of sql, without binding args (they're only
+// used to describe a PrepareError). Also returns the number of bytes of sql
+// that the statement used: sql[n:] is the rest of the SQL. The statement is
+// nil if sql[:n] was only whitespace or comments.
+func (c Conn) prepare(sql []byte, args []any) (*Stmt, int, error) {
 	db := c.db
 	var stmt *C.sqlite3_stmt
-	rc := C.sqlite3_prepare_v2(db, cStrFromBytes(sql), C.int(len(sql)), &stmt, nil)
+	var tail *C.char
+	cSql := cStrFromBytes(sql)
+	rc := C.sqlite3_prepare_v2(db, cSql, C.int(len(sql)), &stmt, &tail)
 	if rc != C.SQLITE_OK {
-		return nil, prepareError(db, rc, string(sql), args)
+		return nil, 0, prepareError(db, rc, string(sql), args, c.prepareErrorArgTypes)
+	}
+
+	n := len(sql)
+	if tail != nil {
+		n = int(uintptr(unsafe.Pointer(tail)) - uintptr(unsafe.Pointer(cSql)))
 	}
 
 	if stmt == nil {
-		return nil, nil
+		return nil, n, nil
 	}
 
 	cColumnCount := C.sqlite3_column_count(stmt)
 	columnCount := int(cColumnCount)
 	columnTypes := make([]byte, columnCount)
-	s := &Stmt{
+	return &Stmt{
 		db:           db,
 		stmt:         stmt,
+		timeFormat:   c.timeFormat,
+		debugRaw:     c.debugRaw,
 		columnTypes:  columnTypes,
 		columnCount:  columnCount,
 		cColumnCount: cColumnCount,
 		cColumnTypes: (*C.uchar)(cBytes(columnTypes)),
-	}
+		reprepares:   C.sqlite3_stmt_status(stmt, C.SQLITE_STMTSTATUS_REPREPARE, 0),
+	}, n, nil
+}
 
-	if len(args) > 0 {
-		if err := s.Bind(args); err != nil {
-			s.Close()
-			return nil, err
-		}
+// Whether the SQL has anything but whitespace and semicolons.
+func hasSQL(sql []byte) bool {
+	return len(bytes.TrimLeft(sql, " \t\r\n;")) > 0
+}
+
+// Whether the SQL left after a statement has another statement (anything but
+// whitespace, semicolons and comments).
+func hasMore(sql []byte) bool {
+	return leadingSpace(sql) < len(sql)
+}
+
+// Prepares the statement using the statement cache, if enabled. The
+// statement is put back in the cache when it's closed.
+func (c Conn) prepareCached(sql []byte, args []any) (*Stmt, error) {
+	cache := c.stmtCache
+	if cache == nil {
+		return c.PrepareArr(sql, args)
 	}
 
+	s, more, err := c.cachedStmt(cache, sql, args)
+	if err != nil || s == nil {
+		return nil, err
+	}
+	if more {
+		s.cache = nil
+		s.Close()
+		return nil, errMultipleStatements
+	}
+	if err := s.bindArgs(args); err != nil {
+		return nil, err
+	}
 	return s, nil
 }
 
+func (c Conn) cachedStmt(cache *stmtCache, sql []byte, args []any) (*Stmt, bool, error) {
+	if s := cache.get(sql); s != nil {
+		return s, false, nil
+	}
+
+	s, n, err := c.prepare(sql, args)
+	more := err == nil && hasMore(sql[n:])
+	if err != nil || s == nil {
+		return nil, more, err
+	}
+	s.cache = cache
+	s.sql = string(sql)
+	return s, more, nil
+}
+
 func (c Conn) RowB(sql []byte, args ...any) Row {
 	return c.RowBArr(sql, args)
 }
@@ -349,7 +373,7 @@ func (c Conn) Row(sql string, args ...any) Row {
 }
 
 func (c Conn) RowBArr(sql []byte, args []any) Row {
-	stmt, err := c.PrepareArr(sql, args)
+	stmt, err := c.prepareCached(sql, args)
 	return Row{Stmt: stmt, err: err}
 }
 
@@ -358,8 +382,7 @@ func (c Conn) RowArr(sql string, args []any) Row {
 }
 
 func (c Conn) RowsB(sql []byte, args ...any) Rows {
-	stmt, err := c.PrepareArr(sql, args)
-	return Rows{Stmt: stmt, err: err}
+	return c.RowsBArr(sql, args)
 }
 
 func (c Conn) Rows(sql string, args ...any) Rows {
@@ -367,7 +390,7 @@ func (c Conn) Rows(sql string, args ...any) Rows {
 }
 
 func (c Conn) RowsBArr(sql []byte, args []any) Rows {
-	stmt, err := c.PrepareArr(sql, args)
+	stmt, err := c.prepareCached(sql, args)
 	return Rows{Stmt: stmt, err: err}
 }
 
@@ -375,6 +398,30 @@ func (c Conn) RowsArr(sql string, args []any) Rows {
 	return c.RowsBArr(s2b(sql), args)
 }
 
+func (c Conn) Maps(sql string, args ...any) ([]map[string]any, error) {
+	return c.MapsArr(sql, args)
+}
+
+func (c Conn) MapsArr(sql string, args []any) ([]map[string]any, error) {
+	rows := c.RowsArr(sql, args)
+	defer rows.Close()
+
+	result := make([]map[string]any, 0)
+	for rows.Next() {
+		// column names are cached by the stmt, so only the map is allocated
+		m, err := rows.Map()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, m)
+	}
+
+	if err := rows.Error(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
 func (c Conn) ExecB(sql []byte, args ...any) error {
 	return c.ExecBArr(sql, args)
 }
@@ -385,6 +432,9 @@ func (c Conn) Exec(sql string, args ...any) error {
 
 func (c Conn) ExecBArr(sql []byte, args []any) error {
 	if len(args) == 0 {
+		if c.stmtCache != nil {
+			return c.execCached(sql)
+		}
 		return c.ExecTerminated(append(sql, '\x00'))
 	}
 	return c.execArgs(sql, args)
@@ -392,15 +442,43 @@ func (c Conn) ExecBArr(sql []byte, args []any) error {
 
 func (c Conn) ExecArr(sql string, args []any) error {
 	if len(args) == 0 {
+		if c.stmtCache != nil {
+			return c.execCached(s2b(sql))
+		}
 		return c.exec(cStr(Terminate(sql)))
 	}
 	return c.execArgs(s2b(sql), args)
 }
 
 func (c Conn) ExecTerminated(sql []byte) error {
+	if c.stmtCache != nil {
+		if n := len(sql); n > 0 && sql[n-1] == 0 {
+			return c.execCached(sql[:n-1])
+		}
+	}
 	return c.exec(cStrFromBytes(sql))
 }
 
+func (c Conn) ExecR(sql string, args ...any) (ExecResult, error) {
+	return c.ExecRArr(sql, args)
+}
+
+func (c Conn) ExecRArr(sql string, args []any) (ExecResult, error) {
+	before := c.TotalChanges64()
+	if err := c.ExecArr(sql, args); err != nil {
+		return ExecResult{}, err
+	}
+	return execResult(c.db, before), nil
+}
+
+func execResult(db *C.sqlite3, totalChangesBefore int64) ExecResult {
+	result := ExecResult{LastInsertRowID: int64(C.sqlite3_last_insert_rowid(db))}
+	if int64(C.sqlite3_total_changes64(db)) != totalChangesBefore {
+		result.RowsAffected = int64(C.sqlite3_changes64(db))
+	}
+	return result
+}
+
 func (c Conn) MustExec(sql string, args ...any) {
 	c.MustExecArr(sql, args)
 }
@@ -418,8 +496,25 @@ func (c Conn) exec(sql *C.char) error {
 	return nil
 }
 
+// Executes SQL without args through the statement cache. SQL with multiple
+// statements isn't cached, and is run by sqlite3_exec like it would be
+// without the cache (as is SQL which fails to prepare, so that the error
+// is the same either way).
+func (c Conn) execCached(sql []byte) error {
+	s, more, err := c.cachedStmt(c.stmtCache, sql, nil)
+	if err != nil || more || s == nil {
+		if s != nil {
+			s.cache = nil
+			s.Close()
+		}
+		return c.exec(cStr(Terminate(string(sql))))
+	}
+	defer s.Close()
+	return s.StepToCompletion()
+}
+
 func (c Conn) execArgs(sql []byte, args []any) error {
-	s, err := c.Prepare(sql)
+	s, err := c.prepareCached(sql, args)
 	if err != nil {
 		return err
 	}
@@ -428,10 +523,6 @@ func (c Conn) execArgs(sql []byte, args []any) error {
 	}
 	defer s.Close()
 
-	if err = s.Bind(args); err != nil {
-		return err
-	}
-
 	if err = s.StepToCompletion(); err != nil {
 		return err
 	}
@@ -459,6 +550,45 @@ func (c Conn) Transaction(f func() error) error {
 	return nil
 }
 
+// Like Transaction, but uses a savepoint so that it can be nested within
+// a transaction (or another savepoint).
+func (c Conn) Savepoint(f func() error) error {
+	if err := c.exec(spBegin); err != nil {
+		return err
+	}
+
+	err := f()
+	if err != nil {
+		// rolling back to a savepoint leaves it open
+		if c.exec(spRollback) == nil {
+			c.exec(spRelease)
+		}
+		return err
+	}
+
+	if err = c.exec(spRelease); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Statistics for the statement cache. Always zero if Config.StmtCacheSize
+// wasn't set.
+func (c Conn) StmtCacheStats() StmtCacheStats {
+	if cache := c.stmtCache; cache != nil {
+		return cache.statistics()
+	}
+	return StmtCacheStats{}
+}
+
+// Finalizes every cached statement. Statements currently in use go back
+// in the cache when they're closed.
+func (c Conn) ClearStmtCache() {
+	if cache := c.stmtCache; cache != nil {
+		cache.clear()
+	}
+}
+
 func (c Conn) LastInsertRowID() int {
 	return int(C.sqlite3_last_insert_rowid(c.db))
 }
@@ -467,6 +597,12 @@ func (c Conn) Changes() int {
 	return int(C.sqlite3_changes(c.db))
 }
 
+// The number of rows inserted, updated or deleted since the connection was
+// opened, including by triggers.
+func (c Conn) TotalChanges64() int64 {
+	return int64(C.sqlite3_total_changes64(c.db))
+}
+
 func (c Conn) BusyTimeout(d time.Duration) {
 	C.sqlite3_busy_timeout(c.db, C.int(d.Milliseconds()))
 }
@@ -486,6 +622,11 @@ func cBytes(b []byte) unsafe.Pointer {
 	return unsafe.Pointer(h.Data)
 }
 
+func b2s(b []byte) string {
+	/* #nosec G103 */
+	return *(*string)(unsafe.Pointer(&b))
+}
+
 func s2b(s string) (b []byte) {
 	/* #nosec G103 */
 	bh := (*reflect.SliceHeader)(unsafe.Pointer(&b))
@@ -0,0 +1,295 @@
+package sqlite
+
+/*
+#include "sqlite3.h"
+*/
+import "C"
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type CSVConfig struct {
+	// The field delimiter, defaults to ','
+	Comma rune
+
+	// The first record is data rather than the column names. Columns are
+	// then named c1, c2, ... when creating the table, or, when appending,
+	// filled in the table's column order.
+	NoHeader bool
+
+	// Import empty fields as NULL rather than as empty strings
+	EmptyAsNull bool
+
+	// The number of records used to infer the column types when the table
+	// is created, defaults to 100
+	InferRows int
+}
+
+// Returned by ImportCSV for a record which couldn't be imported. Line is the
+// (1-based) line the record starts on.
+type CSVError struct {
+	Line  int
+	error error
+}
+
+func (e CSVError) Unwrap() error {
+	return e.error
+}
+
+func (e CSVError) Error() string {
+	return fmt.Sprintf("%s (line: %d)", e.error.Error(), e.Line)
+}
+
+// Writes the rows of the query as CSV, with the column names as the header.
+// NULLs are written as empty fields and blobs as their raw bytes.
+func (c Conn) ExportCSV(w io.Writer, sql string, args ...any) error {
+	rows := c.RowsArr(sql, args)
+	defer rows.Close()
+	if err := rows.Error(); err != nil {
+		return err
+	}
+
+	stmt := rows.Stmt
+	cw := csv.NewWriter(w)
+	if err := cw.Write(stmt.ColumnNames()); err != nil {
+		return err
+	}
+
+	record := make([]string, stmt.ColumnCount())
+	for rows.Next() {
+		for i := range record {
+			switch stmt.columnTypes[i] {
+			case C.SQLITE_NULL:
+				record[i] = ""
+			case C.SQLITE_INTEGER:
+				record[i] = strconv.FormatInt(stmt.ColumnInt64(i), 10)
+			case C.SQLITE_FLOAT:
+				record[i] = strconv.FormatFloat(stmt.ColumnDouble(i), 'g', -1, 64)
+			default:
+				value, err := stmt.ColumnText(i)
+				if err != nil {
+					return err
+				}
+				record[i] = value
+			}
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+	if err := rows.Error(); err != nil {
+		return err
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+// Imports CSV records into table, creating it if it doesn't exist, within a
+// savepoint (so it can be called within a transaction). When the table is
+// created, each column's type is inferred from the first InferRows records:
+// INTEGER if every non-empty value is an integer, REAL if every one is a
+// number, TEXT otherwise. Only numbers in their canonical form count (e.g.
+// "007" and "+5" are text), so that values read back unchanged. Returns the
+// number of imported records. Errors for a specific record are a CSVError
+// (or, for malformed CSV, a *csv.ParseError).
+func (c Conn) ImportCSV(table string, r io.Reader, config CSVConfig) (int, error) {
+	cr := csv.NewReader(r)
+	cr.ReuseRecord = true
+	if comma := config.Comma; comma != 0 {
+		cr.Comma = comma
+	}
+
+	inferRows := config.InferRows
+	if inferRows <= 0 {
+		inferRows = 100
+	}
+
+	count := 0
+	err := c.Savepoint(func() error {
+		var header []string
+		if !config.NoHeader {
+			record, err := cr.Read()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			header = append(header, record...)
+			header[0] = strings.TrimPrefix(header[0], "\ufeff")
+		}
+
+		var exists bool
+		if err := c.Row("select exists (select 1 from sqlite_schema where type = 'table' and name = ?1 collate nocase)", table).Scan(&exists); err != nil {
+			return err
+		}
+
+		// records read ahead, to infer the column types
+		var buffered [][]string
+		var lines []int
+		if !exists {
+			for len(buffered) < inferRows {
+				record, err := cr.Read()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					return err
+				}
+				line, _ := cr.FieldPos(0)
+				buffered = append(buffered, append([]string(nil), record...))
+				lines = append(lines, line)
+			}
+			if header == nil && len(buffered) == 0 {
+				return nil
+			}
+			if err := c.createCSVTable(table, header, buffered); err != nil {
+				return err
+			}
+		}
+
+		stmt, n, err := c.csvInsert(table, header)
+		if err != nil {
+			return err
+		}
+		defer stmt.Close()
+
+		args := make([]any, n)
+		insert := func(record []string, line int) error {
+			if len(record) != len(args) {
+				return CSVError{Line: line, error: Error{Code: CodeMisuse, Message: fmt.Sprintf("expected %d fields, got %d", len(args), len(record))}}
+			}
+			for i, value := range record {
+				if value == "" && config.EmptyAsNull {
+					args[i] = nil
+				} else {
+					args[i] = value
+				}
+			}
+			if err := stmt.Exec(args...); err != nil {
+				return CSVError{Line: line, error: err}
+			}
+			count += 1
+			return nil
+		}
+
+		for i, record := range buffered {
+			if err := insert(record, lines[i]); err != nil {
+				return err
+			}
+		}
+		for {
+			record, err := cr.Read()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			line, _ := cr.FieldPos(0)
+			if err := insert(record, line); err != nil {
+				return err
+			}
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (c Conn) createCSVTable(table string, header []string, records [][]string) error {
+	n := len(header)
+	if n == 0 {
+		n = len(records[0])
+	}
+
+	columns := make([]string, n)
+	for i := range columns {
+		name := ""
+		if i < len(header) {
+			name = header[i]
+		}
+		if name == "" {
+			name = "c" + strconv.Itoa(i+1)
+		}
+		columns[i] = QuoteIdentifier(name) + " " + inferAffinity(records, i)
+	}
+	return c.Exec("create table " + QuoteIdentifier(table) + " (" + strings.Join(columns, ", ") + ")")
+}
+
+// Prepares the insert statement, returning it and its number of parameters.
+func (c Conn) csvInsert(table string, header []string) (*Stmt, int, error) {
+	var columns []string
+	if header != nil {
+		columns = make([]string, len(header))
+		for i, name := range header {
+			if name == "" {
+				name = "c" + strconv.Itoa(i+1)
+			}
+			columns[i] = QuoteIdentifier(name)
+		}
+	} else {
+		tableColumns, err := c.columns(table, "main")
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, column := range tableColumns {
+			if !column.Generated && !column.Hidden {
+				columns = append(columns, QuoteIdentifier(column.Name))
+			}
+		}
+	}
+
+	params := strings.Repeat("?,", len(columns))
+	sql := "insert into " + QuoteIdentifier(table) + " (" + strings.Join(columns, ",") + ") values (" + params[:len(params)-1] + ")"
+	stmt, err := c.Prepare(s2b(sql))
+	return stmt, len(columns), err
+}
+
+func inferAffinity(records [][]string, column int) string {
+	affinity := ""
+	for _, record := range records {
+		if column >= len(record) {
+			continue
+		}
+		value := record[column]
+		if value == "" {
+			continue
+		}
+		// only values which read back unchanged (as ExportCSV would write
+		// them), so that e.g. "007", "+5" and " 5" stay text
+		if n, err := strconv.ParseInt(value, 10, 64); err == nil && strconv.FormatInt(n, 10) == value {
+			if affinity == "" {
+				affinity = "INTEGER"
+			}
+			continue
+		}
+		if isCanonicalFloat(value) {
+			affinity = "REAL"
+			continue
+		}
+		return "TEXT"
+	}
+	if affinity == "" {
+		return "TEXT"
+	}
+	return affinity
+}
+
+// ParseFloat also accepts values like "inf", "0x1p-2" and "1.50", none of
+// which format back to the same text.
+func isCanonicalFloat(value string) bool {
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+		return false
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64) == value || strconv.FormatFloat(f, 'g', -1, 64) == value
+}
@@ -0,0 +1,406 @@
+package sqlite
+
+/*
+#include "sqlite3.h"
+*/
+import "C"
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+type DumpConfig struct {
+	// Only dump these tables (along with their indexes and triggers) and
+	// views. Dumps everything when empty.
+	Tables []string
+
+	// Only dump the INSERT statements
+	DataOnly bool
+
+	// Only dump the CREATE statements
+	SchemaOnly bool
+}
+
+// Writes the database's schema and data as SQL statements, like the sqlite3
+// CLI's .dump command, but without the surrounding transaction (Restore runs
+// the statements in a savepoint). The database is read within a savepoint,
+// so the dump is consistent. Generated columns aren't dumped, and the rowid
+// of tables without an INTEGER PRIMARY KEY isn't preserved. Virtual tables'
+// data is dumped through the virtual table (their shadow tables are
+// skipped).
+func (c Conn) Dump(w io.Writer, config DumpConfig) error {
+	if config.DataOnly && config.SchemaOnly {
+		return Error{Code: CodeMisuse, Message: "dump can't be both data only and schema only"}
+	}
+	return c.Savepoint(func() error {
+		return c.dump(w, config)
+	})
+}
+
+func (c Conn) dump(w io.Writer, config DumpConfig) error {
+	var filter map[string]bool
+	if len(config.Tables) > 0 {
+		filter = make(map[string]bool, len(config.Tables))
+		for _, table := range config.Tables {
+			filter[table] = true
+		}
+	}
+
+	type object struct {
+		tpe   string
+		name  string
+		table string
+		sql   string
+	}
+
+	var tables, others []object
+	// shadow tables are created (and filled) by their virtual table
+	err := c.each(`
+		select type, name, tbl_name, sql from sqlite_schema
+		where sql is not null and name not like 'sqlite\_%' escape '\'
+			and name not in (select name from pragma_table_list where schema = 'main' and type = 'shadow')
+		order by rowid`, nil, func(rows *Rows) error {
+		var o object
+		if err := rows.Scan(&o.tpe, &o.name, &o.table, &o.sql); err != nil {
+			return err
+		}
+		if filter != nil && !filter[o.table] {
+			return nil
+		}
+		if o.tpe == "table" {
+			tables = append(tables, o)
+		} else {
+			others = append(others, o)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var autoIncrement bool
+	if !config.SchemaOnly {
+		if err := c.Row("select exists (select 1 from sqlite_schema where name = 'sqlite_sequence')").Scan(&autoIncrement); err != nil {
+			return err
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	for _, table := range tables {
+		if !config.DataOnly {
+			writeStatement(bw, table.sql)
+		}
+		if config.SchemaOnly {
+			continue
+		}
+		if err := c.dumpRows(bw, table.name); err != nil {
+			return err
+		}
+		if autoIncrement {
+			if err := c.dumpSequence(bw, table.name); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !config.DataOnly {
+		for _, o := range others {
+			writeStatement(bw, o.sql)
+		}
+	}
+	return bw.Flush()
+}
+
+func (c Conn) dumpRows(bw *bufio.Writer, table string) error {
+	columns, err := c.columns(table, "main")
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	for _, column := range columns {
+		if !column.Generated && !column.Hidden {
+			names = append(names, QuoteIdentifier(column.Name))
+		}
+	}
+	if len(names) == 0 {
+		return nil
+	}
+
+	var withoutRowID bool
+	if err := c.Row("select wr from pragma_table_list where schema = 'main' and name = ?1", table).Scan(&withoutRowID); err != nil {
+		return err
+	}
+
+	list := strings.Join(names, ",")
+	sql := "select " + list + " from " + QuoteIdentifier(table)
+	if !withoutRowID {
+		sql += " order by rowid"
+	}
+
+	prefix := "INSERT INTO " + QuoteIdentifier(table) + "(" + list + ") VALUES("
+	var buf []byte
+	return c.each(sql, nil, func(rows *Rows) error {
+		stmt := rows.Stmt
+		buf = append(buf[:0], prefix...)
+		for i := 0; i < stmt.columnCount; i++ {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			value, err := stmt.value(i)
+			if err != nil {
+				return err
+			}
+			// value is nil for an empty blob
+			if value == nil && stmt.columnTypes[i] == C.SQLITE_BLOB {
+				value = []byte{}
+			}
+			buf = appendValue(buf, value)
+		}
+		buf = append(buf, ");\n"...)
+		_, err := bw.Write(buf)
+		return err
+	})
+}
+
+// Restores the table's AUTOINCREMENT counter, if it has one.
+func (c Conn) dumpSequence(bw *bufio.Writer, table string) error {
+	var seq *int64
+	err := c.Row("select seq from sqlite_sequence where name = ?1", table).Scan(&seq)
+	if err != nil {
+		if err == ErrNoRows {
+			return nil
+		}
+		return err
+	}
+	if seq == nil {
+		return nil
+	}
+
+	name := EscapeLiteral(table)
+	writeStatement(bw, "DELETE FROM sqlite_sequence WHERE name = "+name)
+	writeStatement(bw, "INSERT INTO sqlite_sequence(name,seq) VALUES("+name+","+strconv.FormatInt(*seq, 10)+")")
+	return nil
+}
+
+func writeStatement(bw *bufio.Writer, sql string) {
+	bw.WriteString(sql)
+	bw.WriteString(";\n")
+}
+
+func appendValue(buf []byte, value any) []byte {
+	switch v := value.(type) {
+	case nil:
+		return append(buf, "NULL"...)
+	case int:
+		return strconv.AppendInt(buf, int64(v), 10)
+	case float64:
+		switch {
+		case math.IsNaN(v):
+			return append(buf, "NULL"...)
+		case math.IsInf(v, 1):
+			return append(buf, "1e999"...)
+		case math.IsInf(v, -1):
+			return append(buf, "-1e999"...)
+		}
+		start := len(buf)
+		buf = strconv.AppendFloat(buf, v, 'g', -1, 64)
+		// keep it a REAL in columns without a type
+		if bytes.IndexAny(buf[start:], ".e") == -1 {
+			buf = append(buf, ".0"...)
+		}
+		return buf
+	case string:
+		if strings.IndexByte(v, 0) != -1 {
+			// a literal ends at a NUL
+			buf = append(buf, "CAST(X'"...)
+			buf = append(buf, hex.EncodeToString([]byte(v))...)
+			return append(buf, "' AS TEXT)"...)
+		}
+		return append(buf, EscapeLiteral(v)...)
+	case []byte:
+		buf = append(buf, "X'"...)
+		buf = append(buf, hex.EncodeToString(v)...)
+		return append(buf, '\'')
+	}
+	return buf
+}
+
+// Executes the SQL statements read from r (e.g. written by Conn.Dump) in a
+// savepoint, so it can be called within a transaction. Statements are
+// executed as they're read, and foreign keys are only checked on commit (of
+// the surrounding transaction, if there's one). INSERT statements written by
+// Dump are executed with their values bound as parameters, so that rows with
+// large values aren't limited by SQLITE_MAX_SQL_LENGTH. On error, the
+// savepoint is rolled back and the error is a ScriptError (whose Offset is
+// the statement's byte offset within r).
+func Restore(conn Conn, r io.Reader) error {
+	return conn.Savepoint(func() error {
+		// rows can reference rows which are restored after them
+		if err := conn.Exec("pragma defer_foreign_keys = on"); err != nil {
+			return err
+		}
+
+		br := bufio.NewReader(r)
+		var statement []byte
+
+		index, offset, read := 0, 0, 0
+		for {
+			chunk, readErr := br.ReadBytes(';')
+			if len(statement) == 0 {
+				// skip the whitespace between statements
+				n := len(chunk) - len(bytes.TrimLeft(chunk, " \t\r\n"))
+				chunk = chunk[n:]
+				read += n
+				offset = read
+			}
+			read += len(chunk)
+			statement = append(statement, chunk...)
+
+			if readErr != nil && readErr != io.EOF {
+				return readErr
+			}
+
+			terminated := append(statement, 0)
+			if readErr == io.EOF || C.sqlite3_complete(cStrFromBytes(terminated)) == 1 {
+				if hasSQL(statement) {
+					var err error
+					if sql, values, ok := parseDumpInsert(statement); ok {
+						err = conn.ExecArr(sql, values)
+					} else {
+						err = conn.exec(cStrFromBytes(terminated))
+					}
+					if err != nil {
+						return ScriptError{Index: index, Offset: offset, error: err}
+					}
+					index += 1
+				}
+				statement = terminated[:0]
+			}
+
+			if readErr == io.EOF {
+				return nil
+			}
+		}
+	})
+}
+
+// Parses an INSERT statement as written by Dump, returning it with its
+// values replaced by parameters, along with the values. ok is false for
+// any other statement.
+func parseDumpInsert(statement []byte) (sql string, values []any, ok bool) {
+	const prefix = "INSERT INTO "
+	rest := string(bytes.TrimRight(statement, " \t\r\n"))
+	if !strings.HasPrefix(rest, prefix) || !strings.HasSuffix(rest, ");") {
+		return "", nil, false
+	}
+
+	// the table and the column list, up to the values
+	i := len(prefix)
+	if end := quotedEnd(rest, i); end > i {
+		i = end
+	} else {
+		return "", nil, false
+	}
+	if i >= len(rest) || rest[i] != '(' {
+		return "", nil, false
+	}
+	for i += 1; i < len(rest) && rest[i] != ')'; {
+		end := quotedEnd(rest, i)
+		if end == i {
+			return "", nil, false
+		}
+		i = end
+		if i < len(rest) && rest[i] == ',' {
+			i += 1
+		}
+	}
+	if !strings.HasPrefix(rest[i:], ") VALUES(") {
+		return "", nil, false
+	}
+	head := rest[:i] + ") VALUES("
+	i += len(") VALUES(")
+
+	last := len(rest) - 2
+	for i < last {
+		value, n, ok := parseDumpValue(rest[i:last])
+		if !ok {
+			return "", nil, false
+		}
+		values = append(values, value)
+		i += n
+		if i < last {
+			if rest[i] != ',' {
+				return "", nil, false
+			}
+			i += 1
+		}
+	}
+	if i != last || len(values) == 0 {
+		return "", nil, false
+	}
+
+	params := strings.Repeat("?,", len(values))
+	return head + params[:len(params)-1] + ")", values, true
+}
+
+// Parses one of the values written by appendValue, returning it and the
+// number of bytes it took.
+func parseDumpValue(s string) (any, int, bool) {
+	switch {
+	case strings.HasPrefix(s, "NULL"):
+		return nil, 4, true
+	case strings.HasPrefix(s, "'"):
+		var sb strings.Builder
+		for i := 1; i < len(s); i++ {
+			if s[i] != '\'' {
+				sb.WriteByte(s[i])
+				continue
+			}
+			// a doubled quote is an escaped quote
+			if i+1 < len(s) && s[i+1] == '\'' {
+				sb.WriteByte('\'')
+				i += 1
+				continue
+			}
+			return sb.String(), i + 1, true
+		}
+	case strings.HasPrefix(s, "X'"):
+		end := strings.IndexByte(s[2:], '\'')
+		if end == -1 {
+			return nil, 0, false
+		}
+		b, err := hex.DecodeString(s[2 : 2+end])
+		return b, 2 + end + 1, err == nil
+	case strings.HasPrefix(s, "CAST(X'"):
+		end := strings.Index(s, "' AS TEXT)")
+		if end == -1 {
+			return nil, 0, false
+		}
+		b, err := hex.DecodeString(s[7:end])
+		return string(b), end + len("' AS TEXT)"), err == nil
+	default:
+		end := strings.IndexByte(s, ',')
+		if end == -1 {
+			end = len(s)
+		}
+		number := s[:end]
+		if !strings.ContainsAny(number, ".e") {
+			n, err := strconv.ParseInt(number, 10, 64)
+			return n, end, err == nil
+		}
+		f, err := strconv.ParseFloat(number, 64)
+		// 1e999 and -1e999 are infinite
+		if err != nil && !math.IsInf(f, 0) {
+			return nil, 0, false
+		}
+		return f, end, true
+	}
+	return nil, 0, false
+}
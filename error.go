@@ -8,19 +8,82 @@ import "C"
 import (
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 )
 
 type Error struct {
 	Code    int
 	Message string
+
+	// set for an access denied by the sqlkite_assert* functions
+	denied *AccessDeniedError
+}
+
+// Details of a constraint violation, as much as SQLite's error message
+// reveals. Table and Columns are set for unique, primary key and not null
+// violations. Name is set for check violations (the constraint's name, or
+// its expression if it's unnamed) and for unique indexes on expressions
+// (the index name).
+//
+// Table and Columns are best-effort: the message doesn't quote names, so
+// each "table.column" is split at its first dot. A table name containing a
+// dot, or a name containing ", ", isn't parsed correctly (a column name
+// containing a dot is).
+type Constraint struct {
+	Code    int
+	Table   string
+	Columns []string
+	Name    string
+}
+
+// The primary result code (the low 8 bits of the extended code).
+func (err Error) Primary() int {
+	return err.Code & 0xff
 }
 
 func IsUniqueErr(err error) bool {
-	var sqliteErr Error
-	if !errors.As(err, &sqliteErr) {
-		return false
-	}
-	return sqliteErr.Code == 2067
+	return hasCode(err, CodeConstraintUnique)
+}
+
+func IsConstraint(err error) bool {
+	return hasPrimary(err, CodeConstraint)
+}
+
+func IsForeignKey(err error) bool {
+	return hasCode(err, CodeConstraintForeignKey)
+}
+
+func IsNotNull(err error) bool {
+	return hasCode(err, CodeConstraintNotNull)
+}
+
+func IsCheck(err error) bool {
+	return hasCode(err, CodeConstraintCheck)
+}
+
+func IsPrimaryKey(err error) bool {
+	return hasCode(err, CodeConstraintPrimaryKey)
+}
+
+func IsBusy(err error) bool {
+	return hasPrimary(err, CodeBusy)
+}
+
+func IsLocked(err error) bool {
+	return hasPrimary(err, CodeLocked)
+}
+
+func IsReadOnly(err error) bool {
+	return hasPrimary(err, CodeReadOnly)
+}
+
+func IsCorrupt(err error) bool {
+	return hasPrimary(err, CodeCorrupt)
+}
+
+func IsFull(err error) bool {
+	return hasPrimary(err, CodeFull)
 }
 
 func UniqueConstraintName(err error) string {
@@ -28,15 +91,83 @@ func UniqueConstraintName(err error) string {
 	if !errors.As(err, &sqliteErr) {
 		return ""
 	}
-	if sqliteErr.Code != 2067 {
+	if sqliteErr.Code != CodeConstraintUnique {
 		return ""
 	}
+	return strings.TrimPrefix(sqliteErr.Message, "UNIQUE constraint failed: ")
+}
+
+// Parses the constraint violation details out of err. Returns false if err
+// isn't a constraint violation.
+func ConstraintInfo(err error) (Constraint, bool) {
+	var sqliteErr Error
+	if !errors.As(err, &sqliteErr) || sqliteErr.Primary() != CodeConstraint {
+		return Constraint{}, false
+	}
+
+	c := Constraint{Code: sqliteErr.Code}
 	message := sqliteErr.Message
-	if len(message) < 26 {
-		return ""
+
+	switch c.Code {
+	case CodeConstraintUnique, CodeConstraintPrimaryKey:
+		// primary key violations also say "UNIQUE"
+		detail, ok := cutPrefix(message, "UNIQUE constraint failed: ")
+		if !ok {
+			break
+		}
+		if name, ok := cutPrefix(detail, "index '"); ok {
+			c.Name = strings.TrimSuffix(name, "'")
+			break
+		}
+		c.Table, c.Columns = parseConstraintColumns(detail)
+	case CodeConstraintNotNull:
+		if detail, ok := cutPrefix(message, "NOT NULL constraint failed: "); ok {
+			c.Table, c.Columns = parseConstraintColumns(detail)
+		}
+	case CodeConstraintCheck:
+		if detail, ok := cutPrefix(message, "CHECK constraint failed: "); ok {
+			c.Name = detail
+		}
+	}
+	return c, true
+}
+
+// "table.col1, table.col2", names aren't quoted
+func parseConstraintColumns(detail string) (string, []string) {
+	var table string
+	parts := strings.Split(detail, ", ")
+	columns := make([]string, len(parts))
+	for i, part := range parts {
+		if dot := strings.IndexByte(part, '.'); dot != -1 {
+			table = part[:dot]
+			part = part[dot+1:]
+		}
+		columns[i] = part
 	}
+	return table, columns
+}
 
-	return message[26:]
+func cutPrefix(s string, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+func hasCode(err error, code int) bool {
+	var sqliteErr Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code == code
+}
+
+func hasPrimary(err error, code int) bool {
+	var sqliteErr Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Primary() == code
 }
 
 func errorFromCode(db *C.sqlite3, rc C.int) error {
@@ -49,6 +180,7 @@ func errorFromCode(db *C.sqlite3, rc C.int) error {
 	return Error{
 		Code:    int(rc),
 		Message: message,
+		denied:  accessDenied(db, message),
 	}
 }
 
@@ -56,17 +188,59 @@ func (err Error) Error() string {
 	return fmt.Sprintf("sqlite: %s (code: %d)", err.Message, err.Code)
 }
 
+// An access denial matches ErrRowAccess
+func (err Error) Is(target error) bool {
+	return target == ErrRowAccess && err.denied != nil
+}
+
+// An access denial can be read into an *AccessDeniedError
+func (err Error) As(target any) bool {
+	denied, ok := target.(*AccessDeniedError)
+	if !ok || err.denied == nil {
+		return false
+	}
+	*denied = *err.denied
+	return true
+}
+
+// Returned when a value doesn't fit: either a Go value being bound which
+// can't be represented as an SQLite integer, or a column being scanned into
+// a type too narrow for it (including a real which isn't integral scanned
+// into an integer). Index is the bind index or column index (0-based).
+type RangeError struct {
+	Index int
+	Value any
+	Type  string
+}
+
+func (err RangeError) Error() string {
+	return fmt.Sprintf("sqlite: %v is out of range for %s (index: %d)", err.Value, err.Type, err.Index)
+}
+
+// The package-level default for Config.PrepareErrorArgTypes: when true,
+// PrepareError.Error() includes the types (never the values) of the arguments
+// that were given along with the SQL. Read when a connection is opened.
+var PrepareErrorArgTypes = false
+
 type PrepareError struct {
-	sql   string
-	args  []any
-	error error
+	sql    string
+	args   []any
+	offset int
+	error  error
+
+	// see Config.PrepareErrorArgTypes
+	argTypes bool
 }
 
-func prepareError(db *C.sqlite3, rc C.int, sql string, args []any) PrepareError {
+func prepareError(db *C.sqlite3, rc C.int, sql string, args []any, argTypes bool) PrepareError {
+	// must be called before anything else happens on db
+	offset := int(C.sqlite3_error_offset(db))
 	return PrepareError{
-		sql:   sql,
-		args:  args,
-		error: errorFromCode(db, rc),
+		sql:      sql,
+		args:     args,
+		offset:   offset,
+		error:    errorFromCode(db, rc),
+		argTypes: argTypes,
 	}
 }
 
@@ -74,8 +248,86 @@ func (e PrepareError) Unwrap() error {
 	return e.error
 }
 
+func (err PrepareError) SQL() string {
+	return err.sql
+}
+
+// The byte offset within the SQL of the token which caused the error, or
+// -1 if SQLite didn't identify one.
+func (err PrepareError) Offset() int {
+	return err.offset
+}
+
+// The type of each argument, e.g. ["int", "string", "nil"]
+func (err PrepareError) ArgTypes() []string {
+	types := make([]string, len(err.args))
+	for i, arg := range err.args {
+		if arg == nil {
+			types[i] = "nil"
+		} else {
+			types[i] = fmt.Sprintf("%T", arg)
+		}
+	}
+	return types
+}
+
 func (err PrepareError) Error() string {
-	// not using the args for now
-	// not sure we should...performance, privacy, ...
+	// values are never included: performance, privacy, ...
+	if err.argTypes && len(err.args) > 0 {
+		return fmt.Sprintf("%s - %s [%s]", err.error.Error(), err.sql, strings.Join(err.ArgTypes(), ", "))
+	}
 	return fmt.Sprintf("%s - %s", err.error.Error(), err.sql)
 }
+
+// A multi-line description of the error, showing the line of SQL where the
+// error happened with a caret pointing to the offending token:
+//
+//	sqlite: no such column: invalid (code: 1)
+//	2 | select invalid
+//	  |        ^
+func (err PrepareError) Pretty() string {
+	var sb strings.Builder
+	sb.WriteString(err.error.Error())
+	if err.argTypes && len(err.args) > 0 {
+		sb.WriteString(" [")
+		sb.WriteString(strings.Join(err.ArgTypes(), ", "))
+		sb.WriteString("]")
+	}
+
+	sql := err.sql
+	offset := err.offset
+	if offset < 0 || offset > len(sql) {
+		sb.WriteString("\n")
+		sb.WriteString(sql)
+		return sb.String()
+	}
+
+	lineNumber := strings.Count(sql[:offset], "\n") + 1
+	start := strings.LastIndexByte(sql[:offset], '\n') + 1
+	end := strings.IndexByte(sql[offset:], '\n')
+	if end == -1 {
+		end = len(sql)
+	} else {
+		end += offset
+	}
+
+	gutter := strconv.Itoa(lineNumber)
+	sb.WriteString("\n")
+	sb.WriteString(gutter)
+	sb.WriteString(" | ")
+	sb.WriteString(sql[start:end])
+	sb.WriteString("\n")
+	sb.WriteString(strings.Repeat(" ", len(gutter)))
+	sb.WriteString(" | ")
+
+	// keep tabs so that the caret lines up with the line above
+	for _, r := range sql[start:offset] {
+		if r == '\t' {
+			sb.WriteByte('\t')
+		} else {
+			sb.WriteByte(' ')
+		}
+	}
+	sb.WriteByte('^')
+	return sb.String()
+}
@@ -0,0 +1,72 @@
+package sqlite
+
+/*
+#include "sqlite3.h"
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+var jsonNull = []byte("null")
+
+// Binds Value as JSON text and unmarshals a scanned column into Value.
+// To use it as a destination for an existing value, use a pointer:
+//
+//	var user User
+//	row.Scan(&sqlite.JSON[*User]{Value: &user})
+//
+// SQLite doesn't preserve subtypes on bound parameters, so to embed the
+// bound value as JSON (rather than as a string) within another JSON value,
+// wrap the parameter in json(), e.g. json_object('user', json(?1)).
+//
+// A null column is unmarshalled like the JSON null value.
+type JSON[T any] struct {
+	Value T
+}
+
+type jsonBinder interface {
+	marshalJSON() ([]byte, error)
+}
+
+type jsonScanner interface {
+	scanJSON(s *Stmt, i int) error
+}
+
+func (j JSON[T]) marshalJSON() ([]byte, error) {
+	return json.Marshal(j.Value)
+}
+
+func (j *JSON[T]) scanJSON(s *Stmt, i int) error {
+	return s.ColumnJSON(i, &j.Value)
+}
+
+func (s *Stmt) bindJSON(i int, v jsonBinder) error {
+	data, err := v.marshalJSON()
+	if err != nil {
+		return Error{Code: C.SQLITE_MISMATCH, Message: fmt.Sprintf("json marshal %s (index: %d)", err, i)}
+	}
+	// unlike a string, an empty []byte is never possible here
+	rc := C.sqlite3_bind_text(s.stmt, C.int(i+1), (*C.char)(cBytes(data)), C.int(len(data)), C.SQLITE_TRANSIENT)
+	if rc != C.SQLITE_OK {
+		return errorFromCode(s.db, rc)
+	}
+	return nil
+}
+
+// Unmarshals the column into dst, reading directly from SQLite's buffer.
+func (s *Stmt) ColumnJSON(i int, dst any) error {
+	data, err := s.ColumnRawText(i)
+	if err != nil {
+		return err
+	}
+	if data == nil {
+		data = jsonNull
+	}
+	if err := json.Unmarshal(data, dst); err != nil {
+		return Error{Code: C.SQLITE_MISMATCH, Message: fmt.Sprintf("json unmarshal %s (index: %d)", err, i)}
+	}
+	return nil
+}
@@ -0,0 +1,223 @@
+package sqlite
+
+/*
+#include "sqlite3.h"
+*/
+import "C"
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math"
+	"strconv"
+	"unicode/utf8"
+)
+
+type JSONFormat int
+
+const (
+	// [{"id":1,"name":"leto"},...]
+	JSONObjects JSONFormat = iota
+
+	// {"id":1,"name":"leto"}\n... (NDJSON)
+	JSONLines
+
+	// [[1,"leto"],...]
+	JSONArrays
+)
+
+// The subtype the JSON1 functions give their (JSON text) results
+const jsonSubtype = 'J'
+
+const hexDigits = "0123456789abcdef"
+
+type JSONConfig struct {
+	Format JSONFormat
+
+	// Maximum number of rows to write, 0 (or negative) for no limit
+	Limit int
+
+	// Columns holding JSON text (e.g. a column storing JSON) which are
+	// written as-is rather than as a string. A value which isn't valid JSON is
+	// still written as a string. Text produced by JSON1 functions, e.g.
+	// json_object(...), is always written as-is.
+	RawColumns []string
+}
+
+// Writes the rows of the query as an array of JSON objects, keyed by column
+// name, encoding each value directly from SQLite's buffers. Blobs are
+// written as base64 strings, and NaN and infinite reals as null.
+func (c Conn) WriteJSON(w io.Writer, sql string, args ...any) error {
+	return c.WriteJSONConfig(w, JSONConfig{}, sql, args...)
+}
+
+func (c Conn) WriteJSONConfig(w io.Writer, config JSONConfig, sql string, args ...any) error {
+	rows := c.RowsArr(sql, args)
+	defer rows.Close()
+	if err := rows.Error(); err != nil {
+		return err
+	}
+
+	stmt := rows.Stmt
+	columns := stmt.ColumnNames()
+	format := config.Format
+
+	raw := make([]bool, len(columns))
+	for _, name := range config.RawColumns {
+		for i, column := range columns {
+			if column == name {
+				raw[i] = true
+			}
+		}
+	}
+
+	// `"name":` for each column, encoded once
+	var keys [][]byte
+	if format != JSONArrays {
+		keys = make([][]byte, len(columns))
+		for i, column := range columns {
+			keys[i] = append(appendJSONString(nil, []byte(column)), ':')
+		}
+	}
+
+	begin, end := byte('{'), byte('}')
+	if format == JSONArrays {
+		begin, end = '[', ']'
+	}
+
+	bw := bufio.NewWriter(w)
+	var buf []byte
+	if format != JSONLines {
+		bw.WriteByte('[')
+	}
+
+	count := 0
+	for (config.Limit <= 0 || count < config.Limit) && rows.Next() {
+		buf = buf[:0]
+		if count > 0 && format != JSONLines {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, begin)
+		for i := range columns {
+			if i > 0 {
+				buf = append(buf, ',')
+			}
+			if keys != nil {
+				buf = append(buf, keys[i]...)
+			}
+			var err error
+			if buf, err = stmt.appendJSONValue(buf, i, raw[i]); err != nil {
+				return err
+			}
+		}
+		buf = append(buf, end)
+		if format == JSONLines {
+			buf = append(buf, '\n')
+		}
+
+		if _, err := bw.Write(buf); err != nil {
+			return err
+		}
+		count += 1
+	}
+	if err := rows.Error(); err != nil {
+		return err
+	}
+
+	if format != JSONLines {
+		bw.WriteByte(']')
+	}
+	return bw.Flush()
+}
+
+func (s *Stmt) appendJSONValue(buf []byte, i int, raw bool) ([]byte, error) {
+	switch s.columnTypes[i] {
+	case C.SQLITE_INTEGER:
+		return strconv.AppendInt(buf, s.ColumnInt64(i), 10), nil
+	case C.SQLITE_FLOAT:
+		f := s.ColumnDouble(i)
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			return append(buf, "null"...), nil
+		}
+		return strconv.AppendFloat(buf, f, 'g', -1, 64), nil
+	case C.SQLITE_TEXT:
+		value, err := s.ColumnRawText(i)
+		if err != nil {
+			return buf, err
+		}
+		if s.columnSubtype(i) == jsonSubtype || (raw && json.Valid(value)) {
+			return append(buf, value...), nil
+		}
+		return appendJSONString(buf, value), nil
+	case C.SQLITE_BLOB:
+		value, err := s.ColumnRawBytes(i)
+		if err != nil {
+			return buf, err
+		}
+		buf = append(buf, '"')
+		start := len(buf)
+		n := base64.StdEncoding.EncodedLen(len(value))
+		if size := start + n; size > cap(buf) {
+			grown := make([]byte, start, size*2)
+			copy(grown, buf)
+			buf = grown
+		}
+		buf = buf[:start+n]
+		base64.StdEncoding.Encode(buf[start:], value)
+		return append(buf, '"'), nil
+	}
+	return append(buf, "null"...), nil
+}
+
+// Like encoding/json, invalid UTF-8 is replaced with U+FFFD and U+2028 and
+// U+2029 are escaped (but <, > and & aren't).
+func appendJSONString(buf []byte, s []byte) []byte {
+	buf = append(buf, '"')
+	start := 0
+	for i := 0; i < len(s); {
+		b := s[i]
+		if b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' {
+				i += 1
+				continue
+			}
+			buf = append(buf, s[start:i]...)
+			switch b {
+			case '"', '\\':
+				buf = append(buf, '\\', b)
+			case '\n':
+				buf = append(buf, '\\', 'n')
+			case '\r':
+				buf = append(buf, '\\', 'r')
+			case '\t':
+				buf = append(buf, '\\', 't')
+			default:
+				buf = append(buf, '\\', 'u', '0', '0', hexDigits[b>>4], hexDigits[b&0xF])
+			}
+			i += 1
+			start = i
+			continue
+		}
+
+		r, size := utf8.DecodeRune(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, "\ufffd"...)
+			i += size
+			start = i
+			continue
+		}
+		if r == '\u2028' || r == '\u2029' {
+			buf = append(buf, s[start:i]...)
+			buf = append(buf, '\\', 'u', '2', '0', '2', hexDigits[r&0xF])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	buf = append(buf, s[start:]...)
+	return append(buf, '"')
+}
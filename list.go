@@ -0,0 +1,296 @@
+package sqlite
+
+/*
+#include <string.h>
+#include "sqlite3.h"
+
+#define SQLKITE_LIST "sqlite_list"
+#define SQLKITE_LIST_INT 1
+#define SQLKITE_LIST_FLOAT 2
+#define SQLKITE_LIST_TEXT 3
+
+// A list bound to a statement (with sqlite3_bind_pointer). The values are
+// allocated along with the list, in a single allocation, so that the list
+// is freed with sqlite3_free.
+typedef struct sqlkite_list {
+	int type;
+	int count;
+	sqlite3_int64 *ints;
+	double *floats;
+	int *lengths;
+	char **texts;
+	char *data;
+} sqlkite_list;
+
+// data holds text_bytes of (concatenated) text. The caller fills in the
+// values (for text: data and lengths, then calls sqlkite_list_index).
+static sqlkite_list *sqlkite_list_new(int type, int count, sqlite3_int64 text_bytes) {
+	sqlite3_int64 size = sizeof(sqlkite_list);
+	if (type == SQLKITE_LIST_TEXT) {
+		size += count * (sizeof(char *) + sizeof(int)) + text_bytes;
+	} else {
+		size += count * sizeof(sqlite3_int64);
+	}
+
+	sqlkite_list *list = sqlite3_malloc64(size);
+	if (list == 0) {
+		return 0;
+	}
+	memset(list, 0, sizeof(sqlkite_list));
+	list->type = type;
+	list->count = count;
+
+	char *values = (char *)(list + 1);
+	switch (type) {
+	case SQLKITE_LIST_INT:
+		list->ints = (sqlite3_int64 *)values;
+		break;
+	case SQLKITE_LIST_FLOAT:
+		list->floats = (double *)values;
+		break;
+	case SQLKITE_LIST_TEXT:
+		list->texts = (char **)values;
+		list->lengths = (int *)(values + count * sizeof(char *));
+		list->data = values + count * (sizeof(char *) + sizeof(int));
+		break;
+	}
+	return list;
+}
+
+static void sqlkite_list_index(sqlkite_list *list) {
+	char *text = list->data;
+	for (int i = 0; i < list->count; i++) {
+		list->texts[i] = text;
+		text += list->lengths[i];
+	}
+}
+
+static int sqlkite_list_bind(sqlite3_stmt *stmt, int i, sqlkite_list *list) {
+	return sqlite3_bind_pointer(stmt, i, list, SQLKITE_LIST, sqlite3_free);
+}
+
+// sqlite_list(?) is an eponymous virtual table over a list bound to ?
+typedef struct sqlkite_list_cursor {
+	sqlite3_vtab_cursor base;
+	sqlkite_list *list;
+	int row;
+} sqlkite_list_cursor;
+
+static int sqlkite_list_connect(sqlite3 *db, void *aux, int argc, const char *const *argv, sqlite3_vtab **out, char **err) {
+	int rc = sqlite3_declare_vtab(db, "create table x(value, list hidden)");
+	if (rc != SQLITE_OK) {
+		return rc;
+	}
+
+	sqlite3_vtab *vtab = sqlite3_malloc(sizeof(sqlite3_vtab));
+	if (vtab == 0) {
+		return SQLITE_NOMEM;
+	}
+	memset(vtab, 0, sizeof(sqlite3_vtab));
+	sqlite3_vtab_config(db, SQLITE_VTAB_INNOCUOUS);
+	*out = vtab;
+	return SQLITE_OK;
+}
+
+static int sqlkite_list_disconnect(sqlite3_vtab *vtab) {
+	sqlite3_free(vtab);
+	return SQLITE_OK;
+}
+
+static int sqlkite_list_open(sqlite3_vtab *vtab, sqlite3_vtab_cursor **out) {
+	sqlkite_list_cursor *cursor = sqlite3_malloc(sizeof(sqlkite_list_cursor));
+	if (cursor == 0) {
+		return SQLITE_NOMEM;
+	}
+	memset(cursor, 0, sizeof(sqlkite_list_cursor));
+	*out = &cursor->base;
+	return SQLITE_OK;
+}
+
+static int sqlkite_list_close(sqlite3_vtab_cursor *cursor) {
+	sqlite3_free(cursor);
+	return SQLITE_OK;
+}
+
+static int sqlkite_list_best_index(sqlite3_vtab *vtab, sqlite3_index_info *info) {
+	for (int i = 0; i < info->nConstraint; i++) {
+		const struct sqlite3_index_constraint *c = &info->aConstraint[i];
+		if (c->iColumn != 1 || c->op != SQLITE_INDEX_CONSTRAINT_EQ) {
+			continue;
+		}
+		if (!c->usable) {
+			return SQLITE_CONSTRAINT;
+		}
+		info->aConstraintUsage[i].argvIndex = 1;
+		info->aConstraintUsage[i].omit = 1;
+		info->estimatedCost = 1;
+		info->estimatedRows = 100;
+		info->idxNum = 1;
+		return SQLITE_OK;
+	}
+
+	// without a list, there are no rows
+	info->estimatedCost = 1;
+	info->estimatedRows = 1;
+	info->idxNum = 0;
+	return SQLITE_OK;
+}
+
+static int sqlkite_list_filter(sqlite3_vtab_cursor *cur, int idxNum, const char *idxStr, int argc, sqlite3_value **argv) {
+	sqlkite_list_cursor *cursor = (sqlkite_list_cursor *)cur;
+	cursor->list = idxNum == 1 ? sqlite3_value_pointer(argv[0], SQLKITE_LIST) : 0;
+	cursor->row = 0;
+	return SQLITE_OK;
+}
+
+static int sqlkite_list_next(sqlite3_vtab_cursor *cur) {
+	((sqlkite_list_cursor *)cur)->row += 1;
+	return SQLITE_OK;
+}
+
+static int sqlkite_list_eof(sqlite3_vtab_cursor *cur) {
+	sqlkite_list_cursor *cursor = (sqlkite_list_cursor *)cur;
+	return cursor->list == 0 || cursor->row >= cursor->list->count;
+}
+
+static int sqlkite_list_column(sqlite3_vtab_cursor *cur, sqlite3_context *context, int column) {
+	sqlkite_list_cursor *cursor = (sqlkite_list_cursor *)cur;
+	if (column != 0) {
+		// the (hidden) list itself
+		sqlite3_result_null(context);
+		return SQLITE_OK;
+	}
+
+	sqlkite_list *list = cursor->list;
+	int row = cursor->row;
+	switch (list->type) {
+	case SQLKITE_LIST_INT:
+		sqlite3_result_int64(context, list->ints[row]);
+		break;
+	case SQLKITE_LIST_FLOAT:
+		sqlite3_result_double(context, list->floats[row]);
+		break;
+	case SQLKITE_LIST_TEXT:
+		sqlite3_result_text(context, list->texts[row], list->lengths[row], SQLITE_TRANSIENT);
+		break;
+	}
+	return SQLITE_OK;
+}
+
+static int sqlkite_list_rowid(sqlite3_vtab_cursor *cur, sqlite3_int64 *rowid) {
+	*rowid = ((sqlkite_list_cursor *)cur)->row + 1;
+	return SQLITE_OK;
+}
+
+static sqlite3_module sqlkite_list_module = {
+	0,                        // iVersion
+	0,                        // xCreate (eponymous only)
+	sqlkite_list_connect,     // xConnect
+	sqlkite_list_best_index,  // xBestIndex
+	sqlkite_list_disconnect,  // xDisconnect
+	0,                        // xDestroy
+	sqlkite_list_open,        // xOpen
+	sqlkite_list_close,       // xClose
+	sqlkite_list_filter,      // xFilter
+	sqlkite_list_next,        // xNext
+	sqlkite_list_eof,         // xEof
+	sqlkite_list_column,      // xColumn
+	sqlkite_list_rowid,       // xRowid
+};
+
+static int sqlkite_list_register(sqlite3 *db) {
+	return sqlite3_create_module(db, SQLKITE_LIST, &sqlkite_list_module, 0);
+}
+*/
+import "C"
+
+import (
+	"unsafe"
+)
+
+// A list of values, created with List, to bind as a single parameter for
+// use with sqlite_list.
+type ListArg struct {
+	values any
+}
+
+// Wraps a slice so that it can be bound as a single parameter and used as a
+// list of values with the sqlite_list table-valued function, avoiding a
+// parameter per value (and a different statement for each list length):
+//
+//	select * from users where id in sqlite_list(?1)
+//	select * from users where id in (select value from sqlite_list(?1))
+//
+// The list is copied when bound. Outside of sqlite_list, the bound value
+// behaves like NULL.
+func List[T int | int64 | float64 | string](values []T) ListArg {
+	return ListArg{values: values}
+}
+
+func registerList(db *C.sqlite3) C.int {
+	return C.sqlkite_list_register(db)
+}
+
+func (s *Stmt) bindList(bindIndex C.int, l ListArg) C.int {
+	switch v := l.values.(type) {
+	case []int:
+		values := make([]int64, len(v))
+		for i, value := range v {
+			values[i] = int64(value)
+		}
+		return s.bindIntList(bindIndex, values)
+	case []int64:
+		return s.bindIntList(bindIndex, v)
+	case []float64:
+		return s.bindFloatList(bindIndex, v)
+	case []string:
+		return s.bindTextList(bindIndex, v)
+	}
+	// the zero ListArg
+	return s.bindIntList(bindIndex, nil)
+}
+
+func (s *Stmt) bindIntList(bindIndex C.int, values []int64) C.int {
+	list := C.sqlkite_list_new(C.SQLKITE_LIST_INT, C.int(len(values)), 0)
+	if list == nil {
+		return C.SQLITE_NOMEM
+	}
+	if len(values) > 0 {
+		copy(unsafe.Slice((*int64)(unsafe.Pointer(list.ints)), len(values)), values)
+	}
+	return C.sqlkite_list_bind(s.stmt, bindIndex, list)
+}
+
+func (s *Stmt) bindFloatList(bindIndex C.int, values []float64) C.int {
+	list := C.sqlkite_list_new(C.SQLKITE_LIST_FLOAT, C.int(len(values)), 0)
+	if list == nil {
+		return C.SQLITE_NOMEM
+	}
+	if len(values) > 0 {
+		copy(unsafe.Slice((*float64)(unsafe.Pointer(list.floats)), len(values)), values)
+	}
+	return C.sqlkite_list_bind(s.stmt, bindIndex, list)
+}
+
+func (s *Stmt) bindTextList(bindIndex C.int, values []string) C.int {
+	total := 0
+	for _, value := range values {
+		total += len(value)
+	}
+
+	list := C.sqlkite_list_new(C.SQLKITE_LIST_TEXT, C.int(len(values)), C.sqlite3_int64(total))
+	if list == nil {
+		return C.SQLITE_NOMEM
+	}
+	if len(values) > 0 {
+		lengths := unsafe.Slice((*C.int)(unsafe.Pointer(list.lengths)), len(values))
+		data := unsafe.Slice((*byte)(unsafe.Pointer(list.data)), total)
+		n := 0
+		for i, value := range values {
+			lengths[i] = C.int(len(value))
+			n += copy(data[n:], value)
+		}
+		C.sqlkite_list_index(list)
+	}
+	return C.sqlkite_list_bind(s.stmt, bindIndex, list)
+}
@@ -0,0 +1,78 @@
+package migrate
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// Loads SQL migrations from the files in dir. Files are named
+// <version>_<name>.up.sql and (optionally) <version>_<name>.down.sql, e.g.
+// 0001_create_users.up.sql. Other files are ignored. Each migration's
+// Checksum is a hash of its up SQL.
+func FS(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []Migration
+	lookup := make(map[int]int)
+	downs := make(map[int]string)
+
+	for _, entry := range entries {
+		fileName := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(fileName, ".sql") {
+			continue
+		}
+
+		base := strings.TrimSuffix(fileName, ".sql")
+		down := strings.HasSuffix(base, ".down")
+		if !down && !strings.HasSuffix(base, ".up") {
+			continue
+		}
+		base = base[:strings.LastIndexByte(base, '.')]
+
+		prefix, name, _ := strings.Cut(base, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migrate: invalid version in file name %s", fileName)
+		}
+
+		data, err := fs.ReadFile(fsys, path.Join(dir, fileName))
+		if err != nil {
+			return nil, err
+		}
+		sql := string(data)
+
+		if down {
+			downs[version] = sql
+			continue
+		}
+		if _, exists := lookup[version]; exists {
+			return nil, fmt.Errorf("migrate: duplicate version %d", version)
+		}
+
+		checksum := sha256.Sum256(data)
+		lookup[version] = len(migrations)
+		migrations = append(migrations, Migration{
+			Version:  version,
+			Name:     name,
+			Checksum: hex.EncodeToString(checksum[:]),
+			Up:       SQL(sql),
+		})
+	}
+
+	for version, sql := range downs {
+		i, ok := lookup[version]
+		if !ok {
+			return nil, fmt.Errorf("migrate: down migration %d has no up migration", version)
+		}
+		migrations[i].Down = SQL(sql)
+	}
+	return migrations, nil
+}
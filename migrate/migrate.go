@@ -0,0 +1,430 @@
+// Package migrate applies ordered schema migrations to a SQLite database.
+//
+// Each migration runs in its own transaction (see sqlite.Conn.Transaction)
+// and is followed by a foreign key check. Foreign key enforcement is
+// disabled while migrations run (it can't be toggled within a transaction)
+// so that tables can be rebuilt (see Rebuild). Applied migrations are
+// tracked either with PRAGMA user_version, or, when Config.HistoryTable is
+// set, in a table which also records each migration's checksum.
+package migrate
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"src.goblgobl.com/sqlite"
+)
+
+var (
+	ErrDryRun = errors.New("migrate: dry run")
+)
+
+type Migration struct {
+	// Must be unique and greater than 0. Migrations are applied in
+	// ascending Version order.
+	Version int
+	Name    string
+
+	// Recorded in the history table and verified against the recorded value
+	// of applied migrations. Set by FS to a hash of the migration's SQL.
+	// Optional for Go migrations.
+	Checksum string
+
+	Up func(conn sqlite.Conn) error
+
+	// Optional, but required to migrate down past this migration.
+	Down func(conn sqlite.Conn) error
+}
+
+type Config struct {
+	// When set, applied migrations are recorded in this table rather than in
+	// PRAGMA user_version. The table is created, if it doesn't exist, when a
+	// migration is applied.
+	HistoryTable string
+
+	// Runs the migrations and the foreign key checks, but rolls everything
+	// back rather than committing.
+	DryRun bool
+}
+
+type Migrator struct {
+	conn       sqlite.Conn
+	migrations []Migration
+	history    string
+	dryRun     bool
+}
+
+// Returned for a migration which failed. Err is the underlying error, e.g.
+// a sqlite.ScriptError or a ForeignKeyError.
+type MigrationError struct {
+	Version int
+	Name    string
+	Down    bool
+	Err     error
+}
+
+func (e MigrationError) Unwrap() error {
+	return e.Err
+}
+
+func (e MigrationError) Error() string {
+	direction := "up"
+	if e.Down {
+		direction = "down"
+	}
+	return fmt.Sprintf("migrate: %d_%s (%s): %s", e.Version, e.Name, direction, e.Err.Error())
+}
+
+// A row which violates a foreign key constraint after a migration ran, as
+// reported by PRAGMA foreign_key_check.
+type ForeignKeyError struct {
+	Table  string
+	RowID  int64
+	Parent string
+}
+
+func (e ForeignKeyError) Error() string {
+	return fmt.Sprintf("foreign key violation (table: %s, rowid: %d, parent: %s)", e.Table, e.RowID, e.Parent)
+}
+
+func New(conn sqlite.Conn, migrations []Migration, config Config) (*Migrator, error) {
+	sorted := make([]Migration, len(migrations))
+	copy(sorted, migrations)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Version < sorted[j].Version
+	})
+
+	for i, m := range sorted {
+		if m.Version < 1 {
+			return nil, fmt.Errorf("migrate: invalid version %d (%s)", m.Version, m.Name)
+		}
+		if i > 0 && sorted[i-1].Version == m.Version {
+			return nil, fmt.Errorf("migrate: duplicate version %d", m.Version)
+		}
+		if m.Up == nil {
+			return nil, fmt.Errorf("migrate: %d_%s has no up migration", m.Version, m.Name)
+		}
+	}
+
+	return &Migrator{
+		conn:       conn,
+		migrations: sorted,
+		history:    config.HistoryTable,
+		dryRun:     config.DryRun,
+	}, nil
+}
+
+// The version of the most recently applied migration, 0 if none have been.
+func (m *Migrator) Version() (int, error) {
+	if m.history == "" {
+		var version int
+		err := m.conn.Row("pragma user_version").Scan(&version)
+		return version, err
+	}
+
+	exists, err := m.historyExists()
+	if err != nil || !exists {
+		return 0, err
+	}
+	var version int
+	err = m.conn.Row("select coalesce(max(version), 0) from " + sqlite.QuoteIdentifier(m.history)).Scan(&version)
+	return version, err
+}
+
+// Migrations which haven't been applied, in the order they would be.
+func (m *Migrator) Pending() ([]Migration, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []Migration
+	for _, migration := range m.migrations {
+		if _, ok := applied[migration.Version]; !ok {
+			pending = append(pending, migration)
+		}
+	}
+	return pending, nil
+}
+
+// Applies every pending migration. Returns the migrations which were
+// applied (or, with DryRun, which would have been).
+func (m *Migrator) Up() ([]Migration, error) {
+	return m.UpTo(0)
+}
+
+// Applies pending migrations up to, and including, version. A version of 0
+// applies all pending migrations.
+func (m *Migrator) UpTo(version int) ([]Migration, error) {
+	pending, err := m.Pending()
+	if err != nil {
+		return nil, err
+	}
+
+	var steps []Migration
+	for _, migration := range pending {
+		if version > 0 && migration.Version > version {
+			break
+		}
+		steps = append(steps, migration)
+	}
+
+	if err := m.run(steps, false); err != nil {
+		return nil, err
+	}
+	return steps, nil
+}
+
+// Reverts applied migrations, most recent first, until version is the most
+// recently applied one (0 reverts every migration). Returns the migrations
+// which were reverted (or, with DryRun, which would have been).
+func (m *Migrator) Down(version int) ([]Migration, error) {
+	applied, err := m.applied()
+	if err != nil {
+		return nil, err
+	}
+
+	var steps []Migration
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		migration := m.migrations[i]
+		if migration.Version <= version {
+			break
+		}
+		if _, ok := applied[migration.Version]; !ok {
+			continue
+		}
+		if migration.Down == nil {
+			return nil, fmt.Errorf("migrate: %d_%s has no down migration", migration.Version, migration.Name)
+		}
+		steps = append(steps, migration)
+	}
+
+	if err := m.run(steps, true); err != nil {
+		return nil, err
+	}
+	return steps, nil
+}
+
+// The applied migrations' versions mapped to their recorded checksum (always
+// empty when tracking with user_version). Errors if an applied migration's
+// checksum doesn't match the recorded one. With user_version, which only
+// records the latest version, errors if that version isn't one of the
+// migrations, since which migrations it includes can't be known.
+func (m *Migrator) applied() (map[int]string, error) {
+	applied := make(map[int]string)
+
+	if m.history == "" {
+		current, err := m.Version()
+		if err != nil {
+			return nil, err
+		}
+		known := current == 0
+		for _, migration := range m.migrations {
+			if migration.Version <= current {
+				applied[migration.Version] = ""
+			}
+			if migration.Version == current {
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("migrate: unknown version %d (user_version)", current)
+		}
+		return applied, nil
+	}
+
+	exists, err := m.historyExists()
+	if err != nil || !exists {
+		return applied, err
+	}
+	rows := m.conn.Rows("select version, checksum from " + sqlite.QuoteIdentifier(m.history))
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var checksum string
+		if err := rows.Scan(&version, &checksum); err != nil {
+			return nil, err
+		}
+		applied[version] = checksum
+	}
+	if err := rows.Error(); err != nil {
+		return nil, err
+	}
+
+	for _, migration := range m.migrations {
+		recorded, ok := applied[migration.Version]
+		if ok && recorded != "" && migration.Checksum != "" && recorded != migration.Checksum {
+			return nil, fmt.Errorf("migrate: %d_%s checksum mismatch (recorded: %s, actual: %s)", migration.Version, migration.Name, recorded, migration.Checksum)
+		}
+	}
+	return applied, nil
+}
+
+func (m *Migrator) historyExists() (bool, error) {
+	var exists bool
+	err := m.conn.Row("select exists (select 1 from sqlite_schema where type = 'table' and name = ?1 collate nocase)", m.history).Scan(&exists)
+	return exists, err
+}
+
+// Created when the first migration is recorded (so within its transaction,
+// which a dry run rolls back).
+func (m *Migrator) createHistory() error {
+	return m.conn.Exec(`create table if not exists ` + sqlite.QuoteIdentifier(m.history) + ` (
+		version integer primary key not null,
+		name text not null,
+		checksum text not null,
+		applied_at integer not null
+	)`)
+}
+
+func (m *Migrator) run(steps []Migration, down bool) error {
+	if len(steps) == 0 {
+		return nil
+	}
+
+	conn := m.conn
+	var foreignKeys bool
+	if err := conn.Row("pragma foreign_keys").Scan(&foreignKeys); err != nil {
+		return err
+	}
+	if foreignKeys {
+		if err := conn.Exec("pragma foreign_keys = off"); err != nil {
+			return err
+		}
+		defer conn.Exec("pragma foreign_keys = on")
+	}
+
+	if !m.dryRun {
+		for i := range steps {
+			migration := steps[i]
+			err := conn.Transaction(func() error {
+				return m.step(migration, down)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	// everything in a single transaction, each migration in a savepoint, so
+	// that the whole thing can be rolled back
+	err := conn.Transaction(func() error {
+		for i := range steps {
+			migration := steps[i]
+			err := conn.Savepoint(func() error {
+				return m.step(migration, down)
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return ErrDryRun
+	})
+	if err == ErrDryRun {
+		return nil
+	}
+	return err
+}
+
+func (m *Migrator) step(migration Migration, down bool) error {
+	conn := m.conn
+	f := migration.Up
+	if down {
+		f = migration.Down
+	}
+
+	err := f(conn)
+	if err == nil {
+		err = CheckForeignKeys(conn)
+	}
+	if err == nil {
+		err = m.record(migration, down)
+	}
+	if err != nil {
+		return MigrationError{
+			Version: migration.Version,
+			Name:    migration.Name,
+			Down:    down,
+			Err:     err,
+		}
+	}
+	return nil
+}
+
+func (m *Migrator) record(migration Migration, down bool) error {
+	conn := m.conn
+
+	if m.history == "" {
+		version := migration.Version
+		if down {
+			version = m.previous(migration.Version)
+		}
+		return conn.Exec("pragma user_version = " + strconv.Itoa(version))
+	}
+
+	table := sqlite.QuoteIdentifier(m.history)
+	if down {
+		return conn.Exec("delete from "+table+" where version = ?1", migration.Version)
+	}
+	if err := m.createHistory(); err != nil {
+		return err
+	}
+	return conn.Exec("insert into "+table+" (version, name, checksum, applied_at) values (?1, ?2, ?3, ?4)",
+		migration.Version, migration.Name, migration.Checksum, time.Now().Unix())
+}
+
+// The version of the migration before version, 0 if it's the first.
+func (m *Migrator) previous(version int) int {
+	previous := 0
+	for _, migration := range m.migrations {
+		if migration.Version >= version {
+			break
+		}
+		previous = migration.Version
+	}
+	return previous
+}
+
+// Returns a ForeignKeyError for the first row which violates a foreign key
+// constraint, if any.
+func CheckForeignKeys(conn sqlite.Conn) error {
+	rows := conn.Rows("pragma foreign_key_check")
+	defer rows.Close()
+
+	if rows.Next() {
+		var fk ForeignKeyError
+		var rowID *int64
+		var id int
+		if err := rows.Scan(&fk.Table, &rowID, &fk.Parent, &id); err != nil {
+			return err
+		}
+		if rowID != nil {
+			fk.RowID = *rowID
+		}
+		return fk
+	}
+	return rows.Error()
+}
+
+// A migration step which executes a SQL script (see sqlite.Conn.ExecScript).
+func SQL(sql string) func(conn sqlite.Conn) error {
+	return func(conn sqlite.Conn) error {
+		return conn.ExecScript(sql)
+	}
+}
+
+// A migration step which runs each step in order.
+func Steps(steps ...func(conn sqlite.Conn) error) func(conn sqlite.Conn) error {
+	return func(conn sqlite.Conn) error {
+		for _, step := range steps {
+			if err := step(conn); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,337 @@
+package migrate_test
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"src.goblgobl.com/sqlite"
+	"src.goblgobl.com/sqlite/migrate"
+	"src.goblgobl.com/tests/assert"
+)
+
+func Test_Migrate_UserVersion(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	migrator := newMigrator(db, testMigrations(), migrate.Config{})
+	version, _ := migrator.Version()
+	assert.Equal(t, version, 0)
+
+	applied, err := migrator.UpTo(2)
+	assert.Nil(t, err)
+	assert.Equal(t, len(applied), 2)
+	assert.Equal(t, applied[1].Name, "create_posts")
+	assertVersion(t, db, migrator, 2)
+
+	pending, err := migrator.Pending()
+	assert.Nil(t, err)
+	assert.Equal(t, len(pending), 1)
+	assert.Equal(t, pending[0].Version, 3)
+
+	applied, err = migrator.Up()
+	assert.Nil(t, err)
+	assert.Equal(t, len(applied), 1)
+	assertVersion(t, db, migrator, 3)
+	assert.True(t, tableExists(db, "comments"))
+
+	applied, err = migrator.Up()
+	assert.Nil(t, err)
+	assert.Equal(t, len(applied), 0)
+
+	applied, err = migrator.Down(1)
+	assert.Nil(t, err)
+	assert.Equal(t, len(applied), 2)
+	assert.Equal(t, applied[0].Version, 3)
+	assertVersion(t, db, migrator, 1)
+	assert.False(t, tableExists(db, "posts"))
+	assert.True(t, tableExists(db, "users"))
+
+	// foreign keys are restored
+	var foreignKeys bool
+	assert.Nil(t, db.Row("pragma foreign_keys").Scan(&foreignKeys))
+	assert.True(t, foreignKeys)
+}
+
+func Test_Migrate_History(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	migrations := testMigrations()
+	migrations[0].Checksum = "c1"
+	migrator := newMigrator(db, migrations, migrate.Config{HistoryTable: "migrations"})
+
+	// reading the version doesn't create the history table
+	assertVersion(t, db, migrator, 0)
+	pending, err := migrator.Pending()
+	assert.Nil(t, err)
+	assert.Equal(t, len(pending), 3)
+	assert.False(t, tableExists(db, "migrations"))
+
+	_, err = migrator.Up()
+	assert.Nil(t, err)
+	assertVersion(t, db, migrator, 3)
+
+	var userVersion, count int
+	assert.Nil(t, db.Row("pragma user_version").Scan(&userVersion))
+	assert.Equal(t, userVersion, 0)
+	var checksum string
+	assert.Nil(t, db.Row("select checksum from migrations where version = 1").Scan(&checksum))
+	assert.Equal(t, checksum, "c1")
+
+	_, err = migrator.Down(2)
+	assert.Nil(t, err)
+	assert.Nil(t, db.Row("select count(*) from migrations").Scan(&count))
+	assert.Equal(t, count, 2)
+
+	// an applied migration which changed
+	migrations[0].Checksum = "c2"
+	_, err = newMigrator(db, migrations, migrate.Config{HistoryTable: "migrations"}).Up()
+	assert.Equal(t, err.Error(), "migrate: 1_create_users checksum mismatch (recorded: c1, actual: c2)")
+}
+
+func Test_Migrate_DryRun(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	migrator := newMigrator(db, testMigrations(), migrate.Config{DryRun: true})
+	applied, err := migrator.Up()
+	assert.Nil(t, err)
+	assert.Equal(t, len(applied), 3)
+	assertVersion(t, db, migrator, 0)
+	assert.False(t, tableExists(db, "users"))
+
+	migrator = newMigrator(db, testMigrations(), migrate.Config{DryRun: true, HistoryTable: "migrations"})
+	applied, err = migrator.Up()
+	assert.Nil(t, err)
+	assert.Equal(t, len(applied), 3)
+	assertVersion(t, db, migrator, 0)
+	assert.False(t, tableExists(db, "migrations"))
+}
+
+func Test_Migrate_Errors(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	_, err := migrate.New(db, []migrate.Migration{{Version: 1, Up: noop}, {Version: 1, Up: noop}}, migrate.Config{})
+	assert.Equal(t, err.Error(), "migrate: duplicate version 1")
+
+	migrations := append(testMigrations(), migrate.Migration{
+		Version: 4,
+		Name:    "bad",
+		Up:      migrate.SQL("insert into users (id) values (9);\ninsert into invalid values (1)"),
+	})
+	migrator := newMigrator(db, migrations, migrate.Config{})
+	_, err = migrator.Up()
+	var migrationErr migrate.MigrationError
+	assert.True(t, errors.As(err, &migrationErr))
+	assert.Equal(t, migrationErr.Version, 4)
+	var scriptErr sqlite.ScriptError
+	assert.True(t, errors.As(err, &scriptErr))
+	assert.Equal(t, scriptErr.Index, 1)
+
+	// the failed migration is rolled back, the previous ones are committed
+	assertVersion(t, db, migrator, 3)
+	var count int
+	assert.Nil(t, db.Row("select count(*) from users where id = 9").Scan(&count))
+	assert.Equal(t, count, 0)
+
+	// a foreign key violation
+	migrator = newMigrator(db, append(testMigrations(), migrate.Migration{
+		Version: 4,
+		Name:    "orphan",
+		Up:      migrate.SQL("insert into posts (id, user_id) values (1, 99)"),
+	}), migrate.Config{})
+	_, err = migrator.Up()
+	var fkErr migrate.ForeignKeyError
+	assert.True(t, errors.As(err, &fkErr))
+	assert.Equal(t, fkErr.Table, "posts")
+	assert.Equal(t, fkErr.Parent, "users")
+	assertVersion(t, db, migrator, 3)
+
+	// no down migration
+	migrator = newMigrator(db, []migrate.Migration{{Version: 1, Up: noop}, {Version: 3, Name: "one_way", Up: noop}}, migrate.Config{})
+	_, err = migrator.Down(0)
+	assert.Equal(t, err.Error(), "migrate: 3_one_way has no down migration")
+
+	// user_version isn't one of the migrations
+	migrator = newMigrator(db, []migrate.Migration{{Version: 1, Up: noop}, {Version: 2, Up: noop}}, migrate.Config{})
+	_, err = migrator.Up()
+	assert.Equal(t, err.Error(), "migrate: unknown version 3 (user_version)")
+	_, err = migrator.Pending()
+	assert.Equal(t, err.Error(), "migrate: unknown version 3 (user_version)")
+}
+
+func Test_Migrate_FS(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	fsys := fstest.MapFS{
+		"migrations/0001_create_users.up.sql":   {Data: []byte("create table users (id integer primary key);")},
+		"migrations/0001_create_users.down.sql": {Data: []byte("drop table users;")},
+		"migrations/0002_add_name.up.sql":       {Data: []byte("alter table users add column name text;\ninsert into users (id, name) values (1, 'leto');")},
+		"migrations/readme.md":                  {Data: []byte("ignored")},
+	}
+	migrations, err := migrate.FS(fsys, "migrations")
+	assert.Nil(t, err)
+	assert.Equal(t, len(migrations), 2)
+
+	migrator := newMigrator(db, migrations, migrate.Config{HistoryTable: "migrations"})
+	_, err = migrator.Up()
+	assert.Nil(t, err)
+	var name string
+	assert.Nil(t, db.Row("select name from users where id = 1").Scan(&name))
+	assert.Equal(t, name, "leto")
+
+	var checksum string
+	assert.Nil(t, db.Row("select checksum from migrations where version = 2").Scan(&checksum))
+	assert.Equal(t, checksum, migrations[1].Checksum)
+	assert.Equal(t, len(checksum), 64)
+
+	// 2 has no down
+	_, err = migrator.Down(0)
+	assert.Equal(t, err.Error(), "migrate: 2_add_name has no down migration")
+}
+
+func Test_Migrate_Rebuild(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	migrator := newMigrator(db, append(testMigrations(), migrate.Migration{
+		Version: 4,
+		Name:    "rebuild_posts",
+		Up: migrate.Steps(
+			migrate.SQL("create view post_titles as select title from posts"),
+			migrate.RebuildTable(migrate.Rebuild{
+				Table:      "posts",
+				Definition: "(id integer primary key, user_id int not null references users(id), title text not null, slug text not null)",
+				Columns:    map[string]string{"title": "coalesce(title, '')", "Slug": "lower(coalesce(title, ''))"},
+				Drop:       []string{"posts_body"},
+			}),
+		),
+	}), migrate.Config{})
+
+	_, err := migrator.UpTo(3)
+	assert.Nil(t, err)
+	db.MustExec("insert into users (id) values (1)")
+	db.MustExec("insert into posts (id, user_id, title, body) values (1, 1, 'Hello', 'b'), (2, 1, null, 'b')")
+
+	_, err = migrator.Up()
+	assert.Nil(t, err)
+
+	rows, err := db.Maps("select id, title, slug from posts order by id")
+	assert.Nil(t, err)
+	assert.Equal(t, len(rows), 2)
+	assert.Equal(t, rows[0]["slug"].(string), "hello")
+	assert.Equal(t, rows[1]["title"].(string), "")
+
+	// indexes are re-created, unless dropped
+	var count int
+	assert.Nil(t, db.Row("select count(*) from sqlite_schema where type = 'index' and name = 'posts_user_id'").Scan(&count))
+	assert.Equal(t, count, 1)
+	assert.Nil(t, db.Row("select count(*) from sqlite_schema where type = 'index' and name = 'posts_body'").Scan(&count))
+	assert.Equal(t, count, 0)
+
+	// views still work, and the foreign key is enforced
+	assert.Nil(t, db.Row("select count(*) from post_titles").Scan(&count))
+	assert.Equal(t, count, 2)
+	assert.True(t, sqlite.IsForeignKey(db.Exec("insert into posts (id, user_id, title, slug) values (3, 99, '', '')")))
+
+	// legacy_alter_table is left as it was
+	db.MustExec("pragma legacy_alter_table = on")
+	err = migrate.RebuildTable(migrate.Rebuild{Table: "comments", Definition: "(id integer primary key, post_id int references posts(id))"})(db)
+	assert.Nil(t, err)
+	var legacy bool
+	assert.Nil(t, db.Row("pragma legacy_alter_table").Scan(&legacy))
+	assert.True(t, legacy)
+}
+
+func Test_Migrate_Rebuild_Wide(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	// listing every column twice would exceed SQLITE_MAX_SQL_LENGTH
+	columns := make([]string, 150)
+	for i := range columns {
+		columns[i] = fmt.Sprintf("column_number_%03d int", i)
+	}
+	definition := "(" + strings.Join(columns, ", ") + ")"
+	db.MustExec("create table wide " + definition)
+	db.MustExec("insert into wide (column_number_000, column_number_149) values (1, 2)")
+
+	columns[0] += " not null"
+	err := migrate.RebuildTable(migrate.Rebuild{Table: "wide", Definition: "(" + strings.Join(columns, ", ") + ")"})(db)
+	assert.Nil(t, err)
+
+	var first, last int
+	assert.Nil(t, db.Row("select column_number_000, column_number_149 from wide").Scan(&first, &last))
+	assert.Equal(t, first, 1)
+	assert.Equal(t, last, 2)
+}
+
+func testMigrations() []migrate.Migration {
+	return []migrate.Migration{
+		{
+			Version: 1,
+			Name:    "create_users",
+			Up:      migrate.SQL("create table users (id integer primary key)"),
+			Down:    migrate.SQL("drop table users"),
+		},
+		{
+			Version: 3,
+			Name:    "create_comments",
+			Up:      migrate.SQL("create table comments (id integer primary key, post_id int not null references posts(id))"),
+			Down:    migrate.SQL("drop table comments"),
+		},
+		{
+			Version: 2,
+			Name:    "create_posts",
+			Up: migrate.SQL(`
+				create table posts (id integer primary key, user_id int not null references users(id), title text, body text);
+				create index posts_user_id on posts(user_id);
+				create index posts_body on posts(body);
+			`),
+			Down: func(conn sqlite.Conn) error {
+				return conn.Exec("drop table posts")
+			},
+		},
+	}
+}
+
+func newMigrator(db sqlite.Conn, migrations []migrate.Migration, config migrate.Config) *migrate.Migrator {
+	migrator, err := migrate.New(db, migrations, config)
+	if err != nil {
+		panic(err)
+	}
+	return migrator
+}
+
+func assertVersion(t *testing.T, db sqlite.Conn, migrator *migrate.Migrator, expected int) {
+	t.Helper()
+	version, err := migrator.Version()
+	assert.Nil(t, err)
+	assert.Equal(t, version, expected)
+}
+
+func tableExists(db sqlite.Conn, table string) bool {
+	var count int
+	if err := db.Row("select count(*) from sqlite_schema where type = 'table' and name = ?1", table).Scan(&count); err != nil {
+		panic(err)
+	}
+	return count == 1
+}
+
+func noop(conn sqlite.Conn) error {
+	return nil
+}
+
+func testDB() sqlite.Conn {
+	db, err := sqlite.Open(":memory:", true)
+	if err != nil {
+		panic(err)
+	}
+	db.MustExec("pragma foreign_keys = on")
+	return db
+}
@@ -0,0 +1,203 @@
+package migrate
+
+import (
+	"fmt"
+	"strings"
+
+	"src.goblgobl.com/sqlite"
+)
+
+// SQLITE_MAX_SQL_LENGTH
+const maxSQLLength = 5000
+
+// Changes a table in ways ALTER TABLE can't (changing a column's type or
+// constraints, adding a foreign key, ...) by creating a new table, copying
+// the rows over, dropping the old table and renaming the new one, as
+// described in https://www.sqlite.org/lang_altertable.html#otheralter.
+// The table's indexes and triggers are re-created.
+type Rebuild struct {
+	Table string
+
+	// The new table's definition: everything that follows the table name in
+	// a CREATE TABLE statement, e.g. "(id integer primary key, name text not null)"
+	Definition string
+
+	// The values of the new table's columns, as SQL expressions over the old
+	// table's columns, e.g. {"name": "coalesce(name, '')"}. Columns which
+	// exist in both tables and aren't listed here are copied as-is. Names
+	// are case-insensitive, like SQLite's.
+	Columns map[string]string
+
+	// Indexes and triggers to leave out when re-creating them, e.g. because
+	// they reference a column which no longer exists.
+	Drop []string
+}
+
+// A migration step which rebuilds a table (see Rebuild).
+func RebuildTable(rebuild Rebuild) func(conn sqlite.Conn) error {
+	return rebuild.Run
+}
+
+func (r Rebuild) Run(conn sqlite.Conn) error {
+	table := r.Table
+	temp := "migrate_new_" + table
+
+	var objects []string
+	rows := conn.Rows("select name, sql from sqlite_schema where tbl_name = ?1 and type in ('index', 'trigger') and sql is not null", table)
+	for rows.Next() {
+		var name, sql string
+		if err := rows.Scan(&name, &sql); err != nil {
+			rows.Close()
+			return err
+		}
+		if !r.dropped(name) {
+			objects = append(objects, sql)
+		}
+	}
+	rows.Close()
+	if err := rows.Error(); err != nil {
+		return err
+	}
+
+	if err := conn.Exec("create table " + sqlite.QuoteIdentifier(temp) + " " + r.Definition); err != nil {
+		return err
+	}
+
+	oldColumns, err := columnNames(conn, table)
+	if err != nil {
+		return err
+	}
+	newColumns, err := columnNames(conn, temp)
+	if err != nil {
+		return err
+	}
+
+	var columns, values []string
+	for _, column := range newColumns {
+		value, ok := r.value(column)
+		if !ok {
+			if !contains(oldColumns, column) {
+				continue
+			}
+			value = sqlite.QuoteIdentifier(column)
+		}
+		columns = append(columns, sqlite.QuoteIdentifier(column))
+		values = append(values, value)
+	}
+
+	if len(columns) > 0 {
+		all, err := r.copyAll(conn, temp, oldColumns, newColumns)
+		if err != nil {
+			return err
+		}
+
+		var sql string
+		if all {
+			// doesn't list every column twice, which, for a wide table, can
+			// exceed SQLITE_MAX_SQL_LENGTH
+			sql = "insert into " + sqlite.QuoteIdentifier(temp) + " select * from " + sqlite.QuoteIdentifier(table)
+		} else {
+			sql = "insert into " + sqlite.QuoteIdentifier(temp) + " (" + strings.Join(columns, ", ") + ") select " + strings.Join(values, ", ") + " from " + sqlite.QuoteIdentifier(table)
+			if len(sql) > maxSQLLength {
+				return fmt.Errorf("migrate: rebuild of %s copies too many columns for a single statement (%d bytes of SQL)", table, len(sql))
+			}
+		}
+		if err := conn.Exec(sql); err != nil {
+			return err
+		}
+	}
+
+	if err := conn.Exec("drop table " + sqlite.QuoteIdentifier(table)); err != nil {
+		return err
+	}
+
+	// the legacy behavior doesn't rewrite (or validate) references to the
+	// table in views and triggers, which already refer to it by its final name
+	var legacy bool
+	if err := conn.Row("pragma legacy_alter_table").Scan(&legacy); err != nil {
+		return err
+	}
+	if !legacy {
+		if err := conn.Exec("pragma legacy_alter_table = on"); err != nil {
+			return err
+		}
+	}
+	err = conn.Exec("alter table " + sqlite.QuoteIdentifier(temp) + " rename to " + sqlite.QuoteIdentifier(table))
+	if !legacy {
+		if err2 := conn.Exec("pragma legacy_alter_table = off"); err == nil {
+			err = err2
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, sql := range objects {
+		if err := conn.Exec(sql); err != nil {
+			return err
+		}
+	}
+	return CheckForeignKeys(conn)
+}
+
+func (r Rebuild) value(column string) (string, bool) {
+	if value, ok := r.Columns[column]; ok {
+		return value, true
+	}
+	for name, value := range r.Columns {
+		if strings.EqualFold(name, column) {
+			return value, true
+		}
+	}
+	return "", false
+}
+
+func (r Rebuild) dropped(name string) bool {
+	for _, drop := range r.Drop {
+		if strings.EqualFold(drop, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func columnNames(conn sqlite.Conn, table string) ([]string, error) {
+	var names []string
+	rows := conn.Rows("select name from pragma_table_info(?1)", table)
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Error()
+}
+
+// Whether the rows can be copied with a "select *": both tables have the
+// same columns, in the same order, without any generated columns (which
+// "select *" includes), and no column has a new value.
+func (r Rebuild) copyAll(conn sqlite.Conn, temp string, oldColumns []string, newColumns []string) (bool, error) {
+	if len(r.Columns) > 0 || len(oldColumns) != len(newColumns) {
+		return false, nil
+	}
+	for i, name := range oldColumns {
+		if !strings.EqualFold(name, newColumns[i]) {
+			return false, nil
+		}
+	}
+
+	var hidden bool
+	err := conn.Row("select exists (select 1 from pragma_table_xinfo(?1) where hidden != 0 union all select 1 from pragma_table_xinfo(?2) where hidden != 0)", r.Table, temp).Scan(&hidden)
+	return !hidden, err
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
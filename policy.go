@@ -0,0 +1,370 @@
+package sqlite
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const policyPrefix = "sqlkite_policy_"
+
+// A row-level security policy for a table. Applying a policy installs
+// BEFORE INSERT/UPDATE/DELETE triggers which fail with sqlkite_row_access
+// (using the sqlkite_assert* functions) and a view which only exposes the
+// rows the current user can read.
+type Policy struct {
+	Table string `json:"table"`
+
+	// The (text) column holding the id of the user who owns the row. When set,
+	// sqlkite_user_id() must match it to insert, update or delete the row
+	// (for updates, both the old and new values must match). The view only
+	// exposes the user's own rows.
+	OwnerColumn string `json:"owner_column,omitempty"`
+
+	// When set, sqlkite_user_role() must be one of these roles to read or
+	// write to the table.
+	Roles []string `json:"roles,omitempty"`
+
+	// Optional SQL expressions which must be true for the operation to be
+	// allowed. Insert can reference new, Update new and old, Delete old, and
+	// Select the table's columns, e.g.
+	//   Insert: "new.team_id = sqlkite_claim('team_id')"
+	Select string `json:"select,omitempty"`
+	Insert string `json:"insert,omitempty"`
+	Update string `json:"update,omitempty"`
+	Delete string `json:"delete,omitempty"`
+
+	// Name of the view used for reads, defaults to "<Table>_visible"
+	View string `json:"view,omitempty"`
+}
+
+// The difference between a policy and what's installed. Existing is nil
+// when the table has no policy, Desired is nil when a policy is installed
+// but wasn't desired (see DiffPolicies). Changes describes what ApplyPolicy
+// (or DropPolicy) would do, e.g. "create trigger sqlkite_policy_users_insert".
+type PolicyDiff struct {
+	Table    string
+	Existing *Policy
+	Desired  *Policy
+	Changes  []string
+}
+
+type policyObject struct {
+	tpe  string
+	name string
+	sql  string
+}
+
+func (d PolicyDiff) Changed() bool {
+	return len(d.Changes) > 0
+}
+
+func (p Policy) view() string {
+	if view := p.View; view != "" {
+		return view
+	}
+	return p.Table + "_visible"
+}
+
+func (p Policy) normalize() Policy {
+	if len(p.Roles) == 0 {
+		p.Roles = nil
+	}
+	return p
+}
+
+func (p Policy) triggerNames() []string {
+	return []string{
+		policyPrefix + p.Table + "_insert",
+		policyPrefix + p.Table + "_update",
+		policyPrefix + p.Table + "_delete",
+	}
+}
+
+// The triggers and view for the policy, in the order they should be created
+func (p Policy) objects() []policyObject {
+	roles := p.roleCheck()
+	names := p.triggerNames()
+
+	objects := make([]policyObject, 0, 4)
+	if o, ok := p.trigger(names[0], "insert", []string{"new"}, roles, p.Insert); ok {
+		objects = append(objects, o)
+	}
+	if o, ok := p.trigger(names[1], "update", []string{"old", "new"}, roles, p.Update); ok {
+		objects = append(objects, o)
+	}
+	if o, ok := p.trigger(names[2], "delete", []string{"old"}, roles, p.Delete); ok {
+		objects = append(objects, o)
+	}
+
+	var where []string
+	if owner := p.OwnerColumn; owner != "" {
+		where = append(where, QuoteIdentifier(owner)+" = sqlkite_user_id() collate nocase")
+	}
+	if roles != "" {
+		where = append(where, roles)
+	}
+	if rule := p.Select; rule != "" {
+		where = append(where, "("+rule+")")
+	}
+
+	view := p.view()
+	sql := "CREATE VIEW " + QuoteIdentifier(view) + " as select * from " + QuoteIdentifier(p.Table)
+	if len(where) > 0 {
+		sql += " where " + strings.Join(where, " and ")
+	}
+	return append(objects, policyObject{tpe: "view", name: view, sql: sql})
+}
+
+func (p Policy) trigger(name string, op string, rows []string, roles string, rule string) (policyObject, bool) {
+	// the trigger name lets a failed assertion identify the trigger and table
+	// (see AccessDeniedError)
+	source := ", " + EscapeLiteral(name) + ");"
+
+	var checks []string
+	if owner := p.OwnerColumn; owner != "" {
+		for _, row := range rows {
+			checks = append(checks, "select sqlkite_assert_user_id("+row+"."+QuoteIdentifier(owner)+source)
+		}
+	}
+	if roles != "" {
+		checks = append(checks, "select sqlkite_assert("+roles+source)
+	}
+	if rule != "" {
+		checks = append(checks, "select sqlkite_assert(("+rule+")"+source)
+	}
+	if len(checks) == 0 {
+		return policyObject{}, false
+	}
+
+	sql := "CREATE TRIGGER " + QuoteIdentifier(name) + " before " + op + " on " + QuoteIdentifier(p.Table) + " for each row\nbegin\n\t" + strings.Join(checks, "\n\t") + "\nend"
+	return policyObject{tpe: "trigger", name: name, sql: sql}, true
+}
+
+func (p Policy) roleCheck() string {
+	if len(p.Roles) == 0 {
+		return ""
+	}
+	roles := make([]string, len(p.Roles))
+	for i, role := range p.Roles {
+		roles[i] = EscapeLiteral(role)
+	}
+	return "sqlkite_user_role() collate nocase in (" + strings.Join(roles, ", ") + ")"
+}
+
+// Installs the policy, replacing any existing policy on the table. Does
+// nothing if the installed policy is already up to date, so it's safe to
+// call on every deploy. Runs in a savepoint.
+func (c Conn) ApplyPolicy(p Policy) error {
+	if p.Table == "" {
+		return Error{Code: CodeMisuse, Message: "policy requires a table"}
+	}
+	p = p.normalize()
+
+	diff, err := c.DiffPolicy(p)
+	if err != nil || !diff.Changed() {
+		return err
+	}
+
+	definition, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+
+	return c.Savepoint(func() error {
+		if err := c.dropPolicyObjects(p.Table, diff.Existing); err != nil {
+			return err
+		}
+		for _, o := range p.objects() {
+			if err := c.Exec(o.sql); err != nil {
+				return err
+			}
+		}
+		if err := c.Exec("create table if not exists sqlkite_policies (name text primary key not null, definition text not null)"); err != nil {
+			return err
+		}
+		return c.Exec("insert or replace into sqlkite_policies (name, definition) values (?1, ?2)", p.Table, string(definition))
+	})
+}
+
+// Removes the policy (triggers, view and definition) from the table. Does
+// nothing if the table has no policy.
+func (c Conn) DropPolicy(table string) error {
+	existing, err := c.policy(table)
+	if err != nil || existing == nil {
+		return err
+	}
+	return c.Savepoint(func() error {
+		if err := c.dropPolicyObjects(table, existing); err != nil {
+			return err
+		}
+		return c.Exec("delete from sqlkite_policies where name = ?1", table)
+	})
+}
+
+// The installed policies, ordered by table.
+func (c Conn) ListPolicies() ([]Policy, error) {
+	policies := make([]Policy, 0)
+	exists, err := c.policiesExist()
+	if err != nil || !exists {
+		return policies, err
+	}
+
+	rows := c.Rows("select definition from sqlkite_policies order by name")
+	defer rows.Close()
+	for rows.Next() {
+		var p Policy
+		if err := rows.Scan(&JSON[*Policy]{Value: &p}); err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	if err := rows.Error(); err != nil {
+		return nil, err
+	}
+	return policies, nil
+}
+
+// Compares the policy to what's installed on its table, including the
+// triggers and view themselves (so it detects manual changes to them).
+func (c Conn) DiffPolicy(p Policy) (PolicyDiff, error) {
+	p = p.normalize()
+	existing, err := c.policy(p.Table)
+	if err != nil {
+		return PolicyDiff{}, err
+	}
+
+	installed, err := c.policySchema(p.Table, existing)
+	if err != nil {
+		return PolicyDiff{}, err
+	}
+
+	diff := PolicyDiff{Table: p.Table, Existing: existing, Desired: &p}
+	for _, o := range p.objects() {
+		current, ok := installed[o.name]
+		if !ok {
+			diff.Changes = append(diff.Changes, "create "+o.tpe+" "+o.name)
+		} else if current.sql != o.sql {
+			diff.Changes = append(diff.Changes, "replace "+o.tpe+" "+o.name)
+		}
+		delete(installed, o.name)
+	}
+	diff.Changes = append(diff.Changes, dropChanges(installed)...)
+
+	if existing == nil || !reflect.DeepEqual(*existing, p) {
+		diff.Changes = append(diff.Changes, "record policy "+p.Table)
+	}
+	return diff, nil
+}
+
+// Compares the desired policies to all installed policies. Only policies
+// with changes are returned. Installed policies which aren't desired are
+// returned with a nil Desired.
+func (c Conn) DiffPolicies(desired []Policy) ([]PolicyDiff, error) {
+	diffs := make([]PolicyDiff, 0)
+	seen := make(map[string]struct{}, len(desired))
+	for _, p := range desired {
+		seen[p.Table] = struct{}{}
+		diff, err := c.DiffPolicy(p)
+		if err != nil {
+			return nil, err
+		}
+		if diff.Changed() {
+			diffs = append(diffs, diff)
+		}
+	}
+
+	existing, err := c.ListPolicies()
+	if err != nil {
+		return nil, err
+	}
+	for i := range existing {
+		p := &existing[i]
+		if _, ok := seen[p.Table]; ok {
+			continue
+		}
+		installed, err := c.policySchema(p.Table, p)
+		if err != nil {
+			return nil, err
+		}
+		changes := append(dropChanges(installed), "remove policy "+p.Table)
+		diffs = append(diffs, PolicyDiff{Table: p.Table, Existing: p, Changes: changes})
+	}
+	return diffs, nil
+}
+
+func (c Conn) policiesExist() (bool, error) {
+	var exists bool
+	err := c.Row("select exists(select 1 from sqlite_schema where type = 'table' and name = 'sqlkite_policies')").Scan(&exists)
+	return exists, err
+}
+
+func (c Conn) policy(table string) (*Policy, error) {
+	exists, err := c.policiesExist()
+	if err != nil || !exists {
+		return nil, err
+	}
+
+	var p Policy
+	err = c.Row("select definition from sqlkite_policies where name = ?1", table).Scan(&JSON[*Policy]{Value: &p})
+	if err == ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// The policy triggers and view which exist for the table, by name
+func (c Conn) policySchema(table string, existing *Policy) (map[string]policyObject, error) {
+	p := Policy{Table: table}
+	names := p.triggerNames()
+	view := ""
+	if existing != nil {
+		view = existing.view()
+	}
+
+	rows := c.Rows(`
+		select type, name, sql from sqlite_schema
+		where (type = 'trigger' and name in (?1, ?2, ?3)) or (type = 'view' and name = ?4)
+	`, names[0], names[1], names[2], view)
+	defer rows.Close()
+
+	installed := make(map[string]policyObject, 4)
+	for rows.Next() {
+		var o policyObject
+		if err := rows.Scan(&o.tpe, &o.name, &o.sql); err != nil {
+			return nil, err
+		}
+		installed[o.name] = o
+	}
+	if err := rows.Error(); err != nil {
+		return nil, err
+	}
+	return installed, nil
+}
+
+func (c Conn) dropPolicyObjects(table string, existing *Policy) error {
+	for _, name := range (Policy{Table: table}).triggerNames() {
+		if err := c.Exec("drop trigger if exists " + QuoteIdentifier(name)); err != nil {
+			return err
+		}
+	}
+	if existing != nil {
+		if err := c.Exec("drop view if exists " + QuoteIdentifier(existing.view())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func dropChanges(installed map[string]policyObject) []string {
+	changes := make([]string, 0, len(installed))
+	for _, o := range installed {
+		changes = append(changes, "drop "+o.tpe+" "+o.name)
+	}
+	sort.Strings(changes)
+	return changes
+}
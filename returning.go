@@ -0,0 +1,108 @@
+package sqlite
+
+/*
+#include "sqlite3.h"
+*/
+import "C"
+
+// Rows returned by ExecReturning, kept as copies (sqlite3_value_dup) of the
+// statement's values, so that scanning them behaves exactly like scanning
+// any other Rows.
+type rowBuffer struct {
+	columns int
+	values  []*C.sqlite3_value
+	next    int
+}
+
+// Executes an INSERT, UPDATE or DELETE with a RETURNING clause. The statement
+// is stepped to completion, and its rows buffered, before this returns, so
+// the write always completes (and the statement is done with) regardless of
+// how many rows the caller reads. The Rows must still be closed.
+func (c Conn) ExecReturning(sql string, args ...any) Rows {
+	return c.ExecReturningArr(sql, args)
+}
+
+func (c Conn) ExecReturningArr(sql string, args []any) Rows {
+	s, err := c.prepareCached(s2b(sql), args)
+	if err != nil {
+		return Rows{err: err}
+	}
+	if s == nil {
+		return Rows{buffer: &rowBuffer{}}
+	}
+
+	buffer, err := bufferRows(s)
+	if err != nil {
+		s.Close()
+		return Rows{err: err}
+	}
+	return Rows{Stmt: s, buffer: buffer}
+}
+
+// Like ExecReturning, but for a single returned row. The statement is still
+// stepped to completion; any rows after the first are discarded.
+func (c Conn) ExecReturningOne(sql string, args ...any) Row {
+	return c.ExecReturningOneArr(sql, args)
+}
+
+func (c Conn) ExecReturningOneArr(sql string, args []any) Row {
+	rows := c.ExecReturningArr(sql, args)
+	if err := rows.err; err != nil {
+		return Row{err: err}
+	}
+	if rows.Stmt == nil {
+		// no statement, so no rows
+		return Row{err: ErrNoRows}
+	}
+	return Row{Stmt: rows.Stmt, buffer: rows.buffer}
+}
+
+func bufferRows(s *Stmt) (*rowBuffer, error) {
+	buffer := &rowBuffer{columns: s.columnCount}
+	for {
+		hasRow, err := s.Step()
+		if err != nil {
+			buffer.free()
+			return nil, err
+		}
+		if !hasRow {
+			return buffer, nil
+		}
+
+		for i := 0; i < s.columnCount; i++ {
+			value := C.sqlite3_value_dup(C.sqlite3_column_value(s.stmt, C.int(i)))
+			if value == nil {
+				buffer.free()
+				return nil, errorFromCode(s.db, C.SQLITE_NOMEM)
+			}
+			buffer.values = append(buffer.values, value)
+		}
+	}
+}
+
+// Makes the next buffered row the statement's current row.
+func (b *rowBuffer) step(s *Stmt) bool {
+	start := b.next * b.columns
+	if s == nil || start >= len(b.values) {
+		return false
+	}
+	b.next += 1
+	s.setRow(&b.values[start])
+	return true
+}
+
+// Frees the buffered values and, if stmt isn't nil, stops it reading from
+// them.
+func (b *rowBuffer) close(stmt *Stmt) {
+	if stmt != nil {
+		stmt.setRow(nil)
+	}
+	b.free()
+}
+
+func (b *rowBuffer) free() {
+	for _, value := range b.values {
+		C.sqlite3_value_free(value)
+	}
+	b.values = nil
+}
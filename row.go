@@ -3,6 +3,12 @@ package sqlite
 type Row struct {
 	Stmt *Stmt
 	err  error
+
+	// set by Stmt.QueryRow, the statement is reset rather than closed
+	reuse bool
+
+	// set by Conn.ExecReturningOne
+	buffer *rowBuffer
 }
 
 func (r Row) Map() (map[string]any, error) {
@@ -20,9 +26,9 @@ func (r Row) MapInto(m map[string]any) error {
 	}
 
 	stmt := r.Stmt
-	defer stmt.Close()
+	defer r.close()
 
-	hasRow, err := stmt.Step()
+	hasRow, err := r.step()
 	if err != nil {
 		return err
 	}
@@ -39,9 +45,9 @@ func (r Row) Scan(dst ...interface{}) error {
 		return err
 	}
 	stmt := r.Stmt
-	defer stmt.Close()
+	defer r.close()
 
-	hasRow, err := stmt.Step()
+	hasRow, err := r.step()
 	if err != nil {
 		return err
 	}
@@ -57,3 +63,26 @@ func (r Row) Scan(dst ...interface{}) error {
 	}
 	return nil
 }
+
+func (r Row) step() (bool, error) {
+	if buffer := r.buffer; buffer != nil {
+		return buffer.step(r.Stmt), nil
+	}
+	return r.Stmt.Step()
+}
+
+func (r Row) close() {
+	stmt := r.Stmt
+	if buffer := r.buffer; buffer != nil {
+		buffer.close(stmt)
+	}
+	if stmt == nil {
+		return
+	}
+	if r.reuse {
+		stmt.Reset()
+		stmt.ClearBindings()
+	} else {
+		stmt.Close()
+	}
+}
@@ -3,6 +3,12 @@ package sqlite
 type Rows struct {
 	Stmt *Stmt
 	err  error
+
+	// set by Stmt.Query, the statement is reset rather than closed
+	reuse bool
+
+	// set by Conn.ExecReturning
+	buffer *rowBuffer
 }
 
 func (r *Rows) Next() bool {
@@ -10,6 +16,9 @@ func (r *Rows) Next() bool {
 	if r.err != nil {
 		return false
 	}
+	if buffer := r.buffer; buffer != nil {
+		return buffer.step(stmt)
+	}
 
 	hasMore, err := stmt.Step()
 	if err != nil {
@@ -32,13 +41,45 @@ func (r *Rows) Scan(dst ...interface{}) error {
 	return nil
 }
 
+func (r *Rows) Map() (map[string]any, error) {
+	m := make(map[string]any, r.Stmt.columnCount)
+	err := r.MapInto(m)
+	return m, err
+}
+
+func (r *Rows) MapInto(m map[string]any) error {
+	if err := r.Stmt.MapInto(m); err != nil {
+		r.err = err
+		return err
+	}
+	return nil
+}
+
+func (r *Rows) Values(dst []any) error {
+	if err := r.Stmt.Values(dst); err != nil {
+		r.err = err
+		return err
+	}
+	return nil
+}
+
 func (r Rows) Error() error {
 	return r.err
 }
 
 func (r Rows) Close() {
 	// will be nil if the query was never valid
-	if stmt := r.Stmt; stmt != nil {
+	stmt := r.Stmt
+	if buffer := r.buffer; buffer != nil {
+		buffer.close(stmt)
+	}
+	if stmt == nil {
+		return
+	}
+	if r.reuse {
+		stmt.Reset()
+		stmt.ClearBindings()
+	} else {
 		stmt.Close()
 	}
 }
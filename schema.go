@@ -0,0 +1,306 @@
+package sqlite
+
+// A description of the database's tables, views and triggers, as returned
+// by Conn.Schema. Internal sqlite_* objects are excluded.
+type Schema struct {
+	Tables   []Table
+	Views    []View
+	Triggers []Trigger
+}
+
+type SchemaConfig struct {
+	// Include objects from the temp schema (e.g. sqlkite_user)
+	Temp bool
+}
+
+type Table struct {
+	Name         string
+	SQL          string
+	Temp         bool
+	Virtual      bool
+	Strict       bool
+	WithoutRowID bool
+	Columns      []Column
+	Indexes      []Index
+	ForeignKeys  []ForeignKey
+}
+
+type Column struct {
+	Name    string
+	Type    string
+	NotNull bool
+
+	// The SQL text of the default value, nil when there's no default
+	Default *string
+
+	// The column's (1-based) position in the primary key, 0 if it isn't
+	// part of the primary key
+	PrimaryKey int
+
+	// Hidden columns of virtual tables
+	Hidden bool
+
+	// Generated columns, Stored is false for virtual generated columns
+	Generated bool
+	Stored    bool
+}
+
+type Index struct {
+	Name string
+
+	// nil for indexes SQLite creates for unique and primary key constraints
+	SQL *string
+
+	Unique  bool
+	Partial bool
+
+	// "c" for indexes created with CREATE INDEX, "u" for unique constraints
+	// and "pk" for primary keys
+	Origin string
+
+	Columns []IndexColumn
+}
+
+type IndexColumn struct {
+	// Empty for expressions
+	Name       string
+	Expression bool
+	Desc       bool
+	Collation  string
+}
+
+type ForeignKey struct {
+	// The referenced (parent) table
+	Table    string
+	From     []string
+	To       []string
+	OnUpdate string
+	OnDelete string
+	Match    string
+}
+
+type View struct {
+	Name    string
+	SQL     string
+	Temp    bool
+	Columns []Column
+}
+
+type Trigger struct {
+	Name  string
+	Table string
+	SQL   string
+	Temp  bool
+}
+
+func (s Schema) Table(name string) (Table, bool) {
+	for _, t := range s.Tables {
+		if t.Name == name {
+			return t, true
+		}
+	}
+	return Table{}, false
+}
+
+func (s Schema) View(name string) (View, bool) {
+	for _, v := range s.Views {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return View{}, false
+}
+
+func (t Table) Column(name string) (Column, bool) {
+	for _, c := range t.Columns {
+		if c.Name == name {
+			return c, true
+		}
+	}
+	return Column{}, false
+}
+
+func (c Conn) Schema() (Schema, error) {
+	return c.SchemaConfig(SchemaConfig{})
+}
+
+func (c Conn) SchemaConfig(config SchemaConfig) (Schema, error) {
+	var schema Schema
+	if err := c.loadSchema(&schema, "main"); err != nil {
+		return schema, err
+	}
+	if config.Temp {
+		if err := c.loadSchema(&schema, "temp"); err != nil {
+			return schema, err
+		}
+	}
+	return schema, nil
+}
+
+func (c Conn) loadSchema(schema *Schema, name string) error {
+	temp := name == "temp"
+	master := "sqlite_schema"
+	if temp {
+		master = "sqlite_temp_schema"
+	}
+
+	sqls := make(map[string]string)
+	err := c.each("select type, name, tbl_name, coalesce(sql, '') from "+master+" where name not like 'sqlite\\_%' escape '\\' order by name", nil, func(rows *Rows) error {
+		var tpe, objectName, table, sql string
+		if err := rows.Scan(&tpe, &objectName, &table, &sql); err != nil {
+			return err
+		}
+		switch tpe {
+		case "table":
+			sqls[objectName] = sql
+		case "view":
+			schema.Views = append(schema.Views, View{Name: objectName, SQL: sql, Temp: temp})
+		case "trigger":
+			schema.Triggers = append(schema.Triggers, Trigger{Name: objectName, Table: table, SQL: sql, Temp: temp})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	start := len(schema.Tables)
+	err = c.each("select name, type, wr, strict from pragma_table_list where schema = ?1 and type in ('table', 'virtual') and name not like 'sqlite\\_%' escape '\\' order by name", []any{name}, func(rows *Rows) error {
+		var t Table
+		var tpe string
+		if err := rows.Scan(&t.Name, &tpe, &t.WithoutRowID, &t.Strict); err != nil {
+			return err
+		}
+		t.SQL = sqls[t.Name]
+		t.Temp = temp
+		t.Virtual = tpe == "virtual"
+		schema.Tables = append(schema.Tables, t)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := start; i < len(schema.Tables); i++ {
+		t := &schema.Tables[i]
+		if t.Columns, err = c.columns(t.Name, name); err != nil {
+			return err
+		}
+		if t.Indexes, err = c.indexes(t.Name, name); err != nil {
+			return err
+		}
+		if t.ForeignKeys, err = c.foreignKeys(t.Name, name); err != nil {
+			return err
+		}
+	}
+
+	for i := range schema.Views {
+		v := &schema.Views[i]
+		if v.Temp != temp {
+			continue
+		}
+		if v.Columns, err = c.columns(v.Name, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c Conn) columns(table string, schema string) ([]Column, error) {
+	var columns []Column
+	err := c.each(`select name, type, "notnull", dflt_value, pk, hidden from pragma_table_xinfo(?1, ?2) order by cid`, []any{table, schema}, func(rows *Rows) error {
+		var column Column
+		var hidden int
+		if err := rows.Scan(&column.Name, &column.Type, &column.NotNull, &column.Default, &column.PrimaryKey, &hidden); err != nil {
+			return err
+		}
+		switch hidden {
+		case 1:
+			column.Hidden = true
+		case 2:
+			column.Generated = true
+		case 3:
+			column.Generated = true
+			column.Stored = true
+		}
+		columns = append(columns, column)
+		return nil
+	})
+	return columns, err
+}
+
+func (c Conn) indexes(table string, schema string) ([]Index, error) {
+	var indexes []Index
+	err := c.each(`select name, "unique", origin, partial from pragma_index_list(?1, ?2) order by name`, []any{table, schema}, func(rows *Rows) error {
+		var index Index
+		if err := rows.Scan(&index.Name, &index.Unique, &index.Origin, &index.Partial); err != nil {
+			return err
+		}
+		indexes = append(indexes, index)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	master := "sqlite_schema"
+	if schema == "temp" {
+		master = "sqlite_temp_schema"
+	}
+	for i := range indexes {
+		index := &indexes[i]
+		// the primary key of a without rowid table has no entry
+		err := c.Row("select sql from "+master+" where type = 'index' and name = ?1", index.Name).Scan(&index.SQL)
+		if err != nil && err != ErrNoRows {
+			return nil, err
+		}
+		err = c.each(`select cid, coalesce(name, ''), "desc", coll from pragma_index_xinfo(?1, ?2) where key = 1 order by seqno`, []any{index.Name, schema}, func(rows *Rows) error {
+			var cid int
+			var column IndexColumn
+			if err := rows.Scan(&cid, &column.Name, &column.Desc, &column.Collation); err != nil {
+				return err
+			}
+			column.Expression = cid == -2
+			index.Columns = append(index.Columns, column)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return indexes, nil
+}
+
+func (c Conn) foreignKeys(table string, schema string) ([]ForeignKey, error) {
+	var fks []ForeignKey
+	last := -1
+	err := c.each(`select id, "table", "from", coalesce("to", ''), on_update, on_delete, "match" from pragma_foreign_key_list(?1, ?2) order by id, seq`, []any{table, schema}, func(rows *Rows) error {
+		var id int
+		var parent, from, to string
+		var fk ForeignKey
+		if err := rows.Scan(&id, &parent, &from, &to, &fk.OnUpdate, &fk.OnDelete, &fk.Match); err != nil {
+			return err
+		}
+		if id != last {
+			last = id
+			fk.Table = parent
+			fks = append(fks, fk)
+		}
+		current := &fks[len(fks)-1]
+		current.From = append(current.From, from)
+		current.To = append(current.To, to)
+		return nil
+	})
+	return fks, err
+}
+
+func (c Conn) each(sql string, args []any, f func(rows *Rows) error) error {
+	rows := c.RowsArr(sql, args)
+	defer rows.Close()
+	for rows.Next() {
+		if err := f(&rows); err != nil {
+			return err
+		}
+	}
+	return rows.Error()
+}
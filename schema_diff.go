@@ -0,0 +1,425 @@
+package sqlite
+
+import (
+	"sort"
+	"strings"
+)
+
+const (
+	// The object exists in the expected schema but not in the actual one
+	DiffMissing = "missing"
+	// The object exists in the actual schema but not in the expected one
+	DiffExtra = "extra"
+	// The object exists in both, but differs
+	DiffChanged = "changed"
+)
+
+// The differences between an expected schema (a) and an actual one (b), see
+// SchemaDiff. Indexes only include those created with CREATE INDEX; unique
+// and primary key constraints are part of their table's definition.
+type Diff struct {
+	Tables   []TableDiff
+	Indexes  []ObjectDiff
+	Triggers []ObjectDiff
+	Views    []ObjectDiff
+
+	expected Schema
+	actual   Schema
+
+	// the actual database's legacy_alter_table, which rebuilds restore
+	legacyAlterTable bool
+
+	err error
+}
+
+type DiffSQLConfig struct {
+	// Drop tables which exist in the actual schema but not in the expected
+	// one. Off by default, since it loses their data.
+	DropExtraTables bool
+}
+
+type TableDiff struct {
+	Name   string
+	Change string
+
+	// For a changed table, the columns which differ. A table can be changed
+	// without any of its columns differing (e.g. a new CHECK constraint)
+	Columns []ObjectDiff
+}
+
+type ObjectDiff struct {
+	Name   string
+	Change string
+
+	// The table the column, index or trigger belongs to
+	Table string
+}
+
+// Compares the schema of a (the expected schema) with that of b. If either
+// schema can't be read, the Diff is empty and Error returns the error.
+func SchemaDiff(a Conn, b Conn) Diff {
+	expected, err := a.Schema()
+	if err != nil {
+		return Diff{err: err}
+	}
+	actual, err := b.Schema()
+	if err != nil {
+		return Diff{err: err}
+	}
+
+	var legacyAlterTable bool
+	if err := b.Row("pragma legacy_alter_table").Scan(&legacyAlterTable); err != nil {
+		return Diff{err: err}
+	}
+
+	diff := DiffSchemas(expected, actual)
+	diff.legacyAlterTable = legacyAlterTable
+	return diff
+}
+
+func DiffSchemas(expected Schema, actual Schema) Diff {
+	diff := Diff{expected: expected, actual: actual}
+
+	// names are case-insensitive, so the maps are keyed by lowercase names
+	actualTables := tablesByName(actual.Tables)
+	for _, e := range expected.Tables {
+		key := strings.ToLower(e.Name)
+		a, ok := actualTables[key]
+		if !ok {
+			diff.Tables = append(diff.Tables, TableDiff{Name: e.Name, Change: DiffMissing})
+			continue
+		}
+		delete(actualTables, key)
+		columns := diffColumns(e, a)
+		if len(columns) > 0 || normalizeSQL(tableDefinition(e.SQL)) != normalizeSQL(tableDefinition(a.SQL)) {
+			diff.Tables = append(diff.Tables, TableDiff{Name: e.Name, Change: DiffChanged, Columns: columns})
+		}
+	}
+	for _, a := range actualTables {
+		diff.Tables = append(diff.Tables, TableDiff{Name: a.Name, Change: DiffExtra})
+	}
+	sort.Slice(diff.Tables, func(i, j int) bool {
+		return diff.Tables[i].Name < diff.Tables[j].Name
+	})
+
+	diff.Indexes = diffObjects(schemaIndexes(expected), schemaIndexes(actual))
+	diff.Triggers = diffObjects(schemaTriggers(expected), schemaTriggers(actual))
+	diff.Views = diffObjects(schemaViews(expected), schemaViews(actual))
+	return diff
+}
+
+func (d Diff) Error() error {
+	return d.err
+}
+
+func (d Diff) Changed() bool {
+	return len(d.Tables) > 0 || len(d.Indexes) > 0 || len(d.Triggers) > 0 || len(d.Views) > 0
+}
+
+// The statements which would bring the actual schema in line with the
+// expected one. Changed tables are rebuilt: a new table is created, the
+// columns the two have in common are copied over, the old table is dropped
+// and the new one renamed. Foreign key enforcement should be disabled while
+// the statements run (it can't be changed within a transaction) and
+// PRAGMA foreign_key_check run afterwards. Extra tables aren't dropped (see
+// SQLConfig).
+func (d Diff) SQL() []string {
+	return d.SQLConfig(DiffSQLConfig{})
+}
+
+func (d Diff) SQLConfig(config DiffSQLConfig) []string {
+	var sql []string
+
+	expectedTables := tablesByName(d.expected.Tables)
+	actualTables := tablesByName(d.actual.Tables)
+
+	for _, v := range d.Views {
+		if v.Change != DiffMissing {
+			sql = append(sql, "DROP VIEW IF EXISTS "+QuoteIdentifier(v.Name))
+		}
+	}
+	for _, t := range d.Triggers {
+		if t.Change != DiffMissing {
+			sql = append(sql, "DROP TRIGGER IF EXISTS "+QuoteIdentifier(t.Name))
+		}
+	}
+	for _, i := range d.Indexes {
+		if i.Change != DiffMissing {
+			sql = append(sql, "DROP INDEX IF EXISTS "+QuoteIdentifier(i.Name))
+		}
+	}
+
+	// tables which are (re-)created, along with their indexes and triggers
+	created := make(map[string]bool)
+	for _, t := range d.Tables {
+		key := strings.ToLower(t.Name)
+		switch t.Change {
+		case DiffMissing:
+			created[key] = true
+			sql = append(sql, expectedTables[key].SQL)
+		case DiffExtra:
+			if config.DropExtraTables {
+				sql = append(sql, "DROP TABLE "+QuoteIdentifier(t.Name))
+			}
+		case DiffChanged:
+			created[key] = true
+			sql = append(sql, rebuildSQL(expectedTables[key], actualTables[key], d.legacyAlterTable)...)
+		}
+	}
+
+	changedIndexes := changedObjects(d.Indexes)
+	for _, t := range d.expected.Tables {
+		for _, i := range t.Indexes {
+			if i.SQL != nil && (created[strings.ToLower(t.Name)] || changedIndexes[strings.ToLower(i.Name)]) {
+				sql = append(sql, *i.SQL)
+			}
+		}
+	}
+
+	changedViews := changedObjects(d.Views)
+	for _, v := range d.expected.Views {
+		if changedViews[strings.ToLower(v.Name)] {
+			sql = append(sql, v.SQL)
+		}
+	}
+
+	changedTriggers := changedObjects(d.Triggers)
+	for _, t := range d.expected.Triggers {
+		if created[strings.ToLower(t.Table)] || changedTriggers[strings.ToLower(t.Name)] {
+			sql = append(sql, t.SQL)
+		}
+	}
+	return sql
+}
+
+func rebuildSQL(expected Table, actual Table, legacyAlterTable bool) []string {
+	table := QuoteIdentifier(expected.Name)
+	if expected.Virtual || actual.Virtual {
+		return []string{"DROP TABLE " + table, expected.SQL}
+	}
+
+	temp := QuoteIdentifier("schema_diff_new_" + expected.Name)
+	sql := []string{"CREATE TABLE " + temp + " " + tableDefinition(expected.SQL)}
+
+	var columns []string
+	for _, e := range expected.Columns {
+		if e.Generated || e.Hidden {
+			continue
+		}
+		if a, ok := findColumn(actual, e.Name); ok && !a.Generated && !a.Hidden {
+			columns = append(columns, QuoteIdentifier(e.Name))
+		}
+	}
+	if len(columns) > 0 {
+		list := strings.Join(columns, ", ")
+		sql = append(sql, "INSERT INTO "+temp+" ("+list+") SELECT "+list+" FROM "+table)
+	}
+
+	// the legacy behavior doesn't rewrite (or validate) references to the
+	// table in views and triggers, which already refer to it by its final name
+	sql = append(sql, "DROP TABLE "+table)
+	if legacyAlterTable {
+		return append(sql, "ALTER TABLE "+temp+" RENAME TO "+table)
+	}
+	return append(sql,
+		"PRAGMA legacy_alter_table = on",
+		"ALTER TABLE "+temp+" RENAME TO "+table,
+		"PRAGMA legacy_alter_table = off",
+	)
+}
+
+func tablesByName(tables []Table) map[string]Table {
+	byName := make(map[string]Table, len(tables))
+	for _, t := range tables {
+		byName[strings.ToLower(t.Name)] = t
+	}
+	return byName
+}
+
+func findColumn(t Table, name string) (Column, bool) {
+	for _, c := range t.Columns {
+		if strings.EqualFold(c.Name, name) {
+			return c, true
+		}
+	}
+	return Column{}, false
+}
+
+func diffColumns(expected Table, actual Table) []ObjectDiff {
+	var diffs []ObjectDiff
+	for _, e := range expected.Columns {
+		a, ok := findColumn(actual, e.Name)
+		if !ok {
+			diffs = append(diffs, ObjectDiff{Name: e.Name, Table: expected.Name, Change: DiffMissing})
+		} else if !sameColumn(e, a) {
+			diffs = append(diffs, ObjectDiff{Name: e.Name, Table: expected.Name, Change: DiffChanged})
+		}
+	}
+	for _, a := range actual.Columns {
+		if _, ok := findColumn(expected, a.Name); !ok {
+			diffs = append(diffs, ObjectDiff{Name: a.Name, Table: expected.Name, Change: DiffExtra})
+		}
+	}
+	return diffs
+}
+
+func sameColumn(a Column, b Column) bool {
+	if (a.Default == nil) != (b.Default == nil) {
+		return false
+	}
+	if a.Default != nil && *a.Default != *b.Default {
+		return false
+	}
+	return strings.EqualFold(a.Type, b.Type) &&
+		a.NotNull == b.NotNull &&
+		a.PrimaryKey == b.PrimaryKey &&
+		a.Hidden == b.Hidden &&
+		a.Generated == b.Generated &&
+		a.Stored == b.Stored
+}
+
+// Schema objects (indexes, triggers and views) keyed by their lowercase name
+type schemaObject struct {
+	name  string
+	table string
+	sql   string
+}
+
+func diffObjects(expected map[string]schemaObject, actual map[string]schemaObject) []ObjectDiff {
+	var diffs []ObjectDiff
+	for key, e := range expected {
+		a, ok := actual[key]
+		if !ok {
+			diffs = append(diffs, ObjectDiff{Name: e.name, Table: e.table, Change: DiffMissing})
+		} else if normalizeSQL(e.sql) != normalizeSQL(a.sql) {
+			diffs = append(diffs, ObjectDiff{Name: e.name, Table: e.table, Change: DiffChanged})
+		}
+	}
+	for key, a := range actual {
+		if _, ok := expected[key]; !ok {
+			diffs = append(diffs, ObjectDiff{Name: a.name, Table: a.table, Change: DiffExtra})
+		}
+	}
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].Name < diffs[j].Name
+	})
+	return diffs
+}
+
+func changedObjects(diffs []ObjectDiff) map[string]bool {
+	changed := make(map[string]bool, len(diffs))
+	for _, d := range diffs {
+		if d.Change != DiffExtra {
+			changed[strings.ToLower(d.Name)] = true
+		}
+	}
+	return changed
+}
+
+func schemaIndexes(s Schema) map[string]schemaObject {
+	objects := make(map[string]schemaObject)
+	for _, t := range s.Tables {
+		for _, i := range t.Indexes {
+			if i.SQL != nil {
+				objects[strings.ToLower(i.Name)] = schemaObject{name: i.Name, table: t.Name, sql: *i.SQL}
+			}
+		}
+	}
+	return objects
+}
+
+func schemaTriggers(s Schema) map[string]schemaObject {
+	objects := make(map[string]schemaObject, len(s.Triggers))
+	for _, t := range s.Triggers {
+		objects[strings.ToLower(t.Name)] = schemaObject{name: t.Name, table: t.Table, sql: t.SQL}
+	}
+	return objects
+}
+
+func schemaViews(s Schema) map[string]schemaObject {
+	objects := make(map[string]schemaObject, len(s.Views))
+	for _, v := range s.Views {
+		objects[strings.ToLower(v.Name)] = schemaObject{name: v.Name, table: v.Name, sql: v.SQL}
+	}
+	return objects
+}
+
+// The part of a CREATE TABLE statement which follows the table's name.
+func tableDefinition(sql string) string {
+	rest := sql
+	for _, prefix := range []string{"CREATE TABLE ", "CREATE VIRTUAL TABLE "} {
+		if len(rest) >= len(prefix) && strings.EqualFold(rest[:len(prefix)], prefix) {
+			rest = rest[len(prefix):]
+			break
+		}
+	}
+	rest = strings.TrimLeft(rest, " \t\r\n")
+	if rest == "" {
+		return rest
+	}
+
+	end := quotedEnd(rest, 0)
+	if end == 0 {
+		end = strings.IndexAny(rest, " \t\r\n(")
+		if end == -1 {
+			end = len(rest)
+		}
+	}
+	return strings.TrimLeft(rest[end:], " \t\r\n")
+}
+
+// Collapses whitespace so that formatting differences aren't reported as
+// changes.
+func normalizeSQL(sql string) string {
+	var sb strings.Builder
+	sb.Grow(len(sql))
+	space := false
+	var last byte
+	for i := 0; i < len(sql); i++ {
+		b := sql[i]
+		if b == ' ' || b == '\t' || b == '\r' || b == '\n' {
+			space = true
+			continue
+		}
+		if space && last != 0 && last != '(' && last != ',' && b != ')' && b != ',' {
+			sb.WriteByte(' ')
+		}
+		space = false
+
+		// strings and quoted identifiers are kept as-is
+		if end := quotedEnd(sql, i); end > i {
+			sb.WriteString(sql[i:end])
+			i = end - 1
+			last = sql[i]
+			continue
+		}
+		last = b
+		sb.WriteByte(b)
+	}
+	return sb.String()
+}
+
+// The end of the string or quoted identifier starting at i, or i if there
+// isn't one.
+func quotedEnd(sql string, i int) int {
+	quote := sql[i]
+	switch quote {
+	case '\'', '"', '`':
+	case '[':
+		quote = ']'
+	default:
+		return i
+	}
+	for end := i + 1; end < len(sql); end++ {
+		if sql[end] != quote {
+			continue
+		}
+		// a doubled quote is an escaped quote
+		if quote != ']' && end+1 < len(sql) && sql[end+1] == quote {
+			end += 1
+			continue
+		}
+		return end + 1
+	}
+	return len(sql)
+}
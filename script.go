@@ -0,0 +1,190 @@
+package sqlite
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Iterates over every statement of a multi-statement SQL text, preparing
+// each one in turn:
+//
+//	script := conn.Script(sql)
+//	defer script.Close()
+//	for script.Next() {
+//		if err := script.Exec(argsFor(script.Index())...); err != nil {
+//			return err
+//		}
+//	}
+//	return script.Error()
+//
+// Statements are prepared as they're reached, so a statement can depend on
+// the schema changes of the ones before it. Empty statements (only
+// whitespace, comments or semicolons) are skipped.
+type Script struct {
+	conn   Conn
+	sql    []byte
+	next   int
+	index  int
+	offset int
+	end    int
+	stmt   *Stmt
+	err    error
+}
+
+// Returned for a statement of a script which failed to prepare or execute.
+// Index is the statement's position in the script (0-based, not counting
+// empty statements) and Offset its byte offset within the script.
+type ScriptError struct {
+	Index  int
+	Offset int
+	error  error
+}
+
+func (e ScriptError) Unwrap() error {
+	return e.error
+}
+
+func (e ScriptError) Error() string {
+	return fmt.Sprintf("%s (statement: %d, offset: %d)", e.error.Error(), e.Index, e.Offset)
+}
+
+func (c Conn) Script(sql string) *Script {
+	return c.ScriptB(s2b(sql))
+}
+
+func (c Conn) ScriptB(sql []byte) *Script {
+	return &Script{conn: c, sql: sql, index: -1}
+}
+
+// Runs every statement of the script. args[i], if present, is bound to the
+// i-th statement.
+func (c Conn) ExecScript(sql string, args ...[]any) error {
+	script := c.Script(sql)
+	defer script.Close()
+
+	for script.Next() {
+		var stmtArgs []any
+		if i := script.Index(); i < len(args) {
+			stmtArgs = args[i]
+		}
+		if err := script.Exec(stmtArgs...); err != nil {
+			return err
+		}
+	}
+	if err := script.Error(); err != nil {
+		return err
+	}
+
+	if count := script.Index() + 1; len(args) > count {
+		return Error{Code: CodeMisuse, Message: fmt.Sprintf("script has %d statements, got args for %d", count, len(args))}
+	}
+	return nil
+}
+
+// Finalizes the current statement and prepares the next one. Returns false
+// once there are no more statements, or if the next one failed to prepare
+// (see Error).
+func (s *Script) Next() bool {
+	if s.err != nil {
+		return false
+	}
+	s.closeStmt()
+
+	sql := s.sql
+	for {
+		start := s.next + leadingSpace(sql[s.next:])
+		if start == len(sql) {
+			return false
+		}
+		stmt, n, err := s.conn.prepare(sql[start:], nil)
+		if err != nil {
+			s.err = ScriptError{Index: s.index + 1, Offset: start, error: err}
+			return false
+		}
+		s.next = start + n
+		if stmt == nil {
+			// a comment style leadingSpace doesn't know about
+			continue
+		}
+		s.stmt = stmt
+		s.index += 1
+		s.offset = start
+		s.end = start + len(bytes.TrimRight(sql[start:s.next], " \t\r\n"))
+		return true
+	}
+}
+
+// The current statement. Valid until the next call to Next (or Close).
+func (s *Script) Stmt() *Stmt {
+	return s.stmt
+}
+
+// The SQL of the current statement, as it appears in the script.
+func (s *Script) SQL() string {
+	return string(s.sql[s.offset:s.end])
+}
+
+// The byte offset of the current statement within the script.
+func (s *Script) Offset() int {
+	return s.offset
+}
+
+// The 0-based index of the current statement (-1 before Next is called).
+func (s *Script) Index() int {
+	return s.index
+}
+
+// Binds args to the current statement and steps it to completion.
+func (s *Script) Exec(args ...any) error {
+	if err := s.stmt.Exec(args...); err != nil {
+		return s.wrap(err)
+	}
+	return nil
+}
+
+// The error which stopped Next, if any.
+func (s *Script) Error() error {
+	return s.err
+}
+
+func (s *Script) Close() {
+	s.closeStmt()
+}
+
+func (s *Script) closeStmt() {
+	if stmt := s.stmt; stmt != nil {
+		stmt.Close()
+		s.stmt = nil
+	}
+}
+
+func (s *Script) wrap(err error) error {
+	return ScriptError{Index: s.index, Offset: s.offset, error: err}
+}
+
+// The number of bytes of whitespace, comments and empty statements before
+// the next statement.
+func leadingSpace(sql []byte) int {
+	i := 0
+	for i < len(sql) {
+		switch b := sql[i]; {
+		case b == ' ' || b == '\t' || b == '\r' || b == '\n' || b == ';':
+			i += 1
+		case b == '-' && i+1 < len(sql) && sql[i+1] == '-':
+			end := bytes.IndexByte(sql[i:], '\n')
+			if end == -1 {
+				return len(sql)
+			}
+			i += end + 1
+		case b == '/' && i+1 < len(sql) && sql[i+1] == '*':
+			end := bytes.Index(sql[i+2:], []byte("*/"))
+			if end == -1 {
+				return len(sql)
+			}
+			i += end + 4
+		default:
+			return i
+		}
+	}
+	return i
+}
@@ -1,10 +1,16 @@
 package sqlite_test
 
 import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
 	"errors"
 	"io/fs"
+	"math"
 	"math/rand"
 	"os"
+	"strconv"
+	"strings"
 	"testing"
 	"time"
 
@@ -115,6 +121,64 @@ func Test_Conn_Scan_RawBytes(t *testing.T) {
 	rows.Close()
 }
 
+func Test_Stmt_ColumnRawText(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	rows := db.Rows("select 'hello', '', null, 123")
+	defer rows.Close()
+	assert.True(t, rows.Next())
+
+	stmt := rows.Stmt
+	b, err := stmt.ColumnRawText(0)
+	assert.Nil(t, err)
+	assert.Equal(t, string(b), "hello")
+
+	b, err = stmt.ColumnRawText(1)
+	assert.Nil(t, err)
+	assert.True(t, b != nil)
+	assert.Equal(t, len(b), 0)
+
+	b, err = stmt.ColumnRawText(2)
+	assert.Nil(t, err)
+	assert.True(t, b == nil)
+
+	b, err = stmt.ColumnRawText(3)
+	assert.Nil(t, err)
+	assert.Equal(t, string(b), "123")
+
+	str, err := stmt.ColumnUnsafeString(0)
+	assert.Nil(t, err)
+	assert.Equal(t, str, "hello")
+}
+
+func Test_DebugRawBuffers(t *testing.T) {
+	db := testDBConfig(sqlite.Config{DebugRawBuffers: true})
+	defer db.Close()
+
+	rows := db.Rows("select 'abc', x'0102' union all select 'def', x'0304'")
+	defer rows.Close()
+
+	assert.True(t, rows.Next())
+	var text, blob sqlite.RawBytes
+	assert.Nil(t, rows.Scan(&text, &blob))
+	str, _ := rows.Stmt.ColumnUnsafeString(0)
+	assert.Equal(t, string(text), "abc")
+	assert.Equal(t, blob[1], 2)
+	assert.Equal(t, str, "abc")
+
+	assert.True(t, rows.Next())
+	assert.Equal(t, string(text), "\xdb\xdb\xdb")
+	assert.Equal(t, blob[0], sqlite.RawBufferPoison)
+	assert.Equal(t, blob[1], sqlite.RawBufferPoison)
+	assert.Equal(t, str, "\xdb\xdb\xdb")
+
+	// the new row is fine
+	assert.Nil(t, rows.Scan(&text, &blob))
+	assert.Equal(t, string(text), "def")
+	assert.Equal(t, blob[1], 4)
+}
+
 func Test_Bool_True(t *testing.T) {
 	db := testDB()
 	defer db.Close()
@@ -208,6 +272,132 @@ func Test_Uint(t *testing.T) {
 	assert.Equal(t, u64_2, 9002)
 }
 
+func Test_Numeric_Types(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	i8, i16, i32, u, u8, f32 := int8(-8), int16(-16), int32(-32), uint(1), uint8(8), float32(3.5)
+	args := []any{i8, &i8, i16, &i16, i32, &i32, u, &u, u8, &u8, f32, &f32}
+
+	var i8s, i8sp int8
+	var i16s, i16sp *int16
+	var i32s, i32sp int32
+	var us, usp *uint
+	var u8s, u8sp uint8
+	var f32s, f32sp *float32
+	err := db.Row("select ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?", args...).Scan(&i8s, &i8sp, &i16s, &i16sp, &i32s, &i32sp, &us, &usp, &u8s, &u8sp, &f32s, &f32sp)
+	assert.Nil(t, err)
+	assert.Equal(t, i8s, -8)
+	assert.Equal(t, i8sp, -8)
+	assert.Equal(t, *i16s, -16)
+	assert.Equal(t, *i16sp, -16)
+	assert.Equal(t, i32s, -32)
+	assert.Equal(t, i32sp, -32)
+	assert.Equal(t, *us, 1)
+	assert.Equal(t, *usp, 1)
+	assert.Equal(t, u8s, 8)
+	assert.Equal(t, u8sp, 8)
+	assert.Equal(t, *f32s, 3.5)
+	assert.Equal(t, *f32sp, 3.5)
+
+	var nullp *int8
+	var o1, o2, o3, o4 sqlite.Option[int16]
+	err = db.Row("select ?, ?, ?, ?, ?", nil, 9, nil, sqlite.Option[uint8]{Value: 200, Valid: true}, sqlite.Option[int]{}).Scan(&nullp, &o1, &o2, &o3, &o4)
+	assert.Nil(t, err)
+	assert.True(t, nullp == nil)
+	assert.Equal(t, o1, sqlite.Option[int16]{Value: 9, Valid: true})
+	assert.Equal(t, o2, sqlite.Option[int16]{})
+	assert.Equal(t, o3, sqlite.Option[int16]{Value: 200, Valid: true})
+	assert.Equal(t, o4, sqlite.Option[int16]{})
+
+	var f32o sqlite.Option[float32]
+	var u64o sqlite.Option[uint64]
+	var so sqlite.Option[string]
+	assert.Nil(t, db.Row("select 1.25, 9001, ?", sqlite.Option[string]{Value: "hi", Valid: true}).Scan(&f32o, &u64o, &so))
+	assert.Equal(t, f32o, sqlite.Option[float32]{Value: 1.25, Valid: true})
+	assert.Equal(t, u64o, sqlite.Option[uint64]{Value: 9001, Valid: true})
+	assert.Equal(t, so, sqlite.Option[string]{Value: "hi", Valid: true})
+
+	var nilOption *sqlite.Option[int]
+	validOption := &sqlite.Option[int]{Value: 3, Valid: true}
+	var isNull bool
+	var pv int
+	assert.Nil(t, db.Row("select ?1 is null, ?2", nilOption, validOption).Scan(&isNull, &pv))
+	assert.True(t, isNull)
+	assert.Equal(t, pv, 3)
+}
+
+func Test_Numeric_Bind_Overflow(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	var rangeErr sqlite.RangeError
+	err := db.Exec("select ?, ?", 1, uint64(math.MaxInt64+1))
+	assert.True(t, errors.As(err, &rangeErr))
+	assert.Equal(t, rangeErr.Index, 1)
+	assert.Equal(t, err.Error(), "sqlite: 9223372036854775808 is out of range for int64 (index: 1)")
+
+	big := uint(math.MaxUint64)
+	err = db.Exec("select ?", &big)
+	assert.True(t, errors.As(err, &rangeErr))
+	assert.Equal(t, rangeErr.Index, 0)
+
+	var n uint64
+	assert.Nil(t, db.Row("select ?", uint64(math.MaxInt64)).Scan(&n))
+	assert.Equal(t, n, math.MaxInt64)
+}
+
+func Test_Numeric_Scan_Overflow(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	var rangeErr sqlite.RangeError
+
+	var u16 uint16
+	err := db.Row("select 1, 70000").Scan(&u16, &u16)
+	assert.True(t, errors.As(err, &rangeErr))
+	assert.Equal(t, rangeErr.Index, 1)
+	assert.Equal(t, rangeErr.Type, "uint16")
+	assert.Equal(t, err.Error(), "sqlite: 70000 is out of range for uint16 (index: 1)")
+
+	var u64 *uint64
+	err = db.Row("select -1").Scan(&u64)
+	assert.Equal(t, err.Error(), "sqlite: -1 is out of range for uint64 (index: 0)")
+	assert.True(t, u64 == nil)
+
+	var i8 sqlite.Option[int8]
+	err = db.Row("select -129").Scan(&i8)
+	assert.Equal(t, err.Error(), "sqlite: -129 is out of range for int8 (index: 0)")
+
+	var i32 int32
+	err = db.Row("select 2147483648").Scan(&i32)
+	assert.Equal(t, err.Error(), "sqlite: 2147483648 is out of range for int32 (index: 0)")
+
+	var f32 float32
+	err = db.Row("select 1e300").Scan(&f32)
+	assert.Equal(t, err.Error(), "sqlite: 1e+300 is out of range for float32 (index: 0)")
+
+	// reals have to be integral, and aren't clamped to int64's range
+	var i int
+	assert.Nil(t, db.Row("select 3.0").Scan(&i))
+	assert.Equal(t, i, 3)
+	err = db.Row("select 2.5").Scan(&i)
+	assert.Equal(t, err.Error(), "sqlite: 2.5 is out of range for int (index: 0)")
+
+	var i64 *int64
+	err = db.Row("select 1e19").Scan(&i64)
+	assert.Equal(t, err.Error(), "sqlite: 1e+19 is out of range for int64 (index: 0)")
+	assert.True(t, i64 == nil)
+	assert.Nil(t, db.Row("select -9223372036854775808.0").Scan(&i64))
+	assert.Equal(t, *i64, math.MinInt64)
+
+	var u8 sqlite.Option[uint8]
+	err = db.Row("select 256.0").Scan(&u8)
+	assert.Equal(t, err.Error(), "sqlite: 256 is out of range for uint8 (index: 0)")
+	err = db.Row("select -0.5").Scan(&u8)
+	assert.Equal(t, err.Error(), "sqlite: -0.5 is out of range for uint8 (index: 0)")
+}
+
 func Test_String_Empty(t *testing.T) {
 	db := testDB()
 	defer db.Close()
@@ -277,204 +467,1799 @@ func Test_Transaction_Rollback(t *testing.T) {
 	assert.Nil(t, queryId(db, id2))
 }
 
-func Test_Rows(t *testing.T) {
+func Test_Stmt_Query(t *testing.T) {
 	db := testDB()
 	defer db.Close()
 
-	mustExec(db, "delete from test")
-	mustExec(db, `
-		insert into test (cint, ctext)
-		values (?1, ?2), (?3, ?4)
-	`, 1, "two", 3, "four")
-	assert.Equal(t, db.Changes(), 2)
+	mustExec(db, "insert into test (cint, ctext) values (1, 'a'), (2, 'b'), (3, 'c')")
 
-	rows := db.RowsB([]byte("select cint, ctext from test"))
-	defer rows.Close()
+	stmt, err := db.Prepare([]byte("select cint, ctext from test where cint >= ?1 order by cint"))
+	assert.Nil(t, err)
+	defer stmt.Close()
 
-	results := make([][]any, 0, 2)
-	for rows.Next() {
-		var n int
-		var t string
-		if rows.Scan(&n, &t) != nil {
-			break
+	collect := func(rows sqlite.Rows) []string {
+		defer rows.Close()
+		var values []string
+		for rows.Next() {
+			var n int
+			var s string
+			rows.Scan(&n, &s)
+			values = append(values, s)
 		}
-		results = append(results, []any{n, t})
+		assert.Nil(t, rows.Error())
+		return values
 	}
-	assert.Nil(t, rows.Error())
-	assert.Equal(t, len(results), 2)
-	assert.Equal(t, results[0][0].(int), 1)
-	assert.Equal(t, results[0][1].(string), "two")
-	assert.Equal(t, results[1][0].(int), 3)
-	assert.Equal(t, results[1][1].(string), "four")
+
+	assert.Equal(t, strings.Join(collect(stmt.Query(2)), ","), "b,c")
+	assert.Equal(t, strings.Join(collect(stmt.Query(1)), ","), "a,b,c")
+	assert.Equal(t, len(collect(stmt.Query(4))), 0)
+
+	// abandoned mid-iteration, without being closed
+	rows := stmt.Query(1)
+	assert.True(t, rows.Next())
+	assert.Equal(t, strings.Join(collect(stmt.Query(3)), ","), "c")
+
+	// bind errors are surfaced through the Rows
+	rows = stmt.Query(uint64(math.MaxUint64))
+	assert.False(t, rows.Next())
+	assert.Equal(t, rows.Error().Error(), "sqlite: 18446744073709551615 is out of range for int64 (index: 0)")
+	rows.Close()
+
+	var n int
+	var s string
+	assert.Nil(t, stmt.QueryRow(2).Scan(&n, &s))
+	assert.Equal(t, s, "b")
+	assert.Nil(t, stmt.QueryRow(3).Scan(&n, &s))
+	assert.Equal(t, s, "c")
+	assert.True(t, stmt.QueryRow(9).Scan(&n, &s) == sqlite.ErrNoRows)
+
+	m, err := stmt.QueryRow(1).Map()
+	assert.Nil(t, err)
+	assert.Equal(t, m["ctext"].(string), "a")
+
+	// the statement still works with the existing methods
+	assert.Nil(t, stmt.Bind([]any{1}))
+	found, err := stmt.Row(&n, &s)
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, s, "a")
 }
 
-func Test_Rows_QueryError(t *testing.T) {
+func Test_Stmt_Query_SchemaChange(t *testing.T) {
 	db := testDB()
 	defer db.Close()
 
-	rows := db.RowsB([]byte("select invalid from test"))
-	defer rows.Close()
+	mustExec(db, "create table altered (a int)")
+	mustExec(db, "insert into altered values (1)")
 
-	called := 0
-	for rows.Next() {
-		called += 1
-	}
-	assert.Equal(t, rows.Error().Error(), "sqlite: no such column: invalid (code: 1) - select invalid from test")
-	assert.Equal(t, called, 0)
+	stmt, err := db.Prepare([]byte("select * from altered"))
+	assert.Nil(t, err)
+	defer stmt.Close()
+
+	m, err := stmt.QueryRow().Map()
+	assert.Nil(t, err)
+	assert.Equal(t, len(m), 1)
+
+	// re-prepared by SQLite, with a new column
+	mustExec(db, "alter table altered add column b text default('x')")
+	m, err = stmt.QueryRow().Map()
+	assert.Nil(t, err)
+	assert.Equal(t, len(m), 2)
+	assert.Equal(t, m["b"].(string), "x")
+	assert.Equal(t, stmt.ColumnCount(), 2)
 }
 
-func Test_Rows_ScanError(t *testing.T) {
+func Test_ExecR(t *testing.T) {
 	db := testDB()
 	defer db.Close()
 
-	mustExec(db, "delete from test")
-	mustExec(db, `
-		insert into test (cint)
-		values (?1)
-	`, 33)
+	total := db.TotalChanges64()
 
-	rows := db.Rows("select cint from test")
-	defer rows.Close()
+	r, err := db.ExecR("insert into test (id, cint) values (?1, 1)", 10)
+	assert.Nil(t, err)
+	assert.Equal(t, r.LastInsertRowID, int64(10))
+	assert.Equal(t, r.RowsAffected, int64(1))
 
-	called := 0
-	for rows.Next() {
-		called += 1
-		var c os.File
-		if rows.Scan(&c) == nil {
-			break
+	r, err = db.ExecR("insert into test (cint) values (2), (2), (2)")
+	assert.Nil(t, err)
+	assert.Equal(t, r.LastInsertRowID, int64(13))
+	assert.Equal(t, r.RowsAffected, int64(3))
+
+	r, err = db.ExecR("update test set cint = 3 where cint = ?1", 2)
+	assert.Nil(t, err)
+	assert.Equal(t, r.RowsAffected, int64(3))
+
+	// sqlite3_changes would still say 3
+	r, err = db.ExecR("update test set cint = 4 where cint = 99")
+	assert.Nil(t, err)
+	assert.Equal(t, r.RowsAffected, int64(0))
+
+	r, err = db.ExecR("select 1")
+	assert.Nil(t, err)
+	assert.Equal(t, r.RowsAffected, int64(0))
+
+	// changes made by triggers aren't the statement's
+	mustExec(db, "create table audit (id int)")
+	mustExec(db, "create trigger test_audit after delete on test begin insert into audit values (old.id); end")
+	r, err = db.ExecR("delete from test where id = 10")
+	assert.Nil(t, err)
+	assert.Equal(t, r.RowsAffected, int64(1))
+
+	assert.Equal(t, db.TotalChanges64(), total+9)
+
+	_, err = db.ExecR("insert into test (id) values (?1)", 11)
+	assert.Equal(t, err.Error(), "sqlite: UNIQUE constraint failed: test.id (code: 1555)")
+
+	stmt, err := db.Prepare([]byte("delete from test where cint = ?1"))
+	assert.Nil(t, err)
+	defer stmt.Close()
+
+	r, err = stmt.ExecR(3)
+	assert.Nil(t, err)
+	assert.Equal(t, r.RowsAffected, int64(3))
+	r, err = stmt.ExecR(3)
+	assert.Nil(t, err)
+	assert.Equal(t, r.RowsAffected, int64(0))
+}
+
+func Test_ExecReturning(t *testing.T) {
+	for _, config := range []sqlite.Config{{}, {StmtCacheSize: 4}} {
+		db := testDBConfig(config)
+		defer db.Close()
+
+		// only the first row is read, but all the rows are inserted
+		rows := db.ExecReturning(`
+			insert into test (id, cint, creal, ctextn, cblob, cblobn)
+			values (1, 10, 1.5, 'a', x'', x'01'), (2, 20, 2.5, null, x'02', null), (3, 30, 3.5, 'c', x'03', null)
+			returning id, cint, creal, ctextn, cblob, cblobn as "the blob"
+		`)
+		assert.True(t, rows.Next())
+		var id, n int
+		var f float64
+		var text *string
+		var blob, blobn []byte
+		assert.Nil(t, rows.Scan(&id, &n, &f, &text, &blob, &blobn))
+		assert.Equal(t, id, 1)
+		assert.Equal(t, n, 10)
+		assert.Equal(t, f, 1.5)
+		assert.Equal(t, *text, "a")
+		assert.Equal(t, len(blob), 0)
+		assert.Equal(t, blobn[0], byte(1))
+		rows.Close()
+
+		var count int
+		assert.Nil(t, db.Row("select count(*) from test").Scan(&count))
+		assert.Equal(t, count, 3)
+
+		rows = db.ExecReturning("update test set cint = cint + 1 where id > ?1 returning id, ctextn, cblobn", 1)
+		var maps []map[string]any
+		for rows.Next() {
+			m, err := rows.Map()
+			assert.Nil(t, err)
+			maps = append(maps, m)
 		}
+		assert.Nil(t, rows.Error())
+		rows.Close()
+		assert.Equal(t, len(maps), 2)
+		assert.Equal(t, maps[0]["id"].(int), 2)
+		assert.Nil(t, maps[0]["ctextn"])
+		assert.Nil(t, maps[0]["cblobn"])
+		assert.Equal(t, maps[1]["ctextn"].(string), "c")
+
+		var cint int
+		assert.Nil(t, db.ExecReturningOne("update test set cint = 100 where id = ?1 returning cint", 3).Scan(&cint))
+		assert.Equal(t, cint, 100)
+
+		// the write happens even without any rows, or a returning clause
+		assert.True(t, db.ExecReturningOne("delete from test where id = 1 returning id").Scan(&id) == nil)
+		assert.True(t, db.ExecReturningOne("delete from test where id = 1 returning id").Scan(&id) == sqlite.ErrNoRows)
+		assert.True(t, db.ExecReturningOne("delete from test where id = 2").Scan(&id) == sqlite.ErrNoRows)
+		rows = db.ExecReturning("delete from test")
+		assert.False(t, rows.Next())
+		assert.Nil(t, rows.Error())
+		rows.Close()
+		assert.Nil(t, db.Row("select count(*) from test").Scan(&count))
+		assert.Equal(t, count, 0)
+
+		// errors
+		mustExec(db, "insert into test (id) values (1)")
+		rows = db.ExecReturning("insert into test (id) values (2), (1) returning id")
+		assert.False(t, rows.Next())
+		assert.True(t, sqlite.IsPrimaryKey(rows.Error()))
+		rows.Close()
+		assert.True(t, sqlite.IsPrimaryKey(db.ExecReturningOne("insert into test (id) values (1) returning id").Scan(&id)))
+		assert.Nil(t, db.Row("select count(*) from test").Scan(&count))
+		assert.Equal(t, count, 1)
+
+		_, isPrepareError := db.ExecReturningOne("insert into invalid values (1) returning id").Scan(&id).(sqlite.PrepareError)
+		assert.True(t, isPrepareError)
+
+		// more columns than SQLITE_MAX_VARIABLE_NUMBER
+		rows = db.ExecReturning("update test set cint = 7 returning " + strings.Repeat("cint, ", 199) + "id")
+		assert.True(t, rows.Next())
+		values := make([]any, 200)
+		assert.Nil(t, rows.Values(values))
+		assert.Equal(t, values[0].(int), 7)
+		assert.Equal(t, values[199].(int), 1)
+		assert.False(t, rows.Next())
+		rows.Close()
+
+		// values are converted like any other column's
+		var s string
+		var creal float64
+		assert.Nil(t, db.ExecReturningOne("update test set creal = 2.5 returning creal, creal").Scan(&s, &creal))
+		assert.Equal(t, s, "2.5")
+		assert.Equal(t, creal, 2.5)
 	}
-	assert.Equal(t, called, 1)
-	assert.Equal(t, rows.Error().Error(), "sqlite: cannot scan into *os.File (index: 0) (code: 21)")
 }
 
-func Test_Row_Map(t *testing.T) {
+func Test_Prepare_MultipleStatements(t *testing.T) {
+	for _, config := range []sqlite.Config{{}, {StmtCacheSize: 4}} {
+		db := testDBConfig(config)
+		defer db.Close()
+
+		_, err := db.Prepare([]byte("insert into test (id) values (1); insert into test (id) values (2)"))
+		assert.Equal(t, err.Error(), "sqlite: sql has more than one statement (see Script) (code: 21)")
+
+		err = db.Exec("insert into test (id) values (?1); insert into test (id) values (2)", 1)
+		assert.Equal(t, err.Error(), "sqlite: sql has more than one statement (see Script) (code: 21)")
+
+		var count int
+		assert.Nil(t, db.Row("select count(*) from test").Scan(&count))
+		assert.Equal(t, count, 0)
+
+		// trailing semicolons and comments are fine
+		stmt, err := db.Prepare([]byte("select 1; -- one\n;"))
+		assert.Nil(t, err)
+		stmt.Close()
+		assert.Nil(t, db.Row("select count(*) from test where id > ?1; /* done */", 0).Scan(&count))
+	}
+}
+
+func Test_Script(t *testing.T) {
 	db := testDB()
 	defer db.Close()
 
-	now := time.Now()
+	sql := "create table x (id int);\n  -- a comment\n;\ninsert into x values (?);  insert into x values (?)\n"
+	script := db.Script(sql)
+	var statements []string
+	var offsets []int
+	for script.Next() {
+		assert.Equal(t, script.Index(), len(statements))
+		statements = append(statements, script.SQL())
+		offsets = append(offsets, script.Offset())
+		if script.Index() == 0 {
+			assert.Nil(t, script.Exec())
+		} else {
+			assert.Nil(t, script.Exec(script.Index()))
+		}
+	}
+	assert.Nil(t, script.Error())
+	script.Close()
+	assert.Equal(t, len(statements), 3)
+	assert.Equal(t, statements[0], "create table x (id int);")
+	assert.Equal(t, statements[1], "insert into x values (?);")
+	assert.Equal(t, statements[2], "insert into x values (?)")
+	assert.Equal(t, offsets[0], 0)
+	assert.Equal(t, offsets[1], strings.Index(sql, "insert"))
+	assert.Equal(t, offsets[2], strings.LastIndex(sql, "insert"))
+
+	var sum int
+	assert.Nil(t, db.Row("select sum(id) from x").Scan(&sum))
+	assert.Equal(t, sum, 3)
+
+	// ExecScript
+	assert.Nil(t, db.ExecScript("delete from x; insert into x values (?); insert into x values (?), (?);", nil, []any{1}, []any{2, 3}))
+	assert.Nil(t, db.Row("select sum(id) from x").Scan(&sum))
+	assert.Equal(t, sum, 6)
+	assert.Nil(t, db.ExecScript("  \n-- nothing\n;"))
+	// the statements still run
+	assert.Equal(t, db.ExecScript("delete from x", nil, nil).Error(), "sqlite: script has 1 statements, got args for 2 (code: 21)")
+
+	// a failing statement
+	err := db.ExecScript("insert into x values (10);\ninsert into x values (?);\nselect * from invalid;", nil, []any{11})
+	scriptErr, ok := err.(sqlite.ScriptError)
+	assert.True(t, ok)
+	assert.Equal(t, scriptErr.Index, 2)
+	assert.Equal(t, scriptErr.Offset, 53)
+	_, isPrepareError := scriptErr.Unwrap().(sqlite.PrepareError)
+	assert.True(t, isPrepareError)
+	assert.Nil(t, db.Row("select sum(id) from x").Scan(&sum))
+	assert.Equal(t, sum, 21)
+
+	err = db.ExecScript("insert into x values (1); insert into x values ('a', 'b')")
+	assert.Equal(t, err.(sqlite.ScriptError).Index, 1)
+
+	mustExec(db, "create table y (id int primary key)")
+	err = db.ExecScript("insert into y values (1);\ninsert into y values (1)")
+	scriptErr = err.(sqlite.ScriptError)
+	assert.Equal(t, scriptErr.Index, 1)
+	assert.Equal(t, scriptErr.Offset, 26)
+	assert.True(t, sqlite.IsPrimaryKey(err))
+}
+
+func Test_Schema(t *testing.T) {
+	db := testDB()
+	defer db.Close()
 
 	mustExec(db, `
-		insert into test (id, cint, creal, ctext, cblob, ctime)
-		values (?1, ?2, ?3, ?4, ?5, ?6)
-	`, 99, 2, 3.3, "four", []byte("five"), now)
+		create table users (id integer primary key, name text not null default('') collate nocase, email text unique) strict;
+		create table posts (
+			id int not null,
+			user_id int references users(id) on delete cascade,
+			title text,
+			slug text generated always as (lower(title)) stored,
+			upper_title text as (upper(title)),
+			primary key (id, user_id),
+			foreign key (title, slug) references titles(title, slug)
+		) without rowid;
+		create index posts_title on posts(lower(title), user_id desc) where title is not null;
+		create view user_names as select id, name from users;
+		create trigger users_insert after insert on users begin select 1; end;
+	`)
+	createSqlkiteUser(db)
 
-	m, err := db.Row("select * from test").Map()
+	schema, err := db.Schema()
 	assert.Nil(t, err)
-	assert.Equal(t, len(m), 12)
+	assert.Equal(t, len(schema.Tables), 3)
+	assert.Equal(t, schema.Tables[0].Name, "posts")
+	assert.Equal(t, schema.Tables[2].Name, "users")
+	_, ok := schema.Table("sqlkite_user")
+	assert.False(t, ok)
+
+	users, _ := schema.Table("users")
+	assert.True(t, users.Strict)
+	assert.False(t, users.WithoutRowID)
+	assert.True(t, strings.HasPrefix(users.SQL, "CREATE TABLE users"))
+	assert.Equal(t, len(users.Columns), 3)
+	id, _ := users.Column("id")
+	assert.Equal(t, id.Type, "INTEGER")
+	assert.Equal(t, id.PrimaryKey, 1)
+	name, _ := users.Column("name")
+	assert.True(t, name.NotNull)
+	assert.Equal(t, *name.Default, "''")
+	email, _ := users.Column("email")
+	assert.Nil(t, email.Default)
+	assert.Equal(t, len(users.Indexes), 1)
+	assert.Equal(t, users.Indexes[0].Origin, "u")
+	assert.True(t, users.Indexes[0].Unique)
+	assert.Nil(t, users.Indexes[0].SQL)
+	assert.Equal(t, users.Indexes[0].Columns[0].Name, "email")
+
+	posts, _ := schema.Table("posts")
+	assert.True(t, posts.WithoutRowID)
+	assert.Equal(t, len(posts.Columns), 5)
+	userID, _ := posts.Column("user_id")
+	assert.Equal(t, userID.PrimaryKey, 2)
+	slug, _ := posts.Column("slug")
+	assert.True(t, slug.Generated)
+	assert.True(t, slug.Stored)
+	upper, _ := posts.Column("upper_title")
+	assert.True(t, upper.Generated)
+	assert.False(t, upper.Stored)
+
+	assert.Equal(t, len(posts.Indexes), 2)
+	index := posts.Indexes[0]
+	assert.Equal(t, index.Name, "posts_title")
+	assert.True(t, index.Partial)
+	assert.False(t, index.Unique)
+	assert.Equal(t, index.Origin, "c")
+	assert.True(t, strings.HasPrefix(*index.SQL, "CREATE INDEX posts_title"))
+	assert.Equal(t, len(index.Columns), 2)
+	assert.True(t, index.Columns[0].Expression)
+	assert.Equal(t, index.Columns[0].Name, "")
+	assert.Equal(t, index.Columns[1].Name, "user_id")
+	assert.True(t, index.Columns[1].Desc)
+	assert.Equal(t, index.Columns[1].Collation, "BINARY")
+	assert.Equal(t, posts.Indexes[1].Origin, "pk")
+
+	assert.Equal(t, len(posts.ForeignKeys), 2)
+	fk := posts.ForeignKeys[0]
+	assert.Equal(t, fk.Table, "titles")
+	assert.Equal(t, strings.Join(fk.From, ","), "title,slug")
+	assert.Equal(t, strings.Join(fk.To, ","), "title,slug")
+	fk = posts.ForeignKeys[1]
+	assert.Equal(t, fk.Table, "users")
+	assert.Equal(t, fk.OnDelete, "CASCADE")
+	assert.Equal(t, fk.OnUpdate, "NO ACTION")
+
+	view, ok := schema.View("user_names")
+	assert.True(t, ok)
+	assert.Equal(t, len(view.Columns), 2)
+	assert.Equal(t, view.Columns[1].Name, "name")
+
+	assert.Equal(t, len(schema.Triggers), 1)
+	assert.Equal(t, schema.Triggers[0].Table, "users")
+
+	// temp objects
+	schema, err = db.SchemaConfig(sqlite.SchemaConfig{Temp: true})
+	assert.Nil(t, err)
+	user, ok := schema.Table("sqlkite_user")
+	assert.True(t, ok)
+	assert.True(t, user.Temp)
+	assert.Equal(t, len(user.Columns), 2)
+}
 
-	assert.Equal(t, m["id"].(int), 99)
-	assert.Equal(t, m["cint"].(int), 2)
-	assert.Nil(t, m["cintn"])
-	assert.Equal(t, m["creal"].(float64), 3.3)
-	assert.Nil(t, m["crealn"])
-	assert.Equal(t, m["ctext"].(string), "four")
-	assert.Nil(t, m["ctextn"])
-	assert.Equal(t, string(m["cblob"].([]byte)), "five")
-	assert.Nil(t, m["cblobn"])
-	assert.Equal(t, m["ctime"].(int), int(now.Unix()))
-	assert.Nil(t, m["ctimen"])
+func Test_SchemaDiff(t *testing.T) {
+	expected := testDB()
+	defer expected.Close()
+	actual := testDB()
+	defer actual.Close()
+
+	diff := sqlite.SchemaDiff(expected, actual)
+	assert.Nil(t, diff.Error())
+	assert.False(t, diff.Changed())
+
+	mustExec(expected, `
+		create table users (id integer primary key, name text not null default(''), email text unique, check (length(name) < 100));
+		create index users_name on users(name);
+		create table posts (id integer primary key, user_id int not null references users(id), title text);
+		create trigger posts_insert after insert on posts begin select 1; end;
+		create view user_names as select id, name from users;
+	`)
+	mustExec(actual, `
+		create table users (id integer primary key,   name text, legacy int);
+		create index users_name on users(name desc);
+		create table old (id int);
+		create trigger users_insert after insert on users begin select 1; end;
+		create view user_names as select id from users;
+		insert into users (id, name, legacy) values (1, 'leto', 9);
+	`)
+
+	diff = sqlite.SchemaDiff(expected, actual)
+	assert.Nil(t, diff.Error())
+	assert.True(t, diff.Changed())
+
+	assert.Equal(t, len(diff.Tables), 3)
+	assert.Equal(t, diff.Tables[0].Name, "old")
+	assert.Equal(t, diff.Tables[0].Change, sqlite.DiffExtra)
+	assert.Equal(t, diff.Tables[1].Name, "posts")
+	assert.Equal(t, diff.Tables[1].Change, sqlite.DiffMissing)
+	users := diff.Tables[2]
+	assert.Equal(t, users.Change, sqlite.DiffChanged)
+	assert.Equal(t, len(users.Columns), 3)
+	assert.Equal(t, users.Columns[0].Name, "name")
+	assert.Equal(t, users.Columns[0].Change, sqlite.DiffChanged)
+	assert.Equal(t, users.Columns[1].Name, "email")
+	assert.Equal(t, users.Columns[1].Change, sqlite.DiffMissing)
+	assert.Equal(t, users.Columns[2].Name, "legacy")
+	assert.Equal(t, users.Columns[2].Change, sqlite.DiffExtra)
+
+	assert.Equal(t, len(diff.Indexes), 1)
+	assert.Equal(t, diff.Indexes[0].Change, sqlite.DiffChanged)
+	assert.Equal(t, len(diff.Triggers), 2)
+	assert.Equal(t, diff.Triggers[0].Name, "posts_insert")
+	assert.Equal(t, diff.Triggers[0].Change, sqlite.DiffMissing)
+	assert.Equal(t, diff.Triggers[1].Change, sqlite.DiffExtra)
+	assert.Equal(t, len(diff.Views), 1)
+	assert.Equal(t, diff.Views[0].Change, sqlite.DiffChanged)
+
+	// extra tables are only dropped when asked to
+	for _, sql := range diff.SQL() {
+		assert.False(t, strings.Contains(sql, `"old"`))
+	}
+
+	// applying the SQL brings actual in line with expected, keeping the data
+	for _, sql := range diff.SQLConfig(sqlite.DiffSQLConfig{DropExtraTables: true}) {
+		mustExec(actual, sql)
+	}
+	diff = sqlite.SchemaDiff(expected, actual)
+	assert.Nil(t, diff.Error())
+	assert.False(t, diff.Changed())
+	assert.Equal(t, len(diff.SQL()), 0)
+
+	var name string
+	assert.Nil(t, actual.Row("select name from users where id = 1").Scan(&name))
+	assert.Equal(t, name, "leto")
+
+	// formatting and the table's name quoting aren't changes
+	mustExec(expected, "create table formatting (id int, name text)")
+	mustExec(actual, "create table \"formatting\" (\n\tid int,\n\tname   text\n)")
+	diff = sqlite.SchemaDiff(expected, actual)
+	assert.Nil(t, diff.Error())
+	assert.False(t, diff.Changed())
+
+	// but whitespace within strings and quoted identifiers is
+	mustExec(expected, "create table quoted (name text default 'a  b', \"x  y\" int)")
+	mustExec(actual, "create table quoted (name text default 'a b', \"x  y\" int)")
+	diff = sqlite.SchemaDiff(expected, actual)
+	assert.Equal(t, len(diff.Tables), 1)
+	assert.Equal(t, diff.Tables[0].Name, "quoted")
+
+	// a rebuild leaves legacy_alter_table as it was
+	for _, on := range []bool{false, true} {
+		if on {
+			mustExec(actual, "pragma legacy_alter_table = on")
+		}
+		mustExec(actual, "drop table quoted")
+		mustExec(actual, "create table quoted (name text)")
+		for _, sql := range sqlite.SchemaDiff(expected, actual).SQL() {
+			mustExec(actual, sql)
+		}
+		var legacy bool
+		assert.Nil(t, actual.Row("pragma legacy_alter_table").Scan(&legacy))
+		assert.Equal(t, legacy, on)
+	}
+	assert.False(t, sqlite.SchemaDiff(expected, actual).Changed())
+
+	// names are case-insensitive
+	mustExec(expected, `
+		create table Mixed (id int, Name text not null);
+		create index Mixed_Name on Mixed(Name);
+		create trigger Mixed_Insert after insert on Mixed begin select 1; end;
+	`)
+	mustExec(actual, `
+		create table mixed (id int, name text);
+		create index mixed_name on mixed(Name);
+		create trigger mixed_insert after insert on mixed begin select 1; end;
+	`)
+	diff = sqlite.SchemaDiff(expected, actual)
+	assert.Equal(t, len(diff.Tables), 1)
+	assert.Equal(t, diff.Tables[0].Name, "Mixed")
+	assert.Equal(t, diff.Tables[0].Change, sqlite.DiffChanged)
+	assert.Equal(t, len(diff.Tables[0].Columns), 1)
+	assert.Equal(t, diff.Tables[0].Columns[0].Change, sqlite.DiffChanged)
+	assert.Equal(t, len(diff.Indexes), 1)
+	assert.Equal(t, diff.Indexes[0].Change, sqlite.DiffChanged)
+	assert.Equal(t, len(diff.Triggers), 1)
+	assert.Equal(t, diff.Triggers[0].Change, sqlite.DiffChanged)
+	for _, sql := range diff.SQL() {
+		mustExec(actual, sql)
+	}
+	assert.False(t, sqlite.SchemaDiff(expected, actual).Changed())
 }
 
-func Test_Escape(t *testing.T) {
-	assert.Equal(t, sqlite.EscapeLiteral(""), "''")
-	assert.Equal(t, sqlite.EscapeLiteral("over 9000"), "'over 9000'")
-	assert.Equal(t, sqlite.EscapeLiteral(`"over 9000"`), `'"over 9000"'`)
-	assert.Equal(t, sqlite.EscapeLiteral("it's over 9000"), "'it''s over 9000'")
+func Test_Dump_Restore(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	mustExec(db, `
+		create table users (id integer primary key autoincrement, name text not null, upper_name text as (upper(name)));
+		create index users_name on users(name);
+		create table notes (user_id int references users(id), body text, score real, data blob);
+		create trigger users_insert after insert on users begin select 1; end;
+		create view user_names as select name from users;
+		insert into users (name) values ('leto'), ('it''s; -- not a comment');
+		insert into notes values (2, 'a
+b', 1.0, x'00ff'), (1, null, 2.5, x''), (null, '', -3, null);
+		delete from users where id = 3;
+	`)
+	mustExec(db, "insert into users (name) values ('x')")
+	mustExec(db, "delete from users where name = 'x'")
+
+	var buf bytes.Buffer
+	assert.Nil(t, db.Dump(&buf, sqlite.DumpConfig{}))
+	dump := buf.String()
+	assert.StringContains(t, dump, "INSERT INTO \"notes\"(\"user_id\",\"body\",\"score\",\"data\") VALUES(2,'a\nb',1.0,X'00ff');\n")
+	assert.StringContains(t, dump, "VALUES(1,NULL,2.5,X'');\n")
+	assert.StringContains(t, dump, "VALUES(NULL,'',-3.0,NULL);\n")
+	assert.StringContains(t, dump, "VALUES(2,'it''s; -- not a comment');\n")
+	assert.StringContains(t, dump, "INSERT INTO sqlite_sequence(name,seq) VALUES('users',3);\n")
+
+	restored := testDB()
+	defer restored.Close()
+	mustExec(restored, "drop table test")
+	assert.Nil(t, sqlite.Restore(restored, strings.NewReader(dump)))
+
+	diff := sqlite.SchemaDiff(db, restored)
+	assert.Nil(t, diff.Error())
+	assert.False(t, diff.Changed())
+
+	var name, upper string
+	assert.Nil(t, restored.Row("select name, upper_name from users where id = 2").Scan(&name, &upper))
+	assert.Equal(t, name, "it's; -- not a comment")
+	assert.Equal(t, upper, "IT'S; -- NOT A COMMENT")
+	rows, err := restored.Maps("select * from notes order by rowid")
+	assert.Nil(t, err)
+	assert.Equal(t, len(rows), 3)
+	assert.Equal(t, rows[0]["body"].(string), "a\nb")
+	assert.Equal(t, rows[0]["score"].(float64), 1.0)
+	assert.Equal(t, rows[0]["data"].([]byte)[1], byte(255))
+	var tpe string
+	assert.Nil(t, restored.Row("select typeof(data) from notes where body is null").Scan(&tpe))
+	assert.Equal(t, tpe, "blob")
+	assert.Equal(t, rows[2]["score"].(float64), -3.0)
+
+	// the autoincrement counter is restored
+	mustExec(restored, "insert into users (name) values ('new')")
+	assert.Equal(t, restored.LastInsertRowID(), 4)
+
+	// filtered, schema only and data only
+	buf.Reset()
+	assert.Nil(t, db.Dump(&buf, sqlite.DumpConfig{Tables: []string{"users"}, SchemaOnly: true}))
+	assert.Equal(t, buf.String(), `CREATE TABLE users (id integer primary key autoincrement, name text not null, upper_name text as (upper(name)));
+CREATE INDEX users_name on users(name);
+CREATE TRIGGER users_insert after insert on users begin select 1; end;
+`)
+
+	buf.Reset()
+	assert.Nil(t, db.Dump(&buf, sqlite.DumpConfig{Tables: []string{"users"}, DataOnly: true}))
+	assert.Equal(t, buf.String(), `INSERT INTO "users"("id","name") VALUES(1,'leto');
+INSERT INTO "users"("id","name") VALUES(2,'it''s; -- not a comment');
+DELETE FROM sqlite_sequence WHERE name = 'users';
+INSERT INTO sqlite_sequence(name,seq) VALUES('users',3);
+`)
+
+	// a failing statement rolls everything back
+	restored = testDB()
+	defer restored.Close()
+	err = sqlite.Restore(restored, strings.NewReader("insert into test (id) values (1);\n  insert into invalid values (1);"))
+	scriptErr := err.(sqlite.ScriptError)
+	assert.Equal(t, scriptErr.Index, 1)
+	assert.Equal(t, scriptErr.Offset, 36)
+	var count int
+	assert.Nil(t, restored.Row("select count(*) from test").Scan(&count))
+	assert.Equal(t, count, 0)
+
+	// within a transaction, only the restored statements are rolled back
+	assert.Nil(t, restored.Transaction(func() error {
+		mustExec(restored, "insert into test (id) values (1)")
+		err := sqlite.Restore(restored, strings.NewReader("insert into test (id) values (2); insert into invalid values (1);"))
+		assert.Equal(t, err.(sqlite.ScriptError).Index, 1)
+		return sqlite.Restore(restored, strings.NewReader("insert into test (id) values (3);"))
+	}))
+	assert.Nil(t, restored.Row("select sum(id) from test").Scan(&count))
+	assert.Equal(t, count, 4)
 }
 
-func Test_IsUniqueErr(t *testing.T) {
+func Test_Dump_VirtualTables(t *testing.T) {
 	db := testDB()
 	defer db.Close()
 
-	assert.False(t, sqlite.IsUniqueErr(nil))
-	assert.False(t, sqlite.IsUniqueErr(sqlite.ErrNoRows))
+	mustExec(db, `
+		create virtual table docs using fts5(title, body);
+		insert into docs (title, body) values ('dune', 'the spice must flow'), ('messiah', 'no more spice');
+	`)
 
-	assert.Nil(t, db.Exec("insert into test (uniq) values (1)"))
-	assert.True(t, sqlite.IsUniqueErr(db.Exec("insert into test (uniq) values (1)")))
+	var buf bytes.Buffer
+	assert.Nil(t, db.Dump(&buf, sqlite.DumpConfig{}))
+	dump := buf.String()
+	assert.False(t, strings.Contains(dump, "docs_data"))
+	assert.False(t, strings.Contains(dump, "docs_content"))
+	assert.StringContains(t, dump, "INSERT INTO \"docs\"(\"title\",\"body\") VALUES('dune','the spice must flow');\n")
+
+	restored := testDB()
+	defer restored.Close()
+	mustExec(restored, "drop table test")
+	assert.Nil(t, sqlite.Restore(restored, strings.NewReader(dump)))
+	var title string
+	assert.Nil(t, restored.Row("select title from docs where docs match 'flow'").Scan(&title))
+	assert.Equal(t, title, "dune")
+
+	// within a transaction
+	buf.Reset()
+	assert.Nil(t, db.Transaction(func() error {
+		return db.Dump(&buf, sqlite.DumpConfig{Tables: []string{"docs"}, DataOnly: true})
+	}))
+	assert.Equal(t, strings.Count(buf.String(), "\n"), 2)
 }
 
-func Test_UniqueConstraintName(t *testing.T) {
+func Test_Dump_LargeValues(t *testing.T) {
 	db := testDB()
 	defer db.Close()
 
-	assert.Equal(t, sqlite.UniqueConstraintName(nil), "")
-	assert.Equal(t, sqlite.UniqueConstraintName(sqlite.ErrNoRows), "")
-
-	assert.Nil(t, db.Exec("insert into test (uniq) values (1)"))
-	assert.Equal(t, sqlite.UniqueConstraintName(db.Exec("insert into test (uniq) values (1)")), "test.uniq")
+	// rows whose INSERT is around, and well over, SQLITE_MAX_SQL_LENGTH
+	nearLimit := strings.Repeat("x", 4950)
+	large := strings.Repeat("it's, a ); test ", 2000)
+	blob := bytes.Repeat([]byte{0, 1, 2, 255}, 5000)
+	mustExec(db, "insert into test (id, ctext) values (1, ?1)", nearLimit)
+	mustExec(db, "insert into test (id, ctext, cblob, creal) values (2, ?1, ?2, ?3)", large, blob, math.Inf(-1))
+	// text with a NUL
+	mustExec(db, "insert into test (id, ctext) values (3, ?1)", "a\x00b")
+
+	var buf bytes.Buffer
+	assert.Nil(t, db.Dump(&buf, sqlite.DumpConfig{}))
+	assert.StringContains(t, buf.String(), "CAST(X'610062' AS TEXT)")
+
+	restored := testDB()
+	defer restored.Close()
+	mustExec(restored, "drop table test")
+	assert.Nil(t, sqlite.Restore(restored, &buf))
+
+	var text string
+	var data []byte
+	var inf float64
+	assert.Nil(t, restored.Row("select ctext from test where id = 1").Scan(&text))
+	assert.Equal(t, text, nearLimit)
+	assert.Nil(t, restored.Row("select ctext, cblob, creal from test where id = 2").Scan(&text, &data, &inf))
+	assert.Equal(t, text, large)
+	assert.True(t, bytes.Equal(data, blob))
+	assert.True(t, math.IsInf(inf, -1))
+	var length int
+	var tpe string
+	assert.Nil(t, restored.Row("select ctext, length(cast(ctext as blob)), typeof(ctext) from test where id = 3").Scan(&text, &length, &tpe))
+	assert.Equal(t, text, "a\x00b")
+	assert.Equal(t, length, 3)
+	assert.Equal(t, tpe, "text")
 }
 
-func Test_Sqlkite_User(t *testing.T) {
+func Test_CSV(t *testing.T) {
 	db := testDB()
 	defer db.Close()
-	createSqlkiteUser(db)
 
-	var user string
-	err := db.Row("select sqlkite_user_id()").Scan(&user)
+	input := "\ufeffid,name,score,note\n1,leto,9.5,\n2,\"ghanima, atreides\",10,\"multi\nline\"\n3,paul,,x\n"
+	count, err := db.ImportCSV("people", strings.NewReader(input), sqlite.CSVConfig{EmptyAsNull: true})
 	assert.Nil(t, err)
-	assert.Equal(t, user, "")
-
-	var role string
-	err = db.Row("select sqlkite_user_role()").Scan(&role)
+	assert.Equal(t, count, 3)
+
+	schema, _ := db.Schema()
+	people, _ := schema.Table("people")
+	assert.Equal(t, len(people.Columns), 4)
+	assert.Equal(t, people.Columns[0].Name, "id")
+	assert.Equal(t, people.Columns[0].Type, "INTEGER")
+	assert.Equal(t, people.Columns[1].Type, "TEXT")
+	assert.Equal(t, people.Columns[2].Type, "REAL")
+	assert.Equal(t, people.Columns[3].Type, "TEXT")
+
+	var score float64
+	var note *string
+	assert.Nil(t, db.Row("select score, note from people where id = 1").Scan(&score, &note))
+	assert.Equal(t, score, 9.5)
+	assert.Nil(t, note)
+
+	// appending, without a header
+	count, err = db.ImportCSV("people", strings.NewReader("4;chani;1;\n"), sqlite.CSVConfig{Comma: ';', NoHeader: true})
 	assert.Nil(t, err)
-	assert.Equal(t, role, "")
+	assert.Equal(t, count, 1)
+	assert.Nil(t, db.Row("select note from people where id = 4").Scan(&note))
+	assert.Equal(t, *note, "")
 
-	db.MustExec("insert into sqlkite_user (user_id, role) values ('teg', 'special')")
-
-	err = db.Row("select sqlkite_user_id()").Scan(&user)
+	// the table name is case-insensitive
+	count, err = db.ImportCSV("PEOPLE", strings.NewReader("5,stilgar,2,\n"), sqlite.CSVConfig{NoHeader: true})
 	assert.Nil(t, err)
-	assert.Equal(t, user, "teg")
+	assert.Equal(t, count, 1)
 
-	err = db.Row("select sqlkite_user_role()").Scan(&role)
+	// only canonical numbers are inferred as numbers
+	_, err = db.ImportCSV("codes", strings.NewReader("a,b,c,d,e,f\n007,+5,1.50, 5,1234567.5,-3\n010,5,2,6,1e+21,4\n"), sqlite.CSVConfig{})
 	assert.Nil(t, err)
-	assert.Equal(t, role, "special")
+	schema, _ = db.Schema()
+	codes, _ := schema.Table("codes")
+	assert.Equal(t, codes.Columns[0].Type, "TEXT")
+	assert.Equal(t, codes.Columns[1].Type, "TEXT")
+	assert.Equal(t, codes.Columns[2].Type, "TEXT")
+	assert.Equal(t, codes.Columns[3].Type, "TEXT")
+	assert.Equal(t, codes.Columns[4].Type, "REAL")
+	assert.Equal(t, codes.Columns[5].Type, "INTEGER")
+	var code, plus string
+	assert.Nil(t, db.Row("select a, b from codes where rowid = 1").Scan(&code, &plus))
+	assert.Equal(t, code, "007")
+	assert.Equal(t, plus, "+5")
+
+	var buf bytes.Buffer
+	assert.Nil(t, db.ExportCSV(&buf, "select id, name, score, note, x'6869' as b from people where id between ?1 and 4 order by id", 2))
+	assert.Equal(t, buf.String(), "id,name,score,note,b\n2,\"ghanima, atreides\",10,\"multi\nline\",hi\n3,paul,,x,hi\n4,chani,1,,hi\n")
+
+	// the header is written even without rows
+	buf.Reset()
+	assert.Nil(t, db.ExportCSV(&buf, "select id, name from people where id = 0"))
+	assert.Equal(t, buf.String(), "id,name\n")
+
+	// failures roll back and report the line
+	mustExec(db, "create table strict_people (id int not null, name text) strict")
+	_, err = db.ImportCSV("strict_people", strings.NewReader("id,name\n1,a\n2,b\n\"3\nx\",c\n"), sqlite.CSVConfig{})
+	csvErr, ok := err.(sqlite.CSVError)
+	assert.True(t, ok)
+	assert.Equal(t, csvErr.Line, 4)
+	assert.StringContains(t, err.Error(), "(line: 4)")
+	var n int
+	assert.Nil(t, db.Row("select count(*) from strict_people").Scan(&n))
+	assert.Equal(t, n, 0)
+
+	_, err = db.ImportCSV("created", strings.NewReader("a,b\n1,2\n3\n"), sqlite.CSVConfig{})
+	_, ok = err.(*csv.ParseError)
+	assert.True(t, ok)
+	schema, _ = db.Schema()
+	_, ok = schema.Table("created")
+	assert.False(t, ok)
+
+	// within a transaction
+	assert.Nil(t, db.Transaction(func() error {
+		count, err := db.ImportCSV("nested", strings.NewReader("a\n1\n2\n"), sqlite.CSVConfig{})
+		assert.Equal(t, count, 2)
+		return err
+	}))
+	assert.Nil(t, db.Row("select count(*) from nested").Scan(&n))
+	assert.Equal(t, n, 2)
 }
 
-func Test_Sqlkite_Assert_User_Arguments(t *testing.T) {
+func Test_WriteJSON(t *testing.T) {
 	db := testDB()
 	defer db.Close()
-	createSqlkiteUser(db)
 
-	err := db.Exec("select sqlkite_assert_user_id()")
-	assert.StringContains(t, err.Error(), "sqlite: wrong number of arguments to function sqlkite_assert_user_id()")
+	mustExec(db, `
+		insert into test (id, cint, creal, ctext, ctextn, cblob) values
+		(1, 10, 1.5, 'leto', '{"a":1}', x'68656c6c6f'),
+		(2, -3, 2, 'quote " back \ tab	nl
+ ctrl '||char(1)||' sep '||char(8232)||' é', null, x'')
+	`)
 
-	err = db.Exec("select sqlkite_assert_user_role()")
-	assert.StringContains(t, err.Error(), "sqlite: wrong number of arguments to function sqlkite_assert_user_role()")
+	var buf bytes.Buffer
+	assert.Nil(t, db.WriteJSON(&buf, "select id, cint as n, creal, ctext, ctextn, cblob, null as none from test order by id"))
+	assert.Equal(t, buf.String(), `[{"id":1,"n":10,"creal":1.5,"ctext":"leto","ctextn":"{\"a\":1}","cblob":"aGVsbG8=","none":null},`+
+		`{"id":2,"n":-3,"creal":2,"ctext":"quote \" back \\ tab\tnl\n ctrl \u0001 sep \u2028 é","ctextn":null,"cblob":"","none":null}]`)
 
-	err = db.Exec("select sqlkite_assert_user_id(32)")
-	assert.StringContains(t, err.Error(), "sqlkite_assert requires a text argument")
+	var decoded []map[string]any
+	assert.Nil(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, decoded[1]["ctext"].(string), "quote \" back \\ tab\tnl\n ctrl \x01 sep \u2028 é")
 
-	err = db.Exec("select sqlkite_assert_user_role(9000.1)")
-	assert.StringContains(t, err.Error(), "sqlkite_assert requires a text argument")
+	// raw columns and JSON1 results aren't escaped
+	buf.Reset()
+	assert.Nil(t, db.WriteJSONConfig(&buf, sqlite.JSONConfig{RawColumns: []string{"ctextn"}}, "select ctextn, json_object('id', id, 'tags', json_array('a', 'b')) as obj from test where id = ?1", 1))
+	assert.Equal(t, buf.String(), `[{"ctextn":{"a":1},"obj":{"id":1,"tags":["a","b"]}}]`)
+
+	// raw columns which aren't valid JSON are written as strings
+	buf.Reset()
+	assert.Nil(t, db.WriteJSONConfig(&buf, sqlite.JSONConfig{RawColumns: []string{"ctext"}}, "select ctext from test where id = ?1", 1))
+	assert.Equal(t, buf.String(), `[{"ctext":"leto"}]`)
+
+	buf.Reset()
+	assert.Nil(t, db.WriteJSONConfig(&buf, sqlite.JSONConfig{Format: sqlite.JSONLines}, "select id, ctext from test order by id"))
+	assert.Equal(t, buf.String(), "{\"id\":1,\"ctext\":\"leto\"}\n{\"id\":2,\"ctext\":\"quote \\\" back \\\\ tab\\tnl\\n ctrl \\u0001 sep \\u2028 é\"}\n")
+
+	buf.Reset()
+	assert.Nil(t, db.WriteJSONConfig(&buf, sqlite.JSONConfig{Format: sqlite.JSONArrays, Limit: 1}, "select id, cint from test order by id"))
+	assert.Equal(t, buf.String(), `[[1,10]]`)
+
+	buf.Reset()
+	assert.Nil(t, db.WriteJSONConfig(&buf, sqlite.JSONConfig{Format: sqlite.JSONArrays, Limit: -1}, "select id from test order by id"))
+	assert.Equal(t, buf.String(), `[[1],[2]]`)
+
+	buf.Reset()
+	assert.Nil(t, db.WriteJSON(&buf, "select id from test where id = 0"))
+	assert.Equal(t, buf.String(), `[]`)
+
+	_, isPrepareError := db.WriteJSON(&buf, "select invalid").(sqlite.PrepareError)
+	assert.True(t, isPrepareError)
 }
 
-func Test_Sqlkite_Assert_User_Id(t *testing.T) {
+func Test_BulkInsert(t *testing.T) {
 	db := testDB()
 	defer db.Close()
-	createSqlkiteUser(db)
 
-	db.MustExec("create table products (id integer not null, owner_id text not null)")
-	db.MustExec(`
-		create trigger sqlkite_row_control before insert on products for each row
-		begin
-			select sqlkite_assert_user_id(new.owner_id);
-		end
-	`)
+	rows := make([][]any, 1005)
+	for i := range rows {
+		rows[i] = []any{i + 1, i * 2, "row"}
+	}
 
-	assertIds := func(t *testing.T, expected ...int) {
-		t.Helper()
-		i := 0
-		rows := db.Rows("select id from products")
-		defer rows.Close()
-		for rows.Next() {
-			var id int
-			rows.Scan(&id)
-			assert.Equal(t, id, expected[i])
-			i += 1
-		}
-		if err := rows.Error(); err != nil {
-			panic(err)
+	var progress []int
+	inserted, err := db.BulkInsert("test", []string{"id", "cint", "ctext"}, sqlite.RowSlice(rows), sqlite.BulkConfig{
+		OnProgress: func(inserted int) { progress = append(progress, inserted) },
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, inserted, 1005)
+	// 66 rows (of 3 columns) per batch
+	assert.Equal(t, len(progress), 16)
+	assert.Equal(t, progress[0], 66)
+	assert.Equal(t, progress[15], 1005)
+
+	var count, sum int
+	assert.Nil(t, db.Row("select count(*), sum(cint) from test").Scan(&count, &sum))
+	assert.Equal(t, count, 1005)
+	assert.Equal(t, sum, 1005*1004)
+
+	// per-row errors, with the rows before the failing batch's transaction committed
+	mustExec(db, "delete from test")
+	rows = [][]any{{1, "a"}, {2, "b"}, {3, "c"}, {2, "dup"}, {5, "e"}}
+	inserted, err = db.BulkInsert("test", []string{"id", "ctext"}, sqlite.RowSlice(rows), sqlite.BulkConfig{BatchRows: 2, CommitEvery: 2})
+	assert.Equal(t, inserted, 2)
+	bulkErr := err.(sqlite.BulkError)
+	assert.Equal(t, bulkErr.Row, 3)
+	assert.True(t, sqlite.IsPrimaryKey(err))
+	assert.Nil(t, db.Row("select count(*) from test").Scan(&count))
+	assert.Equal(t, count, 2)
+
+	// skipping failed rows
+	mustExec(db, "delete from test")
+	var failed []int
+	rows = append(rows, []any{6})
+	inserted, err = db.BulkInsert("test", []string{"id", "ctext"}, sqlite.RowSlice(rows), sqlite.BulkConfig{
+		BatchRows: 2,
+		OnError: func(row int, values []any, err error) error {
+			failed = append(failed, row)
+			return nil
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, inserted, 4)
+	assert.Equal(t, len(failed), 2)
+	assert.Equal(t, failed[0], 3)
+	assert.Equal(t, failed[1], 5)
+
+	// conflict modes
+	rows = [][]any{{1, "new"}, {7, "g"}}
+	_, err = db.BulkInsert("test", []string{"id", "ctext"}, sqlite.RowSlice(rows), sqlite.BulkConfig{Conflict: sqlite.BulkIgnore})
+	assert.Nil(t, err)
+	var text string
+	assert.Nil(t, db.Row("select ctext from test where id = 1").Scan(&text))
+	assert.Equal(t, text, "a")
+
+	_, err = db.BulkInsert("test", []string{"id", "ctext"}, sqlite.RowSlice(rows), sqlite.BulkConfig{Conflict: sqlite.BulkUpsert, ConflictColumns: []string{"id"}})
+	assert.Nil(t, err)
+	assert.Nil(t, db.Row("select ctext from test where id = 1").Scan(&text))
+	assert.Equal(t, text, "new")
+
+	mustExec(db, "update test set cint = 9 where id = 1")
+	_, err = db.BulkInsert("test", []string{"id", "ctext"}, sqlite.RowSlice(rows), sqlite.BulkConfig{Conflict: sqlite.BulkReplace})
+	assert.Nil(t, err)
+	assert.Nil(t, db.Row("select cint from test where id = 1").Scan(&count))
+	assert.Equal(t, count, 0)
+
+	_, err = db.BulkInsert("test", []string{"id"}, sqlite.RowSlice(rows), sqlite.BulkConfig{Conflict: sqlite.BulkUpsert})
+	assert.Equal(t, err.Error(), "sqlite: bulk upsert requires conflict columns (code: 21)")
+
+	// within a transaction, a failure only rolls back the current savepoint
+	mustExec(db, "delete from test")
+	rows = [][]any{{1, "a"}, {2, "b"}, {3, "c"}, {2, "dup"}}
+	assert.Nil(t, db.Transaction(func() error {
+		inserted, err := db.BulkInsert("test", []string{"id", "ctext"}, sqlite.RowSlice(rows), sqlite.BulkConfig{BatchRows: 2, CommitEvery: 2})
+		assert.Equal(t, inserted, 2)
+		assert.Equal(t, err.(sqlite.BulkError).Row, 3)
+		return nil
+	}))
+	assert.Nil(t, db.Row("select count(*) from test").Scan(&count))
+	assert.Equal(t, count, 2)
+
+	err = db.Transaction(func() error {
+		_, err := db.BulkInsert("test", []string{"id", "ctext"}, sqlite.RowSlice([][]any{{8, "h"}, {9, "i"}}), sqlite.BulkConfig{})
+		assert.Nil(t, err)
+		return errors.New("rollback")
+	})
+	assert.Equal(t, err.Error(), "rollback")
+	assert.Nil(t, db.Row("select count(*) from test").Scan(&count))
+	assert.Equal(t, count, 2)
+}
+
+func Test_BulkInsert_RolledBack(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	mustExec(db, "create temp trigger test_rollback before insert on test when new.cint = 13 begin select raise(rollback, 'no 13'); end")
+
+	rows := make([][]any, 30)
+	for i := range rows {
+		rows[i] = []any{i + 1, i}
+	}
+
+	// OnError isn't given the chance to skip a row which rolled back the
+	// transaction, and the remaining rows aren't inserted outside of it
+	called := false
+	inserted, err := db.BulkInsert("test", []string{"id", "cint"}, sqlite.RowSlice(rows), sqlite.BulkConfig{
+		BatchRows:   5,
+		CommitEvery: 10,
+		OnError: func(row int, values []any, err error) error {
+			called = true
+			return nil
+		},
+	})
+	assert.Equal(t, inserted, 10)
+	assert.StringContains(t, err.Error(), "no 13")
+	assert.False(t, called)
+
+	var count int
+	assert.Nil(t, db.Row("select count(*) from test").Scan(&count))
+	assert.Equal(t, count, 10)
+
+	// a single row
+	mustExec(db, "delete from test")
+	inserted, err = db.BulkInsert("test", []string{"id", "cint"}, sqlite.RowSlice(rows[10:14]), sqlite.BulkConfig{BatchRows: 5})
+	assert.Equal(t, inserted, 0)
+	assert.Equal(t, err.(sqlite.BulkError).Row, 3)
+	assert.Nil(t, db.Row("select count(*) from test").Scan(&count))
+	assert.Equal(t, count, 0)
+}
+
+func Test_BulkInsert_Fail(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	mustExec(db, `
+		create table fails (n int);
+		create temp trigger fails_insert before insert on fails when new.n = 3 begin select raise(fail, 'no 3'); end;
+	`)
+
+	rows := make([][]any, 5)
+	for i := range rows {
+		rows[i] = []any{i + 1}
+	}
+
+	// the rows the failed batch inserted before the failing one aren't kept
+	// (and inserted again by the row by row retry)
+	var failed []int
+	inserted, err := db.BulkInsert("fails", []string{"n"}, sqlite.RowSlice(rows), sqlite.BulkConfig{
+		BatchRows: 5,
+		OnError: func(row int, values []any, err error) error {
+			failed = append(failed, row)
+			return nil
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, inserted, 4)
+	assert.Equal(t, len(failed), 1)
+	assert.Equal(t, failed[0], 2)
+
+	var count, sum int
+	assert.Nil(t, db.Row("select count(*), sum(n) from fails").Scan(&count, &sum))
+	assert.Equal(t, count, 4)
+	assert.Equal(t, sum, 12)
+}
+
+func Test_BulkInsert_SQLLength(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	// 4 columns would otherwise be 50 rows per batch, but with long column
+	// names (and the upsert's set clause), that doesn't fit in 5000 bytes
+	columns := make([]string, 4)
+	for i := range columns {
+		columns[i] = strings.Repeat("c", 449) + strconv.Itoa(i)
+	}
+	mustExec(db, "create table wide ("+strings.Join(columns, ",")+", primary key ("+columns[0]+"))")
+
+	rows := make([][]any, 100)
+	for i := range rows {
+		rows[i] = []any{i, 1, 2, 3}
+	}
+	var batches int
+	inserted, err := db.BulkInsert("wide", columns, sqlite.RowSlice(rows), sqlite.BulkConfig{
+		Conflict:        sqlite.BulkUpsert,
+		ConflictColumns: columns[:1],
+		OnProgress:      func(int) { batches += 1 },
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, inserted, 100)
+	assert.True(t, batches > 2)
+}
+
+func Test_SqliteList(t *testing.T) {
+	db := testDBConfig(sqlite.Config{StmtCacheSize: 2})
+	defer db.Close()
+
+	rows := make([][]any, 500)
+	for i := range rows {
+		rows[i] = []any{i + 1, i * 2, "t" + strconv.Itoa(i+1), float64(i) + 0.5}
+	}
+	_, err := db.BulkInsert("test", []string{"id", "cint", "ctext", "creal"}, sqlite.RowSlice(rows), sqlite.BulkConfig{})
+	assert.Nil(t, err)
+
+	sum := func(sql string, args ...any) int {
+		t.Helper()
+		var n int
+		assert.Nil(t, db.Row(sql, args...).Scan(&n))
+		return n
+	}
+
+	assert.Equal(t, sum("select coalesce(sum(id), 0) from test where id in sqlite_list(?1)", sqlite.List([]int{1, 3, 999})), 4)
+	assert.Equal(t, sum("select coalesce(sum(id), 0) from test where id in sqlite_list(?1)", sqlite.List([]int64{2, 4})), 6)
+	assert.Equal(t, sum("select coalesce(sum(id), 0) from test where ctext in (select value from sqlite_list(?1))", sqlite.List([]string{"t5", "t10", "", "nope"})), 15)
+	assert.Equal(t, sum("select coalesce(sum(id), 0) from test where creal in sqlite_list(?1)", sqlite.List([]float64{0.5, 2.5})), 4)
+
+	// empty lists
+	assert.Equal(t, sum("select count(*) from test where id in sqlite_list(?1)", sqlite.List([]int{})), 0)
+	assert.Equal(t, sum("select count(*) from test where id not in sqlite_list(?1)", sqlite.List([]string(nil))), 500)
+	assert.Equal(t, sum("select count(*) from sqlite_list()"), 0)
+
+	// more values than SQLITE_MAX_VARIABLE_NUMBER, with a single parameter
+	ids := make([]int, 450)
+	for i := range ids {
+		ids[i] = i + 1
+	}
+	assert.Equal(t, sum("select count(*) from test where id in sqlite_list(?1)", sqlite.List(ids)), 450)
+
+	// the same (cached) statement with lists of different lengths
+	for i := 1; i < 5; i++ {
+		assert.Equal(t, sum("select count(*) from test where id in sqlite_list(?1)", sqlite.List(ids[:i])), i)
+	}
+
+	// the list's values and types
+	var values []string
+	result := db.Rows("select value, typeof(value) from sqlite_list(?1) order by rowid", sqlite.List([]string{"a", "", "c"}))
+	for result.Next() {
+		var value, tpe string
+		result.Scan(&value, &tpe)
+		assert.Equal(t, tpe, "text")
+		values = append(values, value)
+	}
+	assert.Nil(t, result.Error())
+	result.Close()
+	assert.Equal(t, len(values), 3)
+	assert.Equal(t, values[1], "")
+	assert.Equal(t, values[2], "c")
+
+	// outside of sqlite_list, a list is NULL
+	var isNull bool
+	assert.Nil(t, db.Row("select ?1 is null", sqlite.List([]int{1})).Scan(&isNull))
+	assert.True(t, isNull)
+
+	// without List, slices aren't supported
+	err = db.Exec("select * from sqlite_list(?1)", []int{1})
+	assert.Equal(t, err.Error(), "sqlite: unsupported type []int (index: 0) (code: 21)")
+}
+
+func Test_Savepoint(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	var id1 int
+	var id2 int
+
+	db.Transaction(func() error {
+		mustExec(db, "insert into test (ctext) values (?)", "outer")
+		id1 = db.LastInsertRowID()
+
+		err := db.Savepoint(func() error {
+			mustExec(db, "insert into test (ctext) values (?)", "inner")
+			id2 = db.LastInsertRowID()
+			return errors.New("fail")
+		})
+		assert.Equal(t, err.Error(), "fail")
+		return nil
+	})
+
+	assert.Equal(t, queryId(db, id1).Text, "outer")
+	assert.Nil(t, queryId(db, id2))
+
+	assert.Nil(t, db.Savepoint(func() error {
+		mustExec(db, "insert into test (ctext) values (?)", "alone")
+		id1 = db.LastInsertRowID()
+		return nil
+	}))
+	assert.Equal(t, queryId(db, id1).Text, "alone")
+}
+
+func Test_Rows(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	mustExec(db, "delete from test")
+	mustExec(db, `
+		insert into test (cint, ctext)
+		values (?1, ?2), (?3, ?4)
+	`, 1, "two", 3, "four")
+	assert.Equal(t, db.Changes(), 2)
+
+	rows := db.RowsB([]byte("select cint, ctext from test"))
+	defer rows.Close()
+
+	results := make([][]any, 0, 2)
+	for rows.Next() {
+		var n int
+		var t string
+		if rows.Scan(&n, &t) != nil {
+			break
+		}
+		results = append(results, []any{n, t})
+	}
+	assert.Nil(t, rows.Error())
+	assert.Equal(t, len(results), 2)
+	assert.Equal(t, results[0][0].(int), 1)
+	assert.Equal(t, results[0][1].(string), "two")
+	assert.Equal(t, results[1][0].(int), 3)
+	assert.Equal(t, results[1][1].(string), "four")
+}
+
+func Test_Rows_QueryError(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	rows := db.RowsB([]byte("select invalid from test"))
+	defer rows.Close()
+
+	called := 0
+	for rows.Next() {
+		called += 1
+	}
+	assert.Equal(t, rows.Error().Error(), "sqlite: no such column: invalid (code: 1) - select invalid from test")
+	assert.Equal(t, called, 0)
+}
+
+func Test_PrepareError(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	sql := "select id,\n\t\tinvalid\nfrom test"
+	err := db.Exec(sql, 1, "two", nil)
+
+	var prepareErr sqlite.PrepareError
+	assert.True(t, errors.As(err, &prepareErr))
+	assert.Equal(t, prepareErr.SQL(), sql)
+	assert.Equal(t, prepareErr.Offset(), 13)
+	assert.Equal(t, prepareErr.Error(), "sqlite: no such column: invalid (code: 1) - "+sql)
+	assert.Equal(t, prepareErr.Pretty(), "sqlite: no such column: invalid (code: 1)\n2 | \t\tinvalid\n  | \t\t^")
+
+	typesDB := testDBConfig(sqlite.Config{PrepareErrorArgTypes: true})
+	defer typesDB.Close()
+	err = typesDB.Exec(sql, 1, "two", nil)
+	assert.True(t, errors.As(err, &prepareErr))
+	assert.Equal(t, prepareErr.Error(), "sqlite: no such column: invalid (code: 1) - "+sql+" [int, string, nil]")
+	assert.Equal(t, prepareErr.Pretty(), "sqlite: no such column: invalid (code: 1) [int, string, nil]\n2 | \t\tinvalid\n  | \t\t^")
+
+	// a syntax error at the start
+	err = db.Exec("selec ?1", 1)
+	assert.True(t, errors.As(err, &prepareErr))
+	assert.Equal(t, prepareErr.Offset(), 0)
+	assert.Equal(t, prepareErr.Pretty(), "sqlite: near \"selec\": syntax error (code: 1)\n1 | selec ?1\n  | ^")
+
+	// no offset
+	err = typesDB.Exec("select 1 from", 1)
+	assert.True(t, errors.As(err, &prepareErr))
+	assert.Equal(t, prepareErr.Offset(), -1)
+	assert.Equal(t, prepareErr.Pretty(), "sqlite: incomplete input (code: 1) [int]\nselect 1 from")
+
+	// the package-level default, for connections opened while it's set
+	sqlite.PrepareErrorArgTypes = true
+	defaultDB := testDB()
+	sqlite.PrepareErrorArgTypes = false
+	defer defaultDB.Close()
+	err = defaultDB.Exec("select 1 from", 1)
+	assert.True(t, errors.As(err, &prepareErr))
+	assert.Equal(t, prepareErr.Error(), "sqlite: incomplete input (code: 1) - select 1 from [int]")
+}
+
+func Test_Rows_ScanError(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	mustExec(db, "delete from test")
+	mustExec(db, `
+		insert into test (cint)
+		values (?1)
+	`, 33)
+
+	rows := db.Rows("select cint from test")
+	defer rows.Close()
+
+	called := 0
+	for rows.Next() {
+		called += 1
+		var c os.File
+		if rows.Scan(&c) == nil {
+			break
+		}
+	}
+	assert.Equal(t, called, 1)
+	assert.Equal(t, rows.Error().Error(), "sqlite: cannot scan into *os.File (index: 0) (code: 21)")
+}
+
+func Test_Row_Map(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	now := time.Now()
+
+	mustExec(db, `
+		insert into test (id, cint, creal, ctext, cblob, ctime)
+		values (?1, ?2, ?3, ?4, ?5, ?6)
+	`, 99, 2, 3.3, "four", []byte("five"), now)
+
+	m, err := db.Row("select * from test").Map()
+	assert.Nil(t, err)
+	assert.Equal(t, len(m), 12)
+
+	assert.Equal(t, m["id"].(int), 99)
+	assert.Equal(t, m["cint"].(int), 2)
+	assert.Nil(t, m["cintn"])
+	assert.Equal(t, m["creal"].(float64), 3.3)
+	assert.Nil(t, m["crealn"])
+	assert.Equal(t, m["ctext"].(string), "four")
+	assert.Nil(t, m["ctextn"])
+	assert.Equal(t, string(m["cblob"].([]byte)), "five")
+	assert.Nil(t, m["cblobn"])
+	assert.Equal(t, m["ctime"].(int), int(now.Unix()))
+	assert.Nil(t, m["ctimen"])
+}
+
+func Test_Time_Formats(t *testing.T) {
+	now := time.Date(2023, 2, 16, 6, 20, 55, 123456789, time.FixedZone("test", 3600))
+
+	tests := []struct {
+		format   sqlite.TimeFormat
+		expected time.Time
+	}{
+		{sqlite.TimeUnix, now.Truncate(time.Second)},
+		{sqlite.TimeUnixMilli, now.Truncate(time.Millisecond)},
+		{sqlite.TimeUnixMicro, now.Truncate(time.Microsecond)},
+		{sqlite.TimeUnixNano, now},
+		{sqlite.TimeText, now},
+		{sqlite.TimeJulianDay, now.Truncate(time.Millisecond)},
+	}
+
+	for _, test := range tests {
+		db := testDBConfig(sqlite.Config{TimeFormat: test.format})
+		mustExec(db, "insert into test (ctime, ctimen) values (?1, ?2)", now, &now)
+
+		row := queryLast(db)
+		assert.True(t, row.Time.Equal(test.expected))
+		assert.True(t, row.Timen.Equal(test.expected))
+		db.Close()
+	}
+}
+
+// UnixNano can only represent 1678-2262
+func Test_Time_Formats_OutOfNanoRange(t *testing.T) {
+	formats := []sqlite.TimeFormat{
+		sqlite.TimeUnix,
+		sqlite.TimeUnixMilli,
+		sqlite.TimeUnixMicro,
+		sqlite.TimeText,
+		sqlite.TimeJulianDay,
+	}
+
+	for _, year := range []int{1500, 3000} {
+		tm := time.Date(year, 7, 4, 12, 30, 15, 0, time.UTC)
+		for _, format := range formats {
+			db := testDBConfig(sqlite.Config{TimeFormat: format})
+			mustExec(db, "insert into test (ctime) values (?1)", tm)
+
+			row := queryLast(db)
+			assert.True(t, row.Time.Equal(tm))
+			db.Close()
+		}
+	}
+}
+
+func Test_Time_Text_Location(t *testing.T) {
+	db := testDBConfig(sqlite.Config{TimeFormat: sqlite.TimeText})
+	defer db.Close()
+
+	now := time.Date(2023, 2, 16, 6, 20, 55, 0, time.FixedZone("test", -7200))
+	mustExec(db, "insert into test (ctime) values (?)", now)
+
+	// stored in UTC, with a fixed width, so that the text sorts chronologically
+	var text string
+	var tm time.Time
+	assert.Nil(t, db.Row("select ctime, ctime from test").Scan(&text, &tm))
+	assert.Equal(t, text, "2023-02-16T08:20:55.000000000Z")
+	_, offset := tm.Zone()
+	assert.Equal(t, offset, 0)
+	assert.True(t, tm.Equal(now))
+
+	mustExec(db, "delete from test")
+	times := []time.Time{
+		now.Add(100 * time.Millisecond),
+		now,
+		now.Add(-time.Hour).In(time.FixedZone("east", 5*3600)),
+		now.Add(time.Nanosecond),
+	}
+	for _, tm := range times {
+		mustExec(db, "insert into test (ctime) values (?)", tm)
+	}
+	rows := db.Rows("select ctime from test order by ctime")
+	var sorted []time.Time
+	for rows.Next() {
+		var tm time.Time
+		assert.Nil(t, rows.Scan(&tm))
+		sorted = append(sorted, tm)
+	}
+	assert.Nil(t, rows.Error())
+	rows.Close()
+	assert.Equal(t, len(sorted), 4)
+	assert.True(t, sorted[0].Equal(times[2]))
+	assert.True(t, sorted[1].Equal(times[1]))
+	assert.True(t, sorted[2].Equal(times[3]))
+	assert.True(t, sorted[3].Equal(times[0]))
+}
+
+func Test_Time_UnixNano_Range(t *testing.T) {
+	db := testDBConfig(sqlite.Config{TimeFormat: sqlite.TimeUnixNano})
+	defer db.Close()
+
+	tm := time.Date(2300, 1, 1, 0, 0, 0, 0, time.UTC)
+	err := db.Exec("insert into test (ctime) values (?1)", tm)
+	var rangeErr sqlite.RangeError
+	assert.True(t, errors.As(err, &rangeErr))
+	assert.Equal(t, rangeErr.Index, 0)
+	assert.Equal(t, rangeErr.Type, "unix_nano")
+
+	err = db.Exec("insert into test (id, ctime) values (?1, ?2)", 1, &tm)
+	assert.True(t, errors.As(err, &rangeErr))
+	assert.Equal(t, rangeErr.Index, 1)
+}
+
+func Test_Time_Scan_Any(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	expected := time.Date(2023, 2, 16, 6, 20, 55, 0, time.UTC)
+	for _, sql := range []string{
+		"select datetime(1676528455, 'unixepoch')",
+		"select '2023-02-16T06:20:55Z'",
+		"select '2023-02-16 08:20:55+02:00'",
+		"select '2023-02-16 06:20:55.000'",
+		"select cast(julianday('2023-02-16 06:20:55') as text)",
+		"select 1676528455",
+		"select 1676528455.0",
+	} {
+		var tm time.Time
+		assert.Nil(t, db.Row(sql).Scan(&tm))
+		assert.True(t, tm.Equal(expected))
+	}
+
+	var tm time.Time
+	assert.Nil(t, db.Row("select '06:20'").Scan(&tm))
+	assert.True(t, tm.Equal(time.Date(2000, 1, 1, 6, 20, 0, 0, time.UTC)))
+
+	// reals are unix seconds when the format is one of the unix formats
+	assert.Nil(t, db.Row("select unixepoch('2023-02-16 06:20:55') + 0.5").Scan(&tm))
+	assert.True(t, tm.Equal(expected.Add(500*time.Millisecond)))
+
+	// otherwise, numbers are treated like SQLite's 'auto' modifier does
+	db2 := testDBConfig(sqlite.Config{TimeFormat: sqlite.TimeText})
+	defer db2.Close()
+	assert.Nil(t, db2.Row("select julianday('2023-02-16 06:20:55')").Scan(&tm))
+	assert.True(t, tm.Equal(expected))
+	assert.Nil(t, db2.Row("select 1676528455").Scan(&tm))
+	assert.True(t, tm.Equal(expected))
+
+	var tmn *time.Time
+	assert.Nil(t, db.Row("select date('now')").Scan(&tmn))
+	assert.Equal(t, tmn.Format("2006-01-02"), time.Now().UTC().Format("2006-01-02"))
+
+	err := db.Row("select 'nope'").Scan(&tm)
+	assert.Equal(t, err.Error(), `sqlite: invalid time "nope" (index: 0) (code: 20)`)
+}
+
+func Test_Time_Scan_Numbers_Configured(t *testing.T) {
+	db := testDBConfig(sqlite.Config{TimeFormat: sqlite.TimeUnixMilli})
+	defer db.Close()
+
+	var t1, t2 time.Time
+	assert.Nil(t, db.Row("select 1676528455123, 1676528455123.5").Scan(&t1, &t2))
+	assert.True(t, t1.Equal(time.UnixMilli(1676528455123)))
+	assert.True(t, t2.Equal(time.Unix(0, 1676528455123500000)))
+}
+
+func Test_JSON(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	type User struct {
+		Name  string   `json:"name"`
+		Power int      `json:"power"`
+		Tags  []string `json:"tags"`
+	}
+
+	leto := User{Name: "Leto", Power: 9001, Tags: []string{"god", "emperor"}}
+	mustExec(db, "insert into test (ctext) values (?)", sqlite.JSON[User]{Value: leto})
+
+	var text string
+	var user sqlite.JSON[User]
+	assert.Nil(t, db.Row("select ctext, ctext from test").Scan(&text, &user))
+	assert.Equal(t, text, `{"name":"Leto","power":9001,"tags":["god","emperor"]}`)
+	assert.Equal(t, user.Value.Name, "Leto")
+	assert.Equal(t, user.Value.Power, 9001)
+	assert.Equal(t, len(user.Value.Tags), 2)
+
+	// JSON1 understands it
+	var name string
+	assert.Nil(t, db.Row("select ctext ->> '$.name' from test").Scan(&name))
+	assert.Equal(t, name, "Leto")
+
+	// as a destination
+	var existing User
+	assert.Nil(t, db.Row("select json_object('name', 'Ghanima', 'power', 8000)").Scan(&sqlite.JSON[*User]{Value: &existing}))
+	assert.Equal(t, existing.Name, "Ghanima")
+	assert.Equal(t, existing.Power, 8000)
+
+	// null
+	var tags sqlite.JSON[[]string]
+	assert.Nil(t, db.Row("select null").Scan(&tags))
+	assert.True(t, tags.Value == nil)
+
+	// directly from the stmt
+	rows := db.Rows("select json_array(1, 2, 3), null, 'invalid'")
+	defer rows.Close()
+	assert.True(t, rows.Next())
+	var numbers []int
+	assert.Nil(t, rows.Stmt.ColumnJSON(0, &numbers))
+	assert.Equal(t, len(numbers), 3)
+	assert.Equal(t, numbers[2], 3)
+
+	numbers = nil
+	assert.Nil(t, rows.Stmt.ColumnJSON(1, &numbers))
+	assert.True(t, numbers == nil)
+
+	err := rows.Stmt.ColumnJSON(2, &numbers)
+	assert.StringContains(t, err.Error(), "json unmarshal invalid character")
+	assert.StringContains(t, err.Error(), "(index: 2)")
+
+	err = db.Exec("select ?", sqlite.JSON[func()]{Value: func() {}})
+	assert.StringContains(t, err.Error(), "json marshal json: unsupported type: func() (index: 0)")
+
+	var nilJSON *sqlite.JSON[[]int]
+	var isNull bool
+	assert.Nil(t, db.Row("select ?1 is null", nilJSON).Scan(&isNull))
+	assert.True(t, isNull)
+}
+
+func Test_Stmt_Value(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	rows := db.Rows("select null, 1, 2.5, 'three', x'04', zeroblob(0)")
+	defer rows.Close()
+	assert.True(t, rows.Next())
+
+	stmt := rows.Stmt
+	assert.Equal(t, stmt.ColumnCount(), 6)
+	assert.Nil(t, stmt.Value(0))
+	assert.Equal(t, stmt.Value(1).(int), 1)
+	assert.Equal(t, stmt.Value(2).(float64), 2.5)
+	assert.Equal(t, stmt.Value(3).(string), "three")
+	assert.Equal(t, stmt.Value(4).([]byte)[0], 4)
+	assert.Nil(t, stmt.Value(5))
+
+	values := make([]any, 6)
+	assert.Nil(t, rows.Values(values))
+	assert.Nil(t, values[0])
+	assert.Equal(t, values[1].(int), 1)
+	assert.Equal(t, values[3].(string), "three")
+
+	err := rows.Values(make([]any, 5))
+	assert.Equal(t, err.Error(), "sqlite: values needs 6 slots, got 5 (code: 21)")
+	assert.Equal(t, rows.Error().Error(), err.Error())
+}
+
+func Test_Rows_Map(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	mustExec(db, "insert into test (id, cint, ctext) values (1, 10, 'a'), (2, 20, 'b')")
+
+	rows := db.Rows("select id, cint, ctextn from test order by id")
+	defer rows.Close()
+
+	m := make(map[string]any, 3)
+	for i := 1; rows.Next(); i++ {
+		assert.Nil(t, rows.MapInto(m))
+		assert.Equal(t, len(m), 3)
+		assert.Equal(t, m["id"].(int), i)
+		assert.Equal(t, m["cint"].(int), i*10)
+		assert.Nil(t, m["ctextn"])
+	}
+	assert.Nil(t, rows.Error())
+
+	rows = db.Rows("select ctext from test where id = 2")
+	defer rows.Close()
+	assert.True(t, rows.Next())
+	m, err := rows.Map()
+	assert.Nil(t, err)
+	assert.Equal(t, m["ctext"].(string), "b")
+}
+
+func Test_Conn_Maps(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	maps, err := db.Maps("select * from test")
+	assert.Nil(t, err)
+	assert.Equal(t, len(maps), 0)
+
+	mustExec(db, "insert into test (id, creal) values (1, 1.5), (2, 2.5), (3, 3.5)")
+	maps, err = db.Maps("select id, creal from test where id > ? order by id", 1)
+	assert.Nil(t, err)
+	assert.Equal(t, len(maps), 2)
+	assert.Equal(t, maps[0]["id"].(int), 2)
+	assert.Equal(t, maps[0]["creal"].(float64), 2.5)
+	assert.Equal(t, maps[1]["id"].(int), 3)
+	assert.Equal(t, maps[1]["creal"].(float64), 3.5)
+
+	_, err = db.Maps("select nope from test")
+	assert.StringContains(t, err.Error(), "no such column: nope")
+}
+
+func Test_Escape(t *testing.T) {
+	assert.Equal(t, sqlite.EscapeLiteral(""), "''")
+	assert.Equal(t, sqlite.EscapeLiteral("over 9000"), "'over 9000'")
+	assert.Equal(t, sqlite.EscapeLiteral(`"over 9000"`), `'"over 9000"'`)
+	assert.Equal(t, sqlite.EscapeLiteral("it's over 9000"), "'it''s over 9000'")
+}
+
+func Test_IsUniqueErr(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	assert.False(t, sqlite.IsUniqueErr(nil))
+	assert.False(t, sqlite.IsUniqueErr(sqlite.ErrNoRows))
+
+	assert.Nil(t, db.Exec("insert into test (uniq) values (1)"))
+	assert.True(t, sqlite.IsUniqueErr(db.Exec("insert into test (uniq) values (1)")))
+}
+
+func Test_UniqueConstraintName(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	assert.Equal(t, sqlite.UniqueConstraintName(nil), "")
+	assert.Equal(t, sqlite.UniqueConstraintName(sqlite.ErrNoRows), "")
+
+	assert.Nil(t, db.Exec("insert into test (uniq) values (1)"))
+	assert.Equal(t, sqlite.UniqueConstraintName(db.Exec("insert into test (uniq) values (1)")), "test.uniq")
+}
+
+func Test_Error_Primary(t *testing.T) {
+	err := sqlite.Error{Code: sqlite.CodeBusySnapshot}
+	assert.Equal(t, err.Primary(), sqlite.CodeBusy)
+	assert.True(t, sqlite.IsBusy(err))
+	assert.False(t, sqlite.IsLocked(err))
+
+	assert.True(t, sqlite.IsLocked(sqlite.Error{Code: sqlite.CodeLockedSharedCache}))
+	assert.True(t, sqlite.IsReadOnly(sqlite.Error{Code: sqlite.CodeReadOnly}))
+	assert.True(t, sqlite.IsCorrupt(sqlite.Error{Code: sqlite.CodeCorruptIndex}))
+	assert.True(t, sqlite.IsFull(sqlite.Error{Code: sqlite.CodeFull}))
+	assert.False(t, sqlite.IsFull(nil))
+}
+
+func Test_ConstraintInfo(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	db.MustExec("pragma foreign_keys = on")
+	db.MustExec(`create table things (
+		name text primary key,
+		a int,
+		b int,
+		c int not null default(0),
+		d int check (d > 0),
+		e int constraint e_positive check (e > 0),
+		p text references things(name),
+		unique (a, b)
+	)`)
+	db.MustExec("insert into things (name, a, b) values ('leto', 1, 2)")
+
+	_, ok := sqlite.ConstraintInfo(nil)
+	assert.False(t, ok)
+	_, ok = sqlite.ConstraintInfo(sqlite.ErrNoRows)
+	assert.False(t, ok)
+
+	err := db.Exec("insert into things (name, a, b) values ('ghanima', 1, 2)")
+	assert.True(t, sqlite.IsConstraint(err))
+	assert.True(t, sqlite.IsUniqueErr(err))
+	info, ok := sqlite.ConstraintInfo(err)
+	assert.True(t, ok)
+	assert.Equal(t, info.Code, sqlite.CodeConstraintUnique)
+	assert.Equal(t, info.Table, "things")
+	assert.Equal(t, len(info.Columns), 2)
+	assert.Equal(t, info.Columns[0], "a")
+	assert.Equal(t, info.Columns[1], "b")
+	assert.Equal(t, sqlite.UniqueConstraintName(err), "things.a, things.b")
+
+	err = db.Exec("insert into things (name) values ('leto')")
+	assert.True(t, sqlite.IsPrimaryKey(err))
+	assert.False(t, sqlite.IsUniqueErr(err))
+	info, _ = sqlite.ConstraintInfo(err)
+	assert.Equal(t, info.Code, sqlite.CodeConstraintPrimaryKey)
+	assert.Equal(t, info.Table, "things")
+	assert.Equal(t, info.Columns[0], "name")
+
+	db.MustExec("create unique index things_lower_name on things(lower(name))")
+	err = db.Exec("insert into things (name) values ('LETO')")
+	info, _ = sqlite.ConstraintInfo(err)
+	assert.Equal(t, info.Code, sqlite.CodeConstraintUnique)
+	assert.Equal(t, info.Name, "things_lower_name")
+	assert.Equal(t, info.Table, "")
+
+	err = db.Exec("insert into things (name, c) values ('paul', null)")
+	assert.True(t, sqlite.IsNotNull(err))
+	info, _ = sqlite.ConstraintInfo(err)
+	assert.Equal(t, info.Table, "things")
+	assert.Equal(t, info.Columns[0], "c")
+
+	err = db.Exec("insert into things (name, d) values ('paul', 0)")
+	assert.True(t, sqlite.IsCheck(err))
+	info, _ = sqlite.ConstraintInfo(err)
+	assert.Equal(t, info.Name, "d > 0")
+
+	err = db.Exec("insert into things (name, e) values ('paul', 0)")
+	info, _ = sqlite.ConstraintInfo(err)
+	assert.Equal(t, info.Name, "e_positive")
+
+	err = db.Exec("insert into things (name, p) values ('paul', 'nope')")
+	assert.True(t, sqlite.IsForeignKey(err))
+	info, ok = sqlite.ConstraintInfo(err)
+	assert.True(t, ok)
+	assert.Equal(t, info.Code, sqlite.CodeConstraintForeignKey)
+	assert.Equal(t, len(info.Columns), 0)
+
+	// names aren't quoted in the message, a column with a dot is still split
+	// from its table
+	db.MustExec(`create table dotted ("a.b" int unique, "c.d" int not null default(0))`)
+	db.MustExec(`insert into dotted ("a.b") values (1)`)
+	err = db.Exec(`insert into dotted ("a.b") values (1)`)
+	info, _ = sqlite.ConstraintInfo(err)
+	assert.Equal(t, info.Table, "dotted")
+	assert.Equal(t, len(info.Columns), 1)
+	assert.Equal(t, info.Columns[0], "a.b")
+
+	err = db.Exec(`insert into dotted ("a.b", "c.d") values (2, null)`)
+	info, _ = sqlite.ConstraintInfo(err)
+	assert.Equal(t, info.Code, sqlite.CodeConstraintNotNull)
+	assert.Equal(t, info.Table, "dotted")
+	assert.Equal(t, info.Columns[0], "c.d")
+}
+
+func Test_Sqlkite_User(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	createSqlkiteUser(db)
+
+	var user string
+	err := db.Row("select sqlkite_user_id()").Scan(&user)
+	assert.Nil(t, err)
+	assert.Equal(t, user, "")
+
+	var role string
+	err = db.Row("select sqlkite_user_role()").Scan(&role)
+	assert.Nil(t, err)
+	assert.Equal(t, role, "")
+
+	db.MustExec("insert into sqlkite_user (user_id, role) values ('teg', 'special')")
+
+	err = db.Row("select sqlkite_user_id()").Scan(&user)
+	assert.Nil(t, err)
+	assert.Equal(t, user, "teg")
+
+	err = db.Row("select sqlkite_user_role()").Scan(&role)
+	assert.Nil(t, err)
+	assert.Equal(t, role, "special")
+}
+
+func Test_Sqlkite_Assert_User_Arguments(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	createSqlkiteUser(db)
+
+	err := db.Exec("select sqlkite_assert_user_id()")
+	assert.StringContains(t, err.Error(), "sqlite: wrong number of arguments to function sqlkite_assert_user_id()")
+
+	err = db.Exec("select sqlkite_assert_user_role()")
+	assert.StringContains(t, err.Error(), "sqlite: wrong number of arguments to function sqlkite_assert_user_role()")
+
+	err = db.Exec("select sqlkite_assert_user_id(32)")
+	assert.StringContains(t, err.Error(), "sqlkite_assert requires a text argument")
+
+	err = db.Exec("select sqlkite_assert_user_role(9000.1)")
+	assert.StringContains(t, err.Error(), "sqlkite_assert requires a text argument")
+
+	err = db.Exec("select sqlkite_assert_user_id(null)")
+	assert.StringContains(t, err.Error(), "sqlkite_assert requires a text argument")
+
+	err = db.Exec("select sqlkite_assert_user_id_exact(x'01')")
+	assert.StringContains(t, err.Error(), "sqlkite_assert requires a text argument")
+
+	err = db.Exec("select sqlkite_assert_user_role_in()")
+	assert.StringContains(t, err.Error(), "sqlkite_assert requires a text argument")
+
+	err = db.Exec("select sqlkite_assert_user_role_in('admin', 1)")
+	assert.StringContains(t, err.Error(), "sqlkite_assert requires a text argument")
+
+	err = db.Exec("select sqlkite_assert_user_role_at_least(1)")
+	assert.StringContains(t, err.Error(), "sqlkite_assert requires a text argument")
+}
+
+func Test_Sqlkite_Assert_User_Id(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	createSqlkiteUser(db)
+
+	db.MustExec("create table products (id integer not null, owner_id text not null)")
+	db.MustExec(`
+		create trigger sqlkite_row_control before insert on products for each row
+		begin
+			select sqlkite_assert_user_id(new.owner_id);
+		end
+	`)
+
+	assertIds := func(t *testing.T, expected ...int) {
+		t.Helper()
+		i := 0
+		rows := db.Rows("select id from products")
+		defer rows.Close()
+		for rows.Next() {
+			var id int
+			rows.Scan(&id)
+			assert.Equal(t, id, expected[i])
+			i += 1
+		}
+		if err := rows.Error(); err != nil {
+			panic(err)
 		}
 	}
 
@@ -561,8 +2346,610 @@ func Test_Sqlkite_Assert_User_Role(t *testing.T) {
 	assertIds(t, 1)
 }
 
+func Test_Sqlkite_SetUser(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	// no temp table needed
+	assert.Nil(t, db.SetUser("teg", "admin"))
+
+	var user, role string
+	assert.Nil(t, db.Row("select sqlkite_user_id(), sqlkite_user_role()").Scan(&user, &role))
+	assert.Equal(t, user, "teg")
+	assert.Equal(t, role, "admin")
+	assert.Nil(t, db.Exec("select sqlkite_assert_user_id('teg'), sqlkite_assert_user_role('admin')"))
+	assert.StringContains(t, db.Exec("select sqlkite_assert_user_id('leto')").Error(), "sqlkite_row_access")
+
+	// a copy of the conn shares the user
+	copy := db
+	assert.Nil(t, copy.SetUser("ghanima", ""))
+	assert.Nil(t, db.Row("select sqlkite_user_id(), sqlkite_user_role()").Scan(&user, &role))
+	assert.Equal(t, user, "ghanima")
+	assert.Equal(t, role, "")
+	assert.StringContains(t, db.Exec("select sqlkite_assert_user_role('')").Error(), "sqlkite_row_access")
+
+	// falls back to the temp table once cleared
+	db.ClearUser()
+	assert.StringContains(t, db.Exec("select sqlkite_user_id()").Error(), "no such table: sqlkite_user")
+
+	createSqlkiteUser(db)
+	db.MustExec("insert into sqlkite_user (user_id, role) values ('leto', 'god')")
+	assert.Nil(t, db.Row("select sqlkite_user_id(), sqlkite_user_role()").Scan(&user, &role))
+	assert.Equal(t, user, "leto")
+	assert.Equal(t, role, "god")
+
+	// and SetUser takes precedence over the temp table
+	assert.Nil(t, db.SetUser("paul", "duke"))
+	assert.Nil(t, db.Row("select sqlkite_user_id()").Scan(&user))
+	assert.Equal(t, user, "paul")
+}
+
+func Test_Sqlkite_Assert_Exact(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	assert.Nil(t, db.SetUser("aGVsbG8=", "Admin"))
+	assert.Nil(t, db.Exec("select sqlkite_assert_user_id('AGVSBG8=')"))
+	assert.Nil(t, db.Exec("select sqlkite_assert_user_id_exact('aGVsbG8=')"))
+	assert.StringContains(t, db.Exec("select sqlkite_assert_user_id_exact('AGVSBG8=')").Error(), "sqlkite_row_access")
+	assert.StringContains(t, db.Exec("select sqlkite_assert_user_id_exact('aGVsbG8')").Error(), "sqlkite_row_access")
+	assert.StringContains(t, db.Exec("select sqlkite_assert_user_id_exact(null)").Error(), "sqlkite_assert requires a text argument")
+
+	assert.Nil(t, db.Exec("select sqlkite_assert_user_role('admin')"))
+	assert.Nil(t, db.Exec("select sqlkite_assert_user_role_exact('Admin')"))
+	assert.StringContains(t, db.Exec("select sqlkite_assert_user_role_exact('admin')").Error(), "sqlkite_row_access")
+
+	db.ClearUser()
+	assert.StringContains(t, db.Exec("select sqlkite_assert_user_id_exact('aGVsbG8=')").Error(), "sqlkite_row_access")
+}
+
+func Test_Sqlkite_Assert_Role_In(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	assert.StringContains(t, db.Exec("select sqlkite_assert_user_role_in('admin')").Error(), "sqlkite_row_access")
+
+	assert.Nil(t, db.SetUser("teg", "Editor"))
+	assert.Nil(t, db.Exec("select sqlkite_assert_user_role_in('editor')"))
+	assert.Nil(t, db.Exec("select sqlkite_assert_user_role_in('admin', 'editor')"))
+	assert.Nil(t, db.Exec("select sqlkite_assert_user_role_in('admin', 'EDITOR')"))
+	assert.StringContains(t, db.Exec("select sqlkite_assert_user_role_in('admin', 'viewer')").Error(), "sqlkite_row_access")
+	assert.StringContains(t, db.Exec("select sqlkite_assert_user_role_in(null)").Error(), "sqlkite_assert requires a text argument")
+	assert.StringContains(t, db.Exec("select sqlkite_assert_user_role_in('editor', null)").Error(), "sqlkite_assert requires a text argument")
+}
+
+func Test_Sqlkite_Role_Hierarchy(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	assert.Nil(t, db.SetUser("teg", "editor"))
+
+	// no hierarchy, every role is unknown
+	assert.StringContains(t, db.Exec("select sqlkite_assert_user_role_at_least('editor')").Error(), "sqlkite_assert_user_role_at_least unknown role: editor")
+
+	assert.Nil(t, db.SetRoleHierarchy("admin", "Editor", "viewer"))
+
+	atLeast := func(role string) bool {
+		var ok bool
+		assert.Nil(t, db.Row("select sqlkite_user_role_at_least(?1)", role).Scan(&ok))
+		return ok
+	}
+
+	assert.False(t, atLeast("admin"))
+	assert.True(t, atLeast("editor"))
+	assert.True(t, atLeast("VIEWER"))
+	assert.StringContains(t, db.Exec("select sqlkite_assert_user_role_at_least('admin')").Error(), "sqlkite_row_access")
+	assert.Nil(t, db.Exec("select sqlkite_assert_user_role_at_least('editor')"))
+	assert.Nil(t, db.Exec("select sqlkite_assert_user_role_at_least('viewer')"))
+	assert.StringContains(t, db.Exec("select sqlkite_user_role_at_least('owner')").Error(), "sqlkite_user_role_at_least unknown role: owner")
+
+	assert.Nil(t, db.SetUser("leto", "Admin"))
+	assert.True(t, atLeast("admin"))
+	assert.True(t, atLeast("viewer"))
+
+	// a role outside the hierarchy is never enough
+	assert.Nil(t, db.SetUser("paul", "guest"))
+	assert.False(t, atLeast("viewer"))
+
+	assert.Nil(t, db.SetUser("paul", ""))
+	assert.False(t, atLeast("viewer"))
+
+	// without a user (or the sqlkite_user table) the check fails, but the
+	// assert is only ever a denial
+	db.ClearUser()
+	assert.StringContains(t, db.Exec("select sqlkite_user_role_at_least('viewer')").Error(), "no such table: sqlkite_user")
+	assert.StringContains(t, db.Exec("select sqlkite_assert_user_role_at_least('viewer')").Error(), "sqlkite_row_access")
+
+	assert.Equal(t, db.SetRoleHierarchy("admin", "editor", "ADMIN").Error(), "sqlite: duplicate role in hierarchy: ADMIN (code: 21)")
+
+	assert.Nil(t, db.SetRoleHierarchy())
+	assert.StringContains(t, db.Exec("select sqlkite_assert_user_role_at_least('viewer')").Error(), "unknown role: viewer")
+}
+
+func Test_Sqlkite_WithUser(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+	createSqlkiteUser(db)
+
+	var user *string
+	err := db.WithUser("teg", "admin", func() error {
+		return db.Row("select sqlkite_user_id()").Scan(&user)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, *user, "teg")
+
+	user = nil
+	assert.Nil(t, db.Row("select sqlkite_user_id()").Scan(&user))
+	assert.True(t, user == nil)
+
+	err = db.WithUser("teg", "admin", func() error {
+		return errors.New("fail")
+	})
+	assert.Equal(t, err.Error(), "fail")
+
+	func() {
+		defer func() { recover() }()
+		db.WithUser("teg", "admin", func() error {
+			panic("boom")
+		})
+	}()
+	user = nil
+	assert.Nil(t, db.Row("select sqlkite_user_id()").Scan(&user))
+	assert.True(t, user == nil)
+
+	// nested calls restore the outer user
+	var role string
+	err = db.WithUser("leto", "admin", func() error {
+		if err := db.WithUser("paul", "viewer", func() error { return nil }); err != nil {
+			return err
+		}
+		return db.Row("select sqlkite_user_id(), sqlkite_user_role()").Scan(&user, &role)
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, *user, "leto")
+	assert.Equal(t, role, "admin")
+
+	assert.Nil(t, db.SetUser("ghanima", ""))
+	func() {
+		defer func() { recover() }()
+		db.WithUser("teg", "admin", func() error {
+			panic("boom")
+		})
+	}()
+	assert.Nil(t, db.Row("select sqlkite_user_id(), sqlkite_user_role()").Scan(&user, &role))
+	assert.Equal(t, *user, "ghanima")
+	assert.Equal(t, role, "")
+}
+
+func Test_Sqlkite_Claims(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	var team *int
+	assert.Nil(t, db.Row("select sqlkite_claim('team_id')").Scan(&team))
+	assert.True(t, team == nil)
+
+	assert.Nil(t, db.SetClaims(map[string]any{
+		"team_id": 33,
+		"plan":    "pro",
+		"ratio":   0.5,
+		"active":  true,
+		"none":    nil,
+		"scopes":  []string{"billing:read", "billing:write"},
+	}))
+
+	m, err := db.Row(`select
+		sqlkite_claim('team_id') as team_id,
+		sqlkite_claim('plan') as plan,
+		sqlkite_claim('ratio') as ratio,
+		sqlkite_claim('active') as active,
+		sqlkite_claim('none') as none,
+		sqlkite_claim('nope') as nope,
+		sqlkite_claim('scopes') as scopes,
+		json_array(sqlkite_claim('scopes')) as nested
+	`).Map()
+	assert.Nil(t, err)
+	assert.Equal(t, m["team_id"].(int), 33)
+	assert.Equal(t, m["plan"].(string), "pro")
+	assert.Equal(t, m["ratio"].(float64), 0.5)
+	assert.Equal(t, m["active"].(int), 1)
+	assert.Nil(t, m["none"])
+	assert.Nil(t, m["nope"])
+	assert.Equal(t, m["scopes"].(string), `["billing:read","billing:write"]`)
+	assert.Equal(t, m["nested"].(string), `[["billing:read","billing:write"]]`)
+
+	var has1, has2, has3 bool
+	assert.Nil(t, db.Row("select sqlkite_has_scope('billing:write'), sqlkite_has_scope('billing'), sqlkite_has_scope('admin')").Scan(&has1, &has2, &has3))
+	assert.True(t, has1)
+	assert.False(t, has2)
+	assert.False(t, has3)
+
+	// space separated scopes
+	assert.Nil(t, db.SetClaims(map[string]any{"scopes": "read write"}))
+	assert.Nil(t, db.Row("select sqlkite_has_scope('write'), sqlkite_has_scope('rea'), sqlkite_claim('team_id') is null").Scan(&has1, &has2, &has3))
+	assert.True(t, has1)
+	assert.False(t, has2)
+	assert.True(t, has3)
+
+	err = db.SetClaims(map[string]any{"a": 1, "b": struct{}{}})
+	assert.Equal(t, err.Error(), "sqlite: unsupported claim type struct {} (claim: b) (code: 21)")
+	assert.Nil(t, db.Row("select sqlkite_claim('a') is null").Scan(&has1))
+	assert.True(t, has1)
+
+	err = db.Exec("select sqlkite_has_scope(1)")
+	assert.StringContains(t, err.Error(), "sqlkite_has_scope requires a text argument")
+}
+
+func Test_Sqlkite_Assert_Claim(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	db.MustExec("create table docs (id integer not null, team_id int, team_text text, plan text)")
+	db.MustExec(`
+		create trigger sqlkite_row_control before insert on docs for each row
+		begin
+			select sqlkite_assert_claim('team_id', new.team_id);
+			select sqlkite_assert_claim('team_id', new.team_text);
+			select sqlkite_assert_claim('plan', new.plan);
+		end
+	`)
+
+	err := db.Exec("insert into docs values (1, 33, '33', 'pro')")
+	assert.StringContains(t, err.Error(), "sqlkite_row_access")
+
+	assert.Nil(t, db.SetClaims(map[string]any{"team_id": 33, "plan": "pro"}))
+	assert.Nil(t, db.Exec("insert into docs values (1, 33, '33', 'pro')"))
+
+	assert.StringContains(t, db.Exec("insert into docs values (2, 34, '33', 'pro')").Error(), "sqlkite_row_access")
+	assert.StringContains(t, db.Exec("insert into docs values (2, 33, '34', 'pro')").Error(), "sqlkite_row_access")
+	assert.StringContains(t, db.Exec("insert into docs values (2, 33, '33', 'Pro')").Error(), "sqlkite_row_access")
+	assert.StringContains(t, db.Exec("insert into docs values (2, null, '33', 'pro')").Error(), "sqlkite_row_access")
+
+	db.ClearClaims()
+	assert.StringContains(t, db.Exec("insert into docs values (1, 33, '33', 'pro')").Error(), "sqlkite_row_access")
+
+	err = db.Exec("select sqlkite_assert_claim(1, 1)")
+	assert.StringContains(t, err.Error(), "sqlkite_assert_claim requires a text claim name")
+}
+
+func Test_Sqlkite_AccessDeniedError(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	denied := func(t *testing.T, err error) sqlite.AccessDeniedError {
+		t.Helper()
+		assert.True(t, errors.Is(err, sqlite.ErrRowAccess))
+
+		var sqliteErr sqlite.Error
+		assert.True(t, errors.As(err, &sqliteErr))
+		assert.StringContains(t, sqliteErr.Message, "sqlkite_row_access")
+
+		var accessErr sqlite.AccessDeniedError
+		assert.True(t, errors.As(err, &accessErr))
+		return accessErr
+	}
+
+	// not within a trigger
+	err := denied(t, db.Exec("select sqlkite_assert_user_id('teg')"))
+	assert.Equal(t, err.Assertion, "sqlkite_assert_user_id")
+	assert.Equal(t, err.Expected, "text")
+	assert.Equal(t, err.Actual, "none")
+	assert.Equal(t, err.Table, "")
+	assert.Equal(t, err.Trigger, "")
+
+	assert.Nil(t, db.SetUser("teg", "editor"))
+	assert.Nil(t, db.SetClaims(map[string]any{"team_id": "2", "scopes": []string{"read"}}))
+
+	err = denied(t, db.Exec("select sqlkite_assert_user_role_in('admin', 'viewer')"))
+	assert.Equal(t, err.Assertion, "sqlkite_assert_user_role_in")
+	assert.Equal(t, err.Expected, "text")
+	assert.Equal(t, err.Actual, "text")
+
+	err = denied(t, db.Exec("select sqlkite_assert_claim('team_id', 3)"))
+	assert.Equal(t, err.Assertion, "sqlkite_assert_claim")
+	assert.Equal(t, err.Expected, "integer")
+	assert.Equal(t, err.Actual, "text")
+
+	err = denied(t, db.Exec("select sqlkite_assert_claim('scopes', 'read')"))
+	assert.Equal(t, err.Actual, "list")
+
+	err = denied(t, db.Exec("select sqlkite_assert_claim('other', null)"))
+	assert.Equal(t, err.Expected, "null")
+	assert.Equal(t, err.Actual, "missing")
+
+	err = denied(t, db.Exec("select sqlkite_assert(null)"))
+	assert.Equal(t, err.Assertion, "sqlkite_assert")
+	assert.Equal(t, err.Expected, "true")
+	assert.Equal(t, err.Actual, "null")
+
+	// within a trigger
+	db.MustExec("create table docs (id integer primary key, owner_id text not null)")
+	assert.Nil(t, db.ApplyPolicy(sqlite.Policy{Table: "docs", OwnerColumn: "owner_id", Delete: "old.id > 10"}))
+
+	err = denied(t, db.Exec("insert into docs (id, owner_id) values (1, 'leto')"))
+	assert.Equal(t, err.Assertion, "sqlkite_assert_user_id")
+	assert.Equal(t, err.Expected, "text")
+	assert.Equal(t, err.Actual, "text")
+	assert.Equal(t, err.Table, "docs")
+	assert.Equal(t, err.Trigger, "sqlkite_policy_docs_insert")
+
+	assert.Nil(t, db.Exec("insert into docs (id, owner_id) values (1, 'teg')"))
+	err = denied(t, db.Exec("delete from docs where id = 1"))
+	assert.Equal(t, err.Assertion, "sqlkite_assert")
+	assert.Equal(t, err.Actual, "false")
+	assert.Equal(t, err.Table, "docs")
+	assert.Equal(t, err.Trigger, "sqlkite_policy_docs_delete")
+
+	// a hand-written trigger naming itself
+	db.MustExec(`create temp trigger docs_update before update on docs for each row
+		begin
+			select sqlkite_assert_user_role_at_least('admin', 'docs_update');
+		end`)
+	assert.Nil(t, db.SetRoleHierarchy("admin", "editor"))
+	err = denied(t, db.Exec("update docs set owner_id = 'teg'"))
+	assert.Equal(t, err.Assertion, "sqlkite_assert_user_role_at_least")
+	assert.Equal(t, err.Table, "docs")
+	assert.Equal(t, err.Trigger, "docs_update")
+
+	// names with separators, and sqlkite_assert_user_role_in's variant
+	db.MustExec(`create temp trigger "docs, (delete)" before delete on docs for each row
+		begin
+			select sqlkite_assert_user_role_in_trigger('docs, (delete)', 'admin', 'owner');
+		end`)
+	err = denied(t, db.Exec("delete from docs where id = 1"))
+	assert.Equal(t, err.Assertion, "sqlkite_assert_user_role_in")
+	assert.Equal(t, err.Expected, "text")
+	assert.Equal(t, err.Actual, "text")
+	assert.Equal(t, err.Table, "docs")
+	assert.Equal(t, err.Trigger, "docs, (delete)")
+
+	// a trigger name is only reported for a trigger calling the assertion
+	err = denied(t, db.Exec("select sqlkite_assert_claim('team_id', '3', 'nope')"))
+	assert.Equal(t, err.Expected, "text")
+	assert.Equal(t, err.Table, "")
+	assert.Equal(t, err.Trigger, "")
+	err = denied(t, db.Exec("select sqlkite_assert_claim('team_id', '3', 'docs_update')"))
+	assert.Equal(t, err.Assertion, "sqlkite_assert_claim")
+	assert.Equal(t, err.Trigger, "")
+
+	// the error is still an Error
+	sqliteErr, ok := db.Exec("select sqlkite_assert_user_id('leto')").(sqlite.Error)
+	assert.True(t, ok)
+	assert.True(t, errors.Is(sqliteErr, sqlite.ErrRowAccess))
+
+	assert.StringContains(t, db.Exec("select sqlkite_assert(0, 1)").Error(), "sqlkite_assert requires a text argument")
+	assert.StringContains(t, db.Exec("select sqlkite_assert_claim('team_id', 3, null)").Error(), "sqlkite_assert requires a text argument")
+
+	// other errors are unaffected
+	assert.False(t, errors.Is(db.Exec("select sqlkite_assert_user_id(1)"), sqlite.ErrRowAccess))
+	assert.False(t, errors.Is(db.Exec("select * from invalid"), sqlite.ErrRowAccess))
+}
+
+func Test_Policy_Apply(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	db.MustExec("create table docs (id integer primary key, owner_id text not null, team_id int not null default(0), locked int not null default(0))")
+	policy := sqlite.Policy{
+		Table:       "docs",
+		OwnerColumn: "owner_id",
+		Roles:       []string{"editor", "admin"},
+		Insert:      "new.team_id = sqlkite_claim('team_id')",
+		Delete:      "not old.locked",
+	}
+	assert.Nil(t, db.ApplyPolicy(policy))
+
+	assertIds := func(t *testing.T, expected ...int) {
+		t.Helper()
+		maps, err := db.Maps("select id from docs_visible order by id")
+		assert.Nil(t, err)
+		assert.Equal(t, len(maps), len(expected))
+		for i, m := range maps {
+			assert.Equal(t, m["id"].(int), expected[i])
+		}
+	}
+
+	assert.Nil(t, db.SetUser("teg", "editor"))
+	assert.Nil(t, db.SetClaims(map[string]any{"team_id": 2}))
+
+	assert.Nil(t, db.Exec("insert into docs (id, owner_id, team_id) values (1, 'teg', 2)"))
+	assert.Nil(t, db.Exec("insert into docs (id, owner_id, team_id, locked) values (2, 'teg', 2, 1)"))
+	assert.StringContains(t, db.Exec("insert into docs (id, owner_id, team_id) values (3, 'leto', 2)").Error(), "sqlkite_row_access")
+	assert.StringContains(t, db.Exec("insert into docs (id, owner_id, team_id) values (3, 'teg', 3)").Error(), "sqlkite_row_access")
+
+	// can't give away a row
+	assert.StringContains(t, db.Exec("update docs set owner_id = 'leto' where id = 1").Error(), "sqlkite_row_access")
+	assert.Nil(t, db.Exec("update docs set team_id = 9 where id = 1"))
+
+	// locked
+	assert.StringContains(t, db.Exec("delete from docs where id = 2").Error(), "sqlkite_row_access")
+
+	assertIds(t, 1, 2)
+
+	assert.Nil(t, db.SetUser("leto", "admin"))
+	assertIds(t)
+	assert.StringContains(t, db.Exec("delete from docs where id = 1").Error(), "sqlkite_row_access")
+
+	assert.Nil(t, db.SetUser("teg", "viewer"))
+	assertIds(t)
+	assert.StringContains(t, db.Exec("insert into docs (id, owner_id, team_id) values (3, 'teg', 2)").Error(), "sqlkite_row_access")
+
+	assert.Nil(t, db.SetUser("teg", "Admin"))
+	assertIds(t, 1, 2)
+	assert.Nil(t, db.Exec("delete from docs where id = 1"))
+	assertIds(t, 2)
+}
+
+func Test_Policy_Idempotent(t *testing.T) {
+	db := testDB()
+	defer db.Close()
+
+	db.MustExec("create table docs (id integer primary key, owner_id text not null)")
+	db.MustExec("create table notes (id integer primary key, owner_id text not null)")
+
+	policies, err := db.ListPolicies()
+	assert.Nil(t, err)
+	assert.Equal(t, len(policies), 0)
+
+	policy := sqlite.Policy{Table: "docs", OwnerColumn: "owner_id"}
+	diff, err := db.DiffPolicy(policy)
+	assert.Nil(t, err)
+	assert.True(t, diff.Existing == nil)
+	assert.Equal(t, strings.Join(diff.Changes, ","), "create trigger sqlkite_policy_docs_insert,create trigger sqlkite_policy_docs_update,create trigger sqlkite_policy_docs_delete,create view docs_visible,record policy docs")
+
+	assert.Nil(t, db.ApplyPolicy(policy))
+	assert.Nil(t, db.ApplyPolicy(policy))
+	assert.Nil(t, db.ApplyPolicy(sqlite.Policy{Table: "notes", Roles: []string{"admin"}, View: "my_notes"}))
+
+	diff, err = db.DiffPolicy(policy)
+	assert.Nil(t, err)
+	assert.False(t, diff.Changed())
+	assert.Equal(t, diff.Existing.OwnerColumn, "owner_id")
+
+	policies, err = db.ListPolicies()
+	assert.Nil(t, err)
+	assert.Equal(t, len(policies), 2)
+	assert.Equal(t, policies[0].Table, "docs")
+	assert.Equal(t, policies[1].Table, "notes")
+	assert.Equal(t, policies[1].Roles[0], "admin")
+
+	// manual tampering is detected
+	db.MustExec("drop trigger sqlkite_policy_docs_delete")
+	diff, _ = db.DiffPolicy(policy)
+	assert.Equal(t, strings.Join(diff.Changes, ","), "create trigger sqlkite_policy_docs_delete")
+	assert.Nil(t, db.ApplyPolicy(policy))
+
+	// changing the policy
+	policy.OwnerColumn = ""
+	policy.Delete = "0"
+	diff, _ = db.DiffPolicy(policy)
+	assert.Equal(t, strings.Join(diff.Changes, ","), "replace trigger sqlkite_policy_docs_delete,replace view docs_visible,drop trigger sqlkite_policy_docs_insert,drop trigger sqlkite_policy_docs_update,record policy docs")
+	assert.Nil(t, db.ApplyPolicy(policy))
+	assert.Nil(t, db.Exec("insert into docs (id, owner_id) values (1, 'x')"))
+	assert.StringContains(t, db.Exec("delete from docs").Error(), "sqlkite_row_access")
+
+	diffs, err := db.DiffPolicies([]sqlite.Policy{policy})
+	assert.Nil(t, err)
+	assert.Equal(t, len(diffs), 1)
+	assert.True(t, diffs[0].Desired == nil)
+	assert.Equal(t, strings.Join(diffs[0].Changes, ","), "drop trigger sqlkite_policy_notes_delete,drop trigger sqlkite_policy_notes_insert,drop trigger sqlkite_policy_notes_update,drop view my_notes,remove policy notes")
+
+	assert.Nil(t, db.DropPolicy("notes"))
+	assert.Nil(t, db.DropPolicy("notes"))
+	policies, _ = db.ListPolicies()
+	assert.Equal(t, len(policies), 1)
+
+	var count int
+	assert.Nil(t, db.Row("select count(*) from sqlite_schema where name like '%notes%' and type != 'table'").Scan(&count))
+	assert.Equal(t, count, 0)
+
+	assert.Equal(t, db.ApplyPolicy(sqlite.Policy{}).Error(), "sqlite: policy requires a table (code: 21)")
+}
+
+func Test_StmtCache(t *testing.T) {
+	db := testDBConfig(sqlite.Config{StmtCacheSize: 2})
+	defer db.Close()
+
+	// testDB's setup was cached
+	initial := db.StmtCacheStats()
+	assert.Equal(t, initial.Size, 1)
+
+	for i := 1; i <= 3; i++ {
+		assert.Nil(t, db.Exec("insert into test (cint, ctextn) values (?1, ?2)", i, "x"))
+	}
+	// bindings are cleared when a statement goes back in the cache
+	assert.Nil(t, db.Exec("insert into test (cint, ctextn) values (?1, ?2)", 4))
+
+	var text *string
+	assert.Nil(t, db.Row("select ctextn from test where cint = ?1", 4).Scan(&text))
+	assert.True(t, text == nil)
+
+	stats := db.StmtCacheStats()
+	assert.Equal(t, stats.Size, 2)
+	assert.Equal(t, stats.Hits, 3)
+	assert.Equal(t, stats.Misses, initial.Misses+2)
+	assert.Equal(t, stats.Evictions, 1)
+
+	// nested use of the same SQL gets a second statement
+	rows := db.Rows("select cint from test where cint < ?1 order by cint", 3)
+	var ids []int
+	for rows.Next() {
+		var id, count int
+		rows.Scan(&id)
+		assert.Nil(t, db.Row("select cint from test where cint < ?1 order by cint", 3).Scan(&count))
+		ids = append(ids, id)
+	}
+	assert.Nil(t, rows.Error())
+	rows.Close()
+	assert.Equal(t, len(ids), 2)
+
+	stats = db.StmtCacheStats()
+	assert.Equal(t, stats.Size, 2)
+	assert.Equal(t, stats.Evictions, 2)
+
+	// SQL with multiple statements isn't cached
+	assert.Nil(t, db.Exec("insert into test (cint) values (10); insert into test (cint) values (11);"))
+	var count int
+	assert.Nil(t, db.Row("select count(*) from test where cint >= 10").Scan(&count))
+	assert.Equal(t, count, 2)
+
+	// prepare errors are the same as without the cache
+	err := db.Exec("select invalid")
+	assert.Equal(t, err.Error(), "sqlite: no such column: invalid (code: 1)")
+	_, isPrepareError := db.Row("select invalid where ?1", 1).Scan().(sqlite.PrepareError)
+	assert.True(t, isPrepareError)
+
+	db.ClearStmtCache()
+	assert.Equal(t, db.StmtCacheStats().Size, 0)
+
+}
+
+func Test_StmtCache_Close(t *testing.T) {
+	db := testDBConfig(sqlite.Config{StmtCacheSize: 2})
+	mustExec(db, "insert into test (cint) values (1)")
+
+	// a statement in use when the connection is closed is finalized, not
+	// put back in the cache, once it's closed
+	rows := db.Rows("select cint from test")
+	assert.True(t, rows.Next())
+	assert.Nil(t, db.Close())
+	rows.Close()
+	assert.Equal(t, db.StmtCacheStats().Size, 0)
+}
+
+func Test_StmtCache_Schema_Change(t *testing.T) {
+	db := testDBConfig(sqlite.Config{StmtCacheSize: 4})
+	defer db.Close()
+
+	db.MustExec("create table cache (id int)")
+	db.MustExec("insert into cache values (1)")
+
+	m, err := db.Row("select * from cache").Map()
+	assert.Nil(t, err)
+	assert.Equal(t, len(m), 1)
+
+	db.MustExec("alter table cache add column name text default('leto')")
+
+	m, err = db.Row("select * from cache").Map()
+	assert.Nil(t, err)
+	assert.Equal(t, len(m), 2)
+	assert.Equal(t, m["name"].(string), "leto")
+
+	stats := db.StmtCacheStats()
+	assert.Equal(t, stats.Hits, 1)
+	assert.Equal(t, stats.Invalidations, 1)
+
+	// an unchanged schema doesn't invalidate anything
+	db.Row("select * from cache").Map()
+	assert.Equal(t, db.StmtCacheStats().Invalidations, 1)
+}
+
 func testDB() sqlite.Conn {
-	db, err := sqlite.Open(":memory:", true)
+	return testDBConfig(sqlite.Config{})
+}
+
+func testDBConfig(config sqlite.Config) sqlite.Conn {
+	db, err := sqlite.OpenConfig(":memory:", true, config)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,1107 @@
+package sqlite
+
+/*
+#include "sqlite3.h"
+#include <string.h>
+
+#define SQLKITE_USER_ID 0
+#define SQLKITE_USER_ROLE 1
+
+#define SQLKITE_NOCASE 0
+#define SQLKITE_EXACT 1
+
+#define SQLKITE_ROW_ACCESS "sqlkite_row_access"
+
+// A claim is either null, an integer, a float, text or a list of text. A
+// list's text is its JSON representation.
+typedef struct sqlkite_claim_value {
+	char *name;
+	int type;
+	sqlite3_int64 i;
+	double f;
+	char *text;
+	int text_len;
+	int list;
+	char **items;
+	int *item_lens;
+	int item_count;
+} sqlkite_claim_value;
+
+// The last access denial (see sqlkite_deny). The assertion, expected and
+// actual are static strings. The table and trigger are only set when the
+// assertion named a trigger which exists.
+typedef struct sqlkite_denial {
+	int set;
+	const char *assertion;
+	const char *expected;
+	const char *actual;
+	char *table;
+	char *trigger;
+} sqlkite_denial;
+
+// Connection-owned user context. When set == 0, the user is read from the
+// sqlkite_user temp table (if it exists). Claims are independent of the user.
+typedef struct sqlkite_ctx {
+	int set;
+	char *user_id;
+	int user_id_len;
+	char *role;
+	int role_len;
+	sqlkite_claim_value *claims;
+	int claim_count;
+	char **roles;
+	int role_count;
+	sqlkite_denial denial;
+} sqlkite_ctx;
+
+static const char *sqlkite_user_sql[] = {
+	"select user_id from sqlkite_user",
+	"select role from sqlkite_user",
+};
+
+static void sqlkite_ctx_clear(sqlkite_ctx *ctx) {
+	sqlite3_free(ctx->user_id);
+	sqlite3_free(ctx->role);
+	ctx->set = 0;
+	ctx->user_id = NULL;
+	ctx->user_id_len = 0;
+	ctx->role = NULL;
+	ctx->role_len = 0;
+}
+
+static void sqlkite_claims_clear(sqlkite_ctx *ctx) {
+	for (int i = 0; i < ctx->claim_count; i++) {
+		sqlkite_claim_value *claim = &ctx->claims[i];
+		sqlite3_free(claim->name);
+		sqlite3_free(claim->text);
+		for (int j = 0; j < claim->item_count; j++) {
+			sqlite3_free(claim->items[j]);
+		}
+		sqlite3_free(claim->items);
+		sqlite3_free(claim->item_lens);
+	}
+	sqlite3_free(ctx->claims);
+	ctx->claims = NULL;
+	ctx->claim_count = 0;
+}
+
+static void sqlkite_roles_clear(sqlkite_ctx *ctx) {
+	for (int i = 0; i < ctx->role_count; i++) {
+		sqlite3_free(ctx->roles[i]);
+	}
+	sqlite3_free(ctx->roles);
+	ctx->roles = NULL;
+	ctx->role_count = 0;
+}
+
+static void sqlkite_denial_clear(sqlkite_ctx *ctx) {
+	sqlite3_free(ctx->denial.table);
+	sqlite3_free(ctx->denial.trigger);
+	memset(&ctx->denial, 0, sizeof(sqlkite_denial));
+}
+
+static void sqlkite_ctx_free(void *p) {
+	sqlkite_ctx *ctx = (sqlkite_ctx*)p;
+	sqlkite_ctx_clear(ctx);
+	sqlkite_claims_clear(ctx);
+	sqlkite_roles_clear(ctx);
+	sqlkite_denial_clear(ctx);
+	sqlite3_free(ctx);
+}
+
+static char *sqlkite_strdup(const char *value, int len) {
+	char *copy = (char*)sqlite3_malloc64(len + 1);
+	if (copy) {
+		if (len > 0) {
+			memcpy(copy, value, len);
+		}
+		copy[len] = 0;
+	}
+	return copy;
+}
+
+static int sqlkite_ctx_set(sqlkite_ctx *ctx, const char *user_id, int user_id_len, const char *role, int role_len) {
+	char *user_id_copy = sqlkite_strdup(user_id, user_id_len);
+	char *role_copy = sqlkite_strdup(role, role_len);
+	if (!user_id_copy || !role_copy) {
+		sqlite3_free(user_id_copy);
+		sqlite3_free(role_copy);
+		return SQLITE_NOMEM;
+	}
+
+	sqlkite_ctx_clear(ctx);
+	ctx->set = 1;
+	ctx->user_id = user_id_copy;
+	ctx->user_id_len = user_id_len;
+	ctx->role = role_copy;
+	ctx->role_len = role_len;
+	return SQLITE_OK;
+}
+
+static int sqlkite_claims_reset(sqlkite_ctx *ctx, int count) {
+	sqlkite_claims_clear(ctx);
+	if (count == 0) {
+		return SQLITE_OK;
+	}
+	sqlkite_claim_value *claims = (sqlkite_claim_value*)sqlite3_malloc64(sizeof(sqlkite_claim_value) * count);
+	if (!claims) {
+		return SQLITE_NOMEM;
+	}
+	memset(claims, 0, sizeof(sqlkite_claim_value) * count);
+	ctx->claims = claims;
+	ctx->claim_count = count;
+	return SQLITE_OK;
+}
+
+// Claims are populated one at a time after sqlkite_claims_reset. A claim with
+// a NULL name is ignored by lookups, so a partially populated set is safe.
+static int sqlkite_claim_set(sqlkite_ctx *ctx, int i, const char *name, int name_len, int type, sqlite3_int64 n, double f, const char *text, int text_len, int list, int item_count) {
+	sqlkite_claim_value *claim = &ctx->claims[i];
+	claim->type = type;
+	claim->list = list;
+	claim->i = n;
+	claim->f = f;
+	if (type == SQLITE_TEXT) {
+		claim->text = sqlkite_strdup(text, text_len);
+		claim->text_len = text_len;
+		if (!claim->text) {
+			return SQLITE_NOMEM;
+		}
+	}
+	if (item_count > 0) {
+		claim->items = (char**)sqlite3_malloc64(sizeof(char*) * item_count);
+		claim->item_lens = (int*)sqlite3_malloc64(sizeof(int) * item_count);
+		if (!claim->items || !claim->item_lens) {
+			return SQLITE_NOMEM;
+		}
+		memset(claim->items, 0, sizeof(char*) * item_count);
+		claim->item_count = item_count;
+	}
+	// set last, so that the claim is only visible once complete
+	claim->name = sqlkite_strdup(name, name_len);
+	if (!claim->name) {
+		return SQLITE_NOMEM;
+	}
+	return SQLITE_OK;
+}
+
+static int sqlkite_claim_set_item(sqlkite_ctx *ctx, int i, int j, const char *value, int len) {
+	sqlkite_claim_value *claim = &ctx->claims[i];
+	claim->items[j] = sqlkite_strdup(value, len);
+	claim->item_lens[j] = len;
+	return claim->items[j] ? SQLITE_OK : SQLITE_NOMEM;
+}
+
+// The role hierarchy, from most to least privileged. Like claims, roles are
+// populated one at a time after sqlkite_roles_reset.
+static int sqlkite_roles_reset(sqlkite_ctx *ctx, int count) {
+	sqlkite_roles_clear(ctx);
+	if (count == 0) {
+		return SQLITE_OK;
+	}
+	char **roles = (char**)sqlite3_malloc64(sizeof(char*) * count);
+	if (!roles) {
+		return SQLITE_NOMEM;
+	}
+	memset(roles, 0, sizeof(char*) * count);
+	ctx->roles = roles;
+	ctx->role_count = count;
+	return SQLITE_OK;
+}
+
+static int sqlkite_roles_set(sqlkite_ctx *ctx, int i, const char *role, int len) {
+	ctx->roles[i] = sqlkite_strdup(role, len);
+	return ctx->roles[i] ? SQLITE_OK : SQLITE_NOMEM;
+}
+
+static int sqlkite_role_rank(sqlkite_ctx *ctx, const char *role) {
+	for (int i = 0; i < ctx->role_count; i++) {
+		if (ctx->roles[i] && sqlite3_stricmp(ctx->roles[i], role) == 0) {
+			return i;
+		}
+	}
+	return -1;
+}
+
+static sqlkite_claim_value *sqlkite_claim_find(sqlite3_context *context, sqlite3_value *name) {
+	sqlkite_ctx *ctx = (sqlkite_ctx*)sqlite3_user_data(context);
+	const char *n = (const char*)sqlite3_value_text(name);
+	if (!n) {
+		return NULL;
+	}
+	for (int i = 0; i < ctx->claim_count; i++) {
+		sqlkite_claim_value *claim = &ctx->claims[i];
+		if (claim->name && strcmp(claim->name, n) == 0) {
+			return claim;
+		}
+	}
+	return NULL;
+}
+
+static const char *sqlkite_value_kind(sqlite3_value *value) {
+	switch (sqlite3_value_type(value)) {
+	case SQLITE_INTEGER:
+		return "integer";
+	case SQLITE_FLOAT:
+		return "real";
+	case SQLITE_TEXT:
+		return "text";
+	case SQLITE_BLOB:
+		return "blob";
+	}
+	return "null";
+}
+
+static void sqlkite_text_argument_error(sqlite3_context *context, const char *fn) {
+	const char* errMsg = sqlite3_mprintf("%s requires a text argument", fn);
+	sqlite3_result_error(context, errMsg, -1);
+	sqlite3_free((void *)errMsg);
+}
+
+// The assertions take an optional trailing argument: the name of the trigger
+// they're called from (SQLite doesn't tell functions). Returns 0, with the
+// error set, if it isn't text.
+static int sqlkite_trigger_arg(sqlite3_context *context, int argc, sqlite3_value **argv, int n, sqlite3_value **trigger) {
+	*trigger = NULL;
+	if (argc <= n) {
+		return 1;
+	}
+	if (sqlite3_value_type(argv[n]) != SQLITE_TEXT) {
+		sqlkite_text_argument_error(context, "sqlkite_assert");
+		return 0;
+	}
+	*trigger = argv[n];
+	return 1;
+}
+
+// Fails with sqlkite_row_access, recording which assertion failed and the
+// kind (never the value) of what was expected and what the user has in the
+// connection's context, where Go reads it from (see AccessDeniedError). The
+// message is only meant for people, e.g.:
+//   sqlkite_row_access: sqlkite_assert_user_id (expected: text, actual: none, table: docs, trigger: docs_insert)
+// The trigger name is given by the caller, so it's only reported if a trigger
+// with that name exists and calls the assertion.
+static void sqlkite_deny(sqlite3_context *context, const char *fn, const char *expected, const char *actual, sqlite3_value *trigger) {
+	sqlkite_ctx *ctx = (sqlkite_ctx*)sqlite3_user_data(context);
+	sqlkite_denial_clear(ctx);
+	ctx->denial.set = 1;
+	ctx->denial.assertion = fn;
+	ctx->denial.expected = expected;
+	ctx->denial.actual = actual;
+
+	if (trigger) {
+		sqlite3_stmt *stmt;
+		sqlite3 *db = sqlite3_context_db_handle(context);
+		const char *sql = "select tbl_name from sqlite_schema where type = 'trigger' and name = ?1 and instr(lower(sql), ?2) "
+			"union all select tbl_name from sqlite_temp_schema where type = 'trigger' and name = ?1 and instr(lower(sql), ?2)";
+
+		if (sqlite3_prepare_v2(db, sql, -1, &stmt, 0) == SQLITE_OK) {
+			sqlite3_bind_value(stmt, 1, trigger);
+			sqlite3_bind_text(stmt, 2, fn, -1, SQLITE_STATIC);
+			if (sqlite3_step(stmt) == SQLITE_ROW) {
+				ctx->denial.table = sqlite3_mprintf("%s", sqlite3_column_text(stmt, 0));
+				ctx->denial.trigger = sqlite3_mprintf("%s", sqlite3_value_text(trigger));
+			}
+			sqlite3_finalize(stmt);
+		}
+	}
+
+	char *errMsg;
+	if (ctx->denial.trigger) {
+		errMsg = sqlite3_mprintf(SQLKITE_ROW_ACCESS ": %s (expected: %s, actual: %s, table: %s, trigger: %s)", fn, expected, actual, ctx->denial.table, ctx->denial.trigger);
+	} else {
+		errMsg = sqlite3_mprintf(SQLKITE_ROW_ACCESS ": %s (expected: %s, actual: %s)", fn, expected, actual);
+	}
+	sqlite3_result_error(context, errMsg, -1);
+	sqlite3_free(errMsg);
+}
+
+static void sqlkite_claim(sqlite3_context *context, int argc, sqlite3_value **argv){
+	sqlkite_claim_value *claim = sqlkite_claim_find(context, argv[0]);
+	if (!claim) {
+		sqlite3_result_null(context);
+		return;
+	}
+
+	switch (claim->type) {
+	case SQLITE_INTEGER:
+		sqlite3_result_int64(context, claim->i);
+		break;
+	case SQLITE_FLOAT:
+		sqlite3_result_double(context, claim->f);
+		break;
+	case SQLITE_TEXT:
+		sqlite3_result_text(context, claim->text, claim->text_len, SQLITE_TRANSIENT);
+		if (claim->list) {
+			// JSON subtype
+			sqlite3_result_subtype(context, 74);
+		}
+		break;
+	default:
+		sqlite3_result_null(context);
+	}
+}
+
+static int sqlkite_has_item(const char *items, int items_len, const char *target, int target_len) {
+	// space separated (like an OAuth scope)
+	int start = 0;
+	for (int i = 0; i <= items_len; i++) {
+		if (i == items_len || items[i] == ' ') {
+			if (i - start == target_len && memcmp(items + start, target, target_len) == 0) {
+				return 1;
+			}
+			start = i + 1;
+		}
+	}
+	return 0;
+}
+
+static void sqlkite_has_scope(sqlite3_context *context, int argc, sqlite3_value **argv){
+	if (sqlite3_value_type(argv[0]) != SQLITE_TEXT) {
+		sqlite3_result_error(context, "sqlkite_has_scope requires a text argument", -1);
+		return;
+	}
+
+	sqlkite_ctx *ctx = (sqlkite_ctx*)sqlite3_user_data(context);
+	const char *target = (const char*)sqlite3_value_text(argv[0]);
+	int target_len = sqlite3_value_bytes(argv[0]);
+
+	int found = 0;
+	for (int i = 0; i < ctx->claim_count; i++) {
+		sqlkite_claim_value *claim = &ctx->claims[i];
+		if (!claim->name || strcmp(claim->name, "scopes") != 0) {
+			continue;
+		}
+		if (claim->list) {
+			for (int j = 0; j < claim->item_count; j++) {
+				if (claim->item_lens[j] == target_len && memcmp(claim->items[j], target, target_len) == 0) {
+					found = 1;
+					break;
+				}
+			}
+		} else if (claim->type == SQLITE_TEXT) {
+			found = sqlkite_has_item(claim->text, claim->text_len, target, target_len);
+		}
+		break;
+	}
+	sqlite3_result_int(context, found);
+}
+
+static int sqlkite_claim_equals(sqlkite_claim_value *claim, sqlite3_value *value) {
+	int type = sqlite3_value_type(value);
+	if (type == SQLITE_NULL) {
+		return 0;
+	}
+
+	switch (claim->type) {
+	case SQLITE_INTEGER:
+		if (type == SQLITE_INTEGER) {
+			return claim->i == sqlite3_value_int64(value);
+		}
+		if (type == SQLITE_FLOAT) {
+			return (double)claim->i == sqlite3_value_double(value);
+		}
+		break;
+	case SQLITE_FLOAT:
+		if (type == SQLITE_INTEGER || type == SQLITE_FLOAT) {
+			return claim->f == sqlite3_value_double(value);
+		}
+		break;
+	case SQLITE_TEXT:
+		if (claim->list) {
+			// a list never equals a single value
+			return 0;
+		}
+		break;
+	default:
+		return 0;
+	}
+
+	// compare the textual representations, e.g. an integer claim against a
+	// text column holding digits
+	char buf[32];
+	const char *expected = claim->text;
+	int expected_len = claim->text_len;
+	if (claim->type == SQLITE_INTEGER) {
+		sqlite3_snprintf(sizeof(buf), buf, "%lld", claim->i);
+		expected = buf;
+		expected_len = strlen(buf);
+	} else if (claim->type == SQLITE_FLOAT) {
+		sqlite3_snprintf(sizeof(buf), buf, "%!.15g", claim->f);
+		expected = buf;
+		expected_len = strlen(buf);
+	}
+
+	const char *actual = (const char*)sqlite3_value_text(value);
+	int actual_len = sqlite3_value_bytes(value);
+	return actual && actual_len == expected_len && memcmp(actual, expected, actual_len) == 0;
+}
+
+static void sqlkite_assert_claim(sqlite3_context *context, int argc, sqlite3_value **argv){
+	if (sqlite3_value_type(argv[0]) != SQLITE_TEXT) {
+		sqlite3_result_error(context, "sqlkite_assert_claim requires a text claim name", -1);
+		return;
+	}
+
+	sqlite3_value *trigger;
+	if (!sqlkite_trigger_arg(context, argc, argv, 2, &trigger)) {
+		return;
+	}
+
+	sqlkite_claim_value *claim = sqlkite_claim_find(context, argv[0]);
+	if (claim && sqlkite_claim_equals(claim, argv[1])) {
+		return;
+	}
+
+	const char *actual = "missing";
+	if (claim) {
+		switch (claim->type) {
+		case SQLITE_INTEGER:
+			actual = "integer";
+			break;
+		case SQLITE_FLOAT:
+			actual = "real";
+			break;
+		case SQLITE_TEXT:
+			actual = claim->list ? "list" : "text";
+			break;
+		default:
+			actual = "null";
+		}
+	}
+	sqlkite_deny(context, "sqlkite_assert_claim", sqlkite_value_kind(argv[1]), actual, trigger);
+}
+
+static int sqlkite_user_stmt(sqlite3_context *context, const char *sql, sqlite3_stmt **stmt) {
+	int rc;
+	sqlite3 *db = sqlite3_context_db_handle(context);
+
+	rc = sqlite3_prepare_v2(db, sql, -1, stmt, 0);
+	if (rc != SQLITE_OK) {
+		const char* errMsg = sqlite3_mprintf("sqlkite_user.prepare - %s", sqlite3_errmsg(db));
+		sqlite3_result_error(context, errMsg, -1);
+		sqlite3_free((void *)errMsg);
+		return rc;
+	}
+
+	rc = sqlite3_step(*stmt);
+	if (rc == SQLITE_ROW) {
+		return rc;
+	}
+	if (rc == SQLITE_DONE) {
+		// this is fine, but we can close stmt for the caller
+		sqlite3_finalize(*stmt);
+		return rc;
+	}
+
+	// an error
+	sqlite3_finalize(*stmt);
+	const char* errMsg = sqlite3_mprintf("sqlkite_user.step - %s", sqlite3_errmsg(db));
+	sqlite3_result_error(context, errMsg, -1);
+	sqlite3_free((void *)errMsg);
+	return rc;
+}
+
+static void sqlkite_user_result(sqlite3_context *context, int which){
+	sqlkite_ctx *ctx = (sqlkite_ctx*)sqlite3_user_data(context);
+	if (ctx->set) {
+		if (which == SQLKITE_USER_ID) {
+			sqlite3_result_text(context, ctx->user_id, ctx->user_id_len, SQLITE_TRANSIENT);
+		} else {
+			sqlite3_result_text(context, ctx->role, ctx->role_len, SQLITE_TRANSIENT);
+		}
+		return;
+	}
+
+	sqlite3_stmt *stmt;
+
+	// Will sqlite3_result_error if needed, and finalize stmt unless there's a row
+	int rc = sqlkite_user_stmt(context, sqlkite_user_sql[which], &stmt);
+
+	if (rc == SQLITE_ROW) {
+		size_t len = sqlite3_column_bytes(stmt, 0);
+		const char *value = (const char*)sqlite3_column_text(stmt, 0);
+		sqlite3_result_text(context, value, len, SQLITE_TRANSIENT);
+		sqlite3_finalize(stmt);
+	} else if (rc == SQLITE_DONE) {
+		sqlite3_result_null(context);
+	}
+}
+
+// Returns a null-terminated copy of the value, which the caller must free,
+// or NULL if there's no value (or it's empty). failed is set when the
+// result error has been set.
+static char *sqlkite_user_value(sqlite3_context *context, int which, int *failed){
+	sqlkite_ctx *ctx = (sqlkite_ctx*)sqlite3_user_data(context);
+	if (ctx->set) {
+		const char *value = which == SQLKITE_USER_ID ? ctx->user_id : ctx->role;
+		int len = which == SQLKITE_USER_ID ? ctx->user_id_len : ctx->role_len;
+		if (len == 0) {
+			return NULL;
+		}
+		char *copy = sqlkite_strdup(value, len);
+		if (!copy) {
+			*failed = 1;
+			sqlite3_result_error_nomem(context);
+		}
+		return copy;
+	}
+
+	sqlite3_stmt *stmt;
+	char *value = NULL;
+
+	// Will sqlite3_result_error if needed, and finalize stmt unless there's a row
+	int rc = sqlkite_user_stmt(context, sqlkite_user_sql[which], &stmt);
+	if (rc == SQLITE_ROW) {
+		size_t len = sqlite3_column_bytes(stmt, 0);
+		if (len != 0) {
+			value = sqlkite_strdup((const char*)sqlite3_column_text(stmt, 0), len);
+			if (!value) {
+				*failed = 1;
+				sqlite3_result_error_nomem(context);
+			}
+		}
+		sqlite3_finalize(stmt);
+	} else if (rc != SQLITE_DONE) {
+		*failed = 1;
+	}
+	return value;
+}
+
+static int sqlkite_matches(const char *actual, sqlite3_value *target, int mode) {
+	const char *t = (const char*)sqlite3_value_text(target);
+	if (mode == SQLKITE_NOCASE) {
+		return sqlite3_stricmp(actual, t) == 0;
+	}
+	int len = sqlite3_value_bytes(target);
+	return (int)strlen(actual) == len && memcmp(actual, t, len) == 0;
+}
+
+// Fails with sqlkite_row_access unless the user's id (or role) matches
+// any of the arguments. Every argument must be text.
+static void sqlkite_assert_value(sqlite3_context *context, const char *fn, int which, int mode, int argc, sqlite3_value **argv, sqlite3_value *trigger){
+	if (argc == 0) {
+		sqlkite_text_argument_error(context, "sqlkite_assert");
+		return;
+	}
+	for (int i = 0; i < argc; i++) {
+		if (sqlite3_value_type(argv[i]) != SQLITE_TEXT) {
+			sqlkite_text_argument_error(context, "sqlkite_assert");
+			return;
+		}
+	}
+
+	// a failure to load the user is reported as sqlkite_row_access
+	int failed = 0;
+	int valid = 0;
+	const char *actual = sqlkite_user_value(context, which, &failed);
+	if (actual) {
+		for (int i = 0; i < argc && !valid; i++) {
+			valid = sqlkite_matches(actual, argv[i], mode);
+		}
+		sqlite3_free((void *)actual);
+	}
+
+	if (!valid) {
+		sqlkite_deny(context, fn, "text", actual ? "text" : "none", trigger);
+	}
+}
+
+// 1 if the user's role is at least the given (text) role in the hierarchy,
+// 0 if not. With the error set: -1 if the given role isn't in the hierarchy,
+// -2 if the user's role couldn't be loaded. has_role is set if the user has a
+// role.
+static int sqlkite_role_at_least(sqlite3_context *context, const char *fn, sqlite3_value *target, int *has_role) {
+	sqlkite_ctx *ctx = (sqlkite_ctx*)sqlite3_user_data(context);
+	int required = sqlkite_role_rank(ctx, (const char*)sqlite3_value_text(target));
+	if (required == -1) {
+		const char* errMsg = sqlite3_mprintf("%s unknown role: %s", fn, sqlite3_value_text(target));
+		sqlite3_result_error(context, errMsg, -1);
+		sqlite3_free((void *)errMsg);
+		return -1;
+	}
+
+	int failed = 0;
+	const char *actual = sqlkite_user_value(context, SQLKITE_USER_ROLE, &failed);
+	if (!actual) {
+		return failed ? -2 : 0;
+	}
+	*has_role = 1;
+	int rank = sqlkite_role_rank(ctx, actual);
+	sqlite3_free((void *)actual);
+	return rank != -1 && rank <= required;
+}
+
+// Fails with sqlkite_row_access unless the value is true (non-zero)
+static void sqlkite_assert(sqlite3_context *context, int argc, sqlite3_value **argv){
+	sqlite3_value *trigger;
+	if (!sqlkite_trigger_arg(context, argc, argv, 1, &trigger)) {
+		return;
+	}
+	if (sqlite3_value_type(argv[0]) == SQLITE_NULL) {
+		sqlkite_deny(context, "sqlkite_assert", "true", "null", trigger);
+	} else if (sqlite3_value_double(argv[0]) == 0.0) {
+		sqlkite_deny(context, "sqlkite_assert", "true", "false", trigger);
+	}
+}
+
+static void sqlkite_user_id(sqlite3_context *context, int argc, sqlite3_value **argv){
+	sqlkite_user_result(context, SQLKITE_USER_ID);
+}
+
+static void sqlkite_user_role(sqlite3_context *context, int argc, sqlite3_value **argv){
+	sqlkite_user_result(context, SQLKITE_USER_ROLE);
+}
+
+static void sqlkite_assert_user_id(sqlite3_context *context, int argc, sqlite3_value **argv){
+	sqlite3_value *trigger;
+	if (sqlkite_trigger_arg(context, argc, argv, 1, &trigger)) {
+		sqlkite_assert_value(context, "sqlkite_assert_user_id", SQLKITE_USER_ID, SQLKITE_NOCASE, 1, argv, trigger);
+	}
+}
+
+static void sqlkite_assert_user_id_exact(sqlite3_context *context, int argc, sqlite3_value **argv){
+	sqlite3_value *trigger;
+	if (sqlkite_trigger_arg(context, argc, argv, 1, &trigger)) {
+		sqlkite_assert_value(context, "sqlkite_assert_user_id_exact", SQLKITE_USER_ID, SQLKITE_EXACT, 1, argv, trigger);
+	}
+}
+
+static void sqlkite_assert_user_role(sqlite3_context *context, int argc, sqlite3_value **argv){
+	sqlite3_value *trigger;
+	if (sqlkite_trigger_arg(context, argc, argv, 1, &trigger)) {
+		sqlkite_assert_value(context, "sqlkite_assert_user_role", SQLKITE_USER_ROLE, SQLKITE_NOCASE, 1, argv, trigger);
+	}
+}
+
+static void sqlkite_assert_user_role_exact(sqlite3_context *context, int argc, sqlite3_value **argv){
+	sqlite3_value *trigger;
+	if (sqlkite_trigger_arg(context, argc, argv, 1, &trigger)) {
+		sqlkite_assert_value(context, "sqlkite_assert_user_role_exact", SQLKITE_USER_ROLE, SQLKITE_EXACT, 1, argv, trigger);
+	}
+}
+
+static void sqlkite_assert_user_role_in(sqlite3_context *context, int argc, sqlite3_value **argv){
+	sqlkite_assert_value(context, "sqlkite_assert_user_role_in", SQLKITE_USER_ROLE, SQLKITE_NOCASE, argc, argv, NULL);
+}
+
+// sqlkite_assert_user_role_in takes any number of roles, so the trigger name
+// is the first argument of this variant
+static void sqlkite_assert_user_role_in_trigger(sqlite3_context *context, int argc, sqlite3_value **argv){
+	sqlite3_value *trigger;
+	if (argc > 0 && sqlkite_trigger_arg(context, argc, argv, 0, &trigger)) {
+		sqlkite_assert_value(context, "sqlkite_assert_user_role_in", SQLKITE_USER_ROLE, SQLKITE_NOCASE, argc - 1, argv + 1, trigger);
+	} else if (argc == 0) {
+		sqlkite_text_argument_error(context, "sqlkite_assert");
+	}
+}
+
+static void sqlkite_user_role_at_least(sqlite3_context *context, int argc, sqlite3_value **argv){
+	if (sqlite3_value_type(argv[0]) != SQLITE_TEXT) {
+		sqlkite_text_argument_error(context, "sqlkite_user_role_at_least");
+		return;
+	}
+
+	int has_role = 0;
+	int valid = sqlkite_role_at_least(context, "sqlkite_user_role_at_least", argv[0], &has_role);
+	if (valid >= 0) {
+		sqlite3_result_int(context, valid);
+	}
+}
+
+static void sqlkite_assert_user_role_at_least(sqlite3_context *context, int argc, sqlite3_value **argv){
+	sqlite3_value *trigger;
+	if (!sqlkite_trigger_arg(context, argc, argv, 1, &trigger)) {
+		return;
+	}
+
+	if (sqlite3_value_type(argv[0]) != SQLITE_TEXT) {
+		sqlkite_text_argument_error(context, "sqlkite_assert");
+		return;
+	}
+
+	// like the other asserts, failing to load the user is a denial
+	int has_role = 0;
+	int valid = sqlkite_role_at_least(context, "sqlkite_assert_user_role_at_least", argv[0], &has_role);
+	if (valid == 0 || valid == -2) {
+		sqlkite_deny(context, "sqlkite_assert_user_role_at_least", "text", has_role ? "text" : "none", trigger);
+	}
+}
+
+static int sqlkite_register(sqlite3 *db, sqlkite_ctx **out) {
+	int rc;
+	sqlkite_ctx *ctx = (sqlkite_ctx*)sqlite3_malloc(sizeof(sqlkite_ctx));
+	if (!ctx) {
+		return SQLITE_NOMEM;
+	}
+	memset(ctx, 0, sizeof(sqlkite_ctx));
+	*out = ctx;
+
+	// ctx is owned by this function and freed when it's destroyed (when the
+	// connection is closed, or right away if registration fails)
+	rc = sqlite3_create_function_v2(db, "sqlkite_user_id", 0, SQLITE_UTF8, ctx, &sqlkite_user_id, NULL, NULL, &sqlkite_ctx_free);
+	if (rc != SQLITE_OK) {
+		*out = NULL;
+		return rc;
+	}
+
+	rc = sqlite3_create_function(db, "sqlkite_user_role", 0, SQLITE_UTF8, ctx, &sqlkite_user_role, NULL, NULL);
+	if (rc != SQLITE_OK) {
+		return rc;
+	}
+
+	rc = sqlite3_create_function(db, "sqlkite_assert_user_id", 1, SQLITE_UTF8, ctx, &sqlkite_assert_user_id, NULL, NULL);
+	if (rc != SQLITE_OK) {
+		return rc;
+	}
+
+	rc = sqlite3_create_function(db, "sqlkite_assert_user_role", 1, SQLITE_UTF8, ctx, &sqlkite_assert_user_role, NULL, NULL);
+	if (rc != SQLITE_OK) {
+		return rc;
+	}
+
+	rc = sqlite3_create_function(db, "sqlkite_assert_user_id_exact", 1, SQLITE_UTF8, ctx, &sqlkite_assert_user_id_exact, NULL, NULL);
+	if (rc != SQLITE_OK) {
+		return rc;
+	}
+
+	rc = sqlite3_create_function(db, "sqlkite_assert_user_role_exact", 1, SQLITE_UTF8, ctx, &sqlkite_assert_user_role_exact, NULL, NULL);
+	if (rc != SQLITE_OK) {
+		return rc;
+	}
+
+	rc = sqlite3_create_function(db, "sqlkite_assert_user_role_in", -1, SQLITE_UTF8, ctx, &sqlkite_assert_user_role_in, NULL, NULL);
+	if (rc != SQLITE_OK) {
+		return rc;
+	}
+
+	rc = sqlite3_create_function(db, "sqlkite_assert_user_role_in_trigger", -1, SQLITE_UTF8, ctx, &sqlkite_assert_user_role_in_trigger, NULL, NULL);
+	if (rc != SQLITE_OK) {
+		return rc;
+	}
+
+	rc = sqlite3_create_function(db, "sqlkite_user_role_at_least", 1, SQLITE_UTF8, ctx, &sqlkite_user_role_at_least, NULL, NULL);
+	if (rc != SQLITE_OK) {
+		return rc;
+	}
+
+	rc = sqlite3_create_function(db, "sqlkite_assert_user_role_at_least", 1, SQLITE_UTF8, ctx, &sqlkite_assert_user_role_at_least, NULL, NULL);
+	if (rc != SQLITE_OK) {
+		return rc;
+	}
+
+	rc = sqlite3_create_function(db, "sqlkite_assert", 1, SQLITE_UTF8, ctx, &sqlkite_assert, NULL, NULL);
+	if (rc != SQLITE_OK) {
+		return rc;
+	}
+
+	rc = sqlite3_create_function(db, "sqlkite_claim", 1, SQLITE_UTF8, ctx, &sqlkite_claim, NULL, NULL);
+	if (rc != SQLITE_OK) {
+		return rc;
+	}
+
+	rc = sqlite3_create_function(db, "sqlkite_has_scope", 1, SQLITE_UTF8, ctx, &sqlkite_has_scope, NULL, NULL);
+	if (rc != SQLITE_OK) {
+		return rc;
+	}
+
+	rc = sqlite3_create_function(db, "sqlkite_assert_claim", 2, SQLITE_UTF8, ctx, &sqlkite_assert_claim, NULL, NULL);
+	if (rc != SQLITE_OK) {
+		return rc;
+	}
+
+	// the same assertions, with the trailing trigger name argument
+	struct {
+		const char *name;
+		int argc;
+		void (*fn)(sqlite3_context*, int, sqlite3_value**);
+	} with_trigger[] = {
+		{"sqlkite_assert", 2, &sqlkite_assert},
+		{"sqlkite_assert_user_id", 2, &sqlkite_assert_user_id},
+		{"sqlkite_assert_user_id_exact", 2, &sqlkite_assert_user_id_exact},
+		{"sqlkite_assert_user_role", 2, &sqlkite_assert_user_role},
+		{"sqlkite_assert_user_role_exact", 2, &sqlkite_assert_user_role_exact},
+		{"sqlkite_assert_user_role_at_least", 2, &sqlkite_assert_user_role_at_least},
+		{"sqlkite_assert_claim", 3, &sqlkite_assert_claim},
+	};
+	for (int i = 0; i < sizeof(with_trigger) / sizeof(with_trigger[0]); i++) {
+		rc = sqlite3_create_function(db, with_trigger[i].name, with_trigger[i].argc, SQLITE_UTF8, ctx, with_trigger[i].fn, NULL, NULL);
+		if (rc != SQLITE_OK) {
+			return rc;
+		}
+	}
+	return SQLITE_OK;
+}
+*/
+import "C"
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+)
+
+const rowAccessPrefix = "sqlkite_row_access"
+
+// Matched (via errors.Is) by the Error of every access denial.
+var ErrRowAccess = errors.New("sqlite: row access denied")
+
+// The details of an access denied by one of the sqlkite_assert* functions,
+// available from the returned Error via errors.As. Expected and Actual
+// describe the kind (never the value) of what the assertion wanted and what
+// the user has: "text", "integer", "real", "blob", "null", "list", "true",
+// "false", "none" (no user) or "missing" (no such claim). Denials raised some
+// other way, e.g. raise(abort, 'sqlkite_row_access'), have no details.
+//
+// SQLite doesn't tell a function which trigger it's running in, so every
+// assertion takes the trigger's name as an optional last argument, e.g.
+// sqlkite_assert_user_id(new.owner_id, 'docs_insert'), or, for
+// sqlkite_assert_user_role_in, as the first argument of
+// sqlkite_assert_user_role_in_trigger('docs_insert', 'admin', 'editor').
+// Trigger and Table are only set if a trigger with that name exists and calls
+// the assertion. Triggers installed by ApplyPolicy always pass it.
+type AccessDeniedError struct {
+	Assertion string
+	Expected  string
+	Actual    string
+	Table     string
+	Trigger   string
+}
+
+func (e AccessDeniedError) Error() string {
+	if e.Assertion == "" {
+		return ErrRowAccess.Error()
+	}
+	return ErrRowAccess.Error() + " (assertion: " + e.Assertion + ")"
+}
+
+func (e AccessDeniedError) Is(target error) bool {
+	return target == ErrRowAccess
+}
+
+// Connections, by handle, for errorFromCode to find the details of an access
+// denial
+var sqlkiteContexts sync.Map
+
+// Takes the details of the connection's last access denial, for an error
+// whose message is sqlkite_row_access.
+func accessDenied(db *C.sqlite3, message string) *AccessDeniedError {
+	if db == nil || !strings.HasPrefix(message, rowAccessPrefix) {
+		return nil
+	}
+
+	denied := &AccessDeniedError{}
+	value, ok := sqlkiteContexts.Load(db)
+	if !ok {
+		return denied
+	}
+
+	ctx := value.(*C.sqlkite_ctx)
+	denial := &ctx.denial
+	if denial.set == 0 {
+		return denied
+	}
+	denied.Assertion = C.GoString(denial.assertion)
+	denied.Expected = C.GoString(denial.expected)
+	denied.Actual = C.GoString(denial.actual)
+	if denial.trigger != nil {
+		denied.Table = C.GoString(denial.table)
+		denied.Trigger = C.GoString(denial.trigger)
+	}
+	C.sqlkite_denial_clear(ctx)
+	return denied
+}
+
+// The per-connection state used by the sqlkite_* SQL functions. Shared by
+// every copy of a Conn.
+type sqlkite struct {
+	ctx *C.sqlkite_ctx
+}
+
+func registerSqlkite(db *C.sqlite3) (sqlkite, C.int) {
+	var ctx *C.sqlkite_ctx
+	rc := C.sqlkite_register(db, &ctx)
+	if rc == C.SQLITE_OK {
+		sqlkiteContexts.Store(db, ctx)
+	}
+	return sqlkite{ctx: ctx}, rc
+}
+
+func unregisterSqlkite(db *C.sqlite3) {
+	sqlkiteContexts.Delete(db)
+}
+
+// Sets the user returned by sqlkite_user_id() and sqlkite_user_role() (and
+// checked by the sqlkite_assert_* functions). Until ClearUser is called, the
+// sqlkite_user temp table is ignored.
+func (c Conn) SetUser(id string, role string) error {
+	rc := C.sqlkite_ctx_set(c.sqlkite.ctx, cStr(id), C.int(len(id)), cStr(role), C.int(len(role)))
+	if rc != C.SQLITE_OK {
+		return errorFromCode(nil, rc)
+	}
+	return nil
+}
+
+// Clears the user set by SetUser. The sqlkite_* functions go back to reading
+// the user from the sqlkite_user temp table.
+func (c Conn) ClearUser() {
+	C.sqlkite_ctx_clear(c.sqlkite.ctx)
+}
+
+// Sets the user for the duration of fn. Once fn returns, even if it panics,
+// the previous user is restored (or cleared, if there wasn't one), so calls
+// can be nested.
+func (c Conn) WithUser(id string, role string, fn func() error) error {
+	ctx := c.sqlkite.ctx
+	set := ctx.set != 0
+	var previousID, previousRole string
+	if set {
+		previousID = C.GoStringN(ctx.user_id, ctx.user_id_len)
+		previousRole = C.GoStringN(ctx.role, ctx.role_len)
+	}
+
+	if err := c.SetUser(id, role); err != nil {
+		return err
+	}
+	defer func() {
+		if !set {
+			c.ClearUser()
+		} else if err := c.SetUser(previousID, previousRole); err != nil {
+			// can only fail to allocate, don't leave the inner user set
+			c.ClearUser()
+		}
+	}()
+	return fn()
+}
+
+// Sets the claims available to SQL via sqlkite_claim(name),
+// sqlkite_has_scope(scope) and sqlkite_assert_claim(name, value), replacing
+// any existing claims. Values can be nil, strings, bools, integers, floats or
+// []string (which sqlkite_claim returns as a JSON array). sqlkite_has_scope
+// looks at the "scopes" claim, which can either be a []string or a space
+// separated string. Claims are independent of SetUser/ClearUser.
+func (c Conn) SetClaims(claims map[string]any) error {
+	ctx := c.sqlkite.ctx
+	if rc := C.sqlkite_claims_reset(ctx, C.int(len(claims))); rc != C.SQLITE_OK {
+		return errorFromCode(nil, rc)
+	}
+
+	i := 0
+	for name, value := range claims {
+		if err := setClaim(ctx, C.int(i), name, value); err != nil {
+			C.sqlkite_claims_reset(ctx, 0)
+			return err
+		}
+		i += 1
+	}
+	return nil
+}
+
+func (c Conn) ClearClaims() {
+	C.sqlkite_claims_reset(c.sqlkite.ctx, 0)
+}
+
+// Sets the role hierarchy used by sqlkite_user_role_at_least(role) and
+// sqlkite_assert_user_role_at_least(role), ordered from most to least
+// privileged. For example, given ("admin", "editor", "viewer"), an admin
+// is at least an editor. Roles are compared case-insensitively. Calling it
+// without any roles clears the hierarchy.
+func (c Conn) SetRoleHierarchy(roles ...string) error {
+	for i, role := range roles {
+		for _, other := range roles[:i] {
+			if strings.EqualFold(role, other) {
+				return Error{Code: C.SQLITE_MISUSE, Message: "duplicate role in hierarchy: " + role}
+			}
+		}
+	}
+
+	ctx := c.sqlkite.ctx
+	if rc := C.sqlkite_roles_reset(ctx, C.int(len(roles))); rc != C.SQLITE_OK {
+		return errorFromCode(nil, rc)
+	}
+	for i, role := range roles {
+		if rc := C.sqlkite_roles_set(ctx, C.int(i), cStr(role), C.int(len(role))); rc != C.SQLITE_OK {
+			C.sqlkite_roles_reset(ctx, 0)
+			return errorFromCode(nil, rc)
+		}
+	}
+	return nil
+}
+
+func setClaim(ctx *C.sqlkite_ctx, i C.int, name string, value any) error {
+	var n int64
+	var f float64
+	var text string
+	var list []string
+	var tpe C.int
+
+	switch v := value.(type) {
+	case nil:
+		tpe = C.SQLITE_NULL
+	case string:
+		tpe, text = C.SQLITE_TEXT, v
+	case bool:
+		tpe = C.SQLITE_INTEGER
+		if v {
+			n = 1
+		}
+	case int:
+		tpe, n = C.SQLITE_INTEGER, int64(v)
+	case int8:
+		tpe, n = C.SQLITE_INTEGER, int64(v)
+	case int16:
+		tpe, n = C.SQLITE_INTEGER, int64(v)
+	case int32:
+		tpe, n = C.SQLITE_INTEGER, int64(v)
+	case int64:
+		tpe, n = C.SQLITE_INTEGER, v
+	case uint:
+		tpe, n = C.SQLITE_INTEGER, int64(v)
+		if uint64(v) > math.MaxInt64 {
+			return RangeError{Value: v, Type: "int64"}
+		}
+	case uint8:
+		tpe, n = C.SQLITE_INTEGER, int64(v)
+	case uint16:
+		tpe, n = C.SQLITE_INTEGER, int64(v)
+	case uint32:
+		tpe, n = C.SQLITE_INTEGER, int64(v)
+	case uint64:
+		tpe, n = C.SQLITE_INTEGER, int64(v)
+		if v > math.MaxInt64 {
+			return RangeError{Value: v, Type: "int64"}
+		}
+	case float32:
+		tpe, f = C.SQLITE_FLOAT, float64(v)
+	case float64:
+		tpe, f = C.SQLITE_FLOAT, v
+	case []string:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		tpe, text, list = C.SQLITE_TEXT, string(data), v
+	default:
+		return Error{Code: C.SQLITE_MISUSE, Message: fmt.Sprintf("unsupported claim type %T (claim: %s)", v, name)}
+	}
+
+	isList := C.int(0)
+	if list != nil {
+		isList = 1
+	}
+
+	rc := C.sqlkite_claim_set(ctx, i, cStr(name), C.int(len(name)), tpe, C.sqlite3_int64(n), C.double(f), cStr(text), C.int(len(text)), isList, C.int(len(list)))
+	if rc != C.SQLITE_OK {
+		return errorFromCode(nil, rc)
+	}
+
+	for j, item := range list {
+		if rc := C.sqlkite_claim_set_item(ctx, i, C.int(j), cStr(item), C.int(len(item))); rc != C.SQLITE_OK {
+			return errorFromCode(nil, rc)
+		}
+	}
+	return nil
+}
@@ -13,11 +13,44 @@ static void column_types(sqlite3_stmt *s, unsigned char p[], int n) {
 static int empty_string(sqlite3_stmt *s, int i) {
 	return sqlite3_bind_text(s, i, "", 0, SQLITE_STATIC);
 }
+
+// Column accessors which read from row, a row of values buffered by
+// ExecReturning, when it isn't null, and from the statement otherwise.
+static void value_types(sqlite3_value **row, unsigned char p[], int n) {
+	for (int i = 0; i < n; ++i, ++p) {
+		*p = sqlite3_value_type(row[i]);
+	}
+}
+
+static const void *column_blob(sqlite3_stmt *s, sqlite3_value **row, int i) {
+	return row ? sqlite3_value_blob(row[i]) : sqlite3_column_blob(s, i);
+}
+
+static const unsigned char *column_text(sqlite3_stmt *s, sqlite3_value **row, int i) {
+	return row ? sqlite3_value_text(row[i]) : sqlite3_column_text(s, i);
+}
+
+static int column_bytes(sqlite3_stmt *s, sqlite3_value **row, int i) {
+	return row ? sqlite3_value_bytes(row[i]) : sqlite3_column_bytes(s, i);
+}
+
+static double column_double(sqlite3_stmt *s, sqlite3_value **row, int i) {
+	return row ? sqlite3_value_double(row[i]) : sqlite3_column_double(s, i);
+}
+
+static sqlite3_int64 column_int64(sqlite3_stmt *s, sqlite3_value **row, int i) {
+	return row ? sqlite3_value_int64(row[i]) : sqlite3_column_int64(s, i);
+}
+
+static sqlite3_value *column_value(sqlite3_stmt *s, sqlite3_value **row, int i) {
+	return row ? row[i] : sqlite3_column_value(s, i);
+}
 */
 import "C"
 
 import (
 	"fmt"
+	"math"
 	"reflect"
 	"time"
 	"unsafe"
@@ -25,13 +58,45 @@ import (
 
 // When reading values into a RawByte, the slice is owned by sqlite and will
 // only be valid until the next call on the statement is made.
+// Config.DebugRawBuffers can be used to catch code which holds on to a
+// RawBytes (or an UnsafeString) for too long.
 type RawBytes []byte
 
+// Byte written over every RawBytes handed out by a statement, when the
+// statement is stepped, reset or closed, if Config.DebugRawBuffers is set.
+const RawBufferPoison = 0xDB
+
+// A nullable value. Can be bound (an invalid Option binds null) and scanned
+// into (null leaves the Option invalid) for any T that is itself supported.
 type Option[T any] struct {
 	Value T
 	Valid bool
 }
 
+type optionBinder interface {
+	bindValue() (any, bool)
+}
+
+type optionScanner interface {
+	scanOption(s *Stmt, i int) error
+}
+
+func (o Option[T]) bindValue() (any, bool) {
+	return o.Value, o.Valid
+}
+
+func (o *Option[T]) scanOption(s *Stmt, i int) error {
+	if s.columnTypes[i] == C.SQLITE_NULL {
+		*o = Option[T]{}
+		return nil
+	}
+	if err := s.scan(i, &o.Value); err != nil {
+		return err
+	}
+	o.Valid = true
+	return nil
+}
+
 type Stmt struct {
 	stmt         *C.sqlite3_stmt
 	db           *C.sqlite3
@@ -40,9 +105,32 @@ type Stmt struct {
 	cColumnTypes *C.uchar
 	cColumnCount C.int
 	columnNames  []string
+	timeFormat   TimeFormat
+	debugRaw     bool
+	rawBuffers   []RawBytes
+
+	// the current row, when reading rows buffered by ExecReturning
+	row **C.sqlite3_value
+
+	// SQLite transparently re-prepares a statement when the schema changes,
+	// which can change its columns. Checked on the first row of each
+	// execution after the first.
+	reprepares  C.int
+	checkSchema bool
+
+	// set when the statement belongs to the connection's statement cache
+	cache   *stmtCache
+	sql     string
+	discard bool
 }
 
+// Finalizes the statement or, for a statement from the connection's
+// statement cache, resets it and puts it back in the cache.
 func (s *Stmt) Close() error {
+	s.poisonRawBuffers()
+	if cache := s.cache; cache != nil {
+		return cache.put(s)
+	}
 	rc := C.sqlite3_finalize(s.stmt)
 	if rc != C.SQLITE_OK {
 		return errorFromCode(s.db, rc)
@@ -83,127 +171,259 @@ func (s *Stmt) Exec(args ...any) error {
 	return nil
 }
 
+// Binds args to a newly prepared statement, closing it on error.
+func (s *Stmt) bindArgs(args []any) error {
+	if len(args) == 0 {
+		return nil
+	}
+	if err := s.Bind(args); err != nil {
+		s.Close()
+		return err
+	}
+	return nil
+}
+
+// Like Exec, but returns the statement's ExecResult.
+func (s *Stmt) ExecR(args ...any) (ExecResult, error) {
+	before := int64(C.sqlite3_total_changes64(s.db))
+	if err := s.Exec(args...); err != nil {
+		return ExecResult{}, err
+	}
+	return execResult(s.db, before), nil
+}
+
 func (s *Stmt) Bind(args []any) error {
-	stmt := s.stmt
 	for i, v := range args {
-		var rc C.int
-		bindIndex := C.int(i + 1)
+		if err := s.bind(i, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		switch v := v.(type) {
-		case nil:
-			rc = C.sqlite3_bind_null(stmt, bindIndex)
-		case int:
-			rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(v))
-		case *int:
-			if v == nil {
-				C.sqlite3_bind_null(stmt, bindIndex)
-			} else {
-				rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(*v))
-			}
-		case string:
-			if v == "" {
+func (s *Stmt) bind(i int, v any) error {
+	var rc C.int
+	stmt := s.stmt
+	bindIndex := C.int(i + 1)
+
+	switch v := v.(type) {
+	case nil:
+		rc = C.sqlite3_bind_null(stmt, bindIndex)
+	case int:
+		rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(v))
+	case *int:
+		if v == nil {
+			C.sqlite3_bind_null(stmt, bindIndex)
+		} else {
+			rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(*v))
+		}
+	case string:
+		if v == "" {
+			rc = C.empty_string(stmt, bindIndex)
+		} else {
+			rc = C.sqlite3_bind_text(stmt, bindIndex, cStr(v), C.int(len(v)), C.SQLITE_TRANSIENT)
+		}
+	case *string:
+		if v == nil {
+			C.sqlite3_bind_null(stmt, bindIndex)
+		} else {
+			if v := *v; v == "" {
 				rc = C.empty_string(stmt, bindIndex)
 			} else {
 				rc = C.sqlite3_bind_text(stmt, bindIndex, cStr(v), C.int(len(v)), C.SQLITE_TRANSIENT)
 			}
-		case *string:
-			if v == nil {
-				C.sqlite3_bind_null(stmt, bindIndex)
-			} else {
-				if v := *v; v == "" {
-					rc = C.empty_string(stmt, bindIndex)
-				} else {
-					rc = C.sqlite3_bind_text(stmt, bindIndex, cStr(v), C.int(len(v)), C.SQLITE_TRANSIENT)
-				}
-			}
-		case uint16:
-			rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(int64(v)))
-		case *uint16:
-			if v == nil {
-				C.sqlite3_bind_null(stmt, bindIndex)
-			} else {
-				rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(int64(*v)))
-			}
-		case uint32:
-			rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(int64(v)))
-		case *uint32:
-			if v == nil {
-				C.sqlite3_bind_null(stmt, bindIndex)
-			} else {
-				rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(int64(*v)))
-			}
-		case uint64:
-			// OMG!!
-			rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(int64(v)))
-		case *uint64:
-			if v == nil {
-				C.sqlite3_bind_null(stmt, bindIndex)
-			} else {
-				rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(int64(*v)))
-			}
-		case int64:
-			rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(v))
-		case *int64:
-			if v == nil {
-				C.sqlite3_bind_null(stmt, bindIndex)
-			} else {
-				rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(*v))
-			}
-		case float64:
-			rc = C.sqlite3_bind_double(stmt, bindIndex, C.double(v))
-		case *float64:
-			if v == nil {
-				C.sqlite3_bind_null(stmt, bindIndex)
-			} else {
-				rc = C.sqlite3_bind_double(stmt, bindIndex, C.double(*v))
-			}
-		case bool:
+		}
+	case int8:
+		rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(v))
+	case *int8:
+		if v == nil {
+			C.sqlite3_bind_null(stmt, bindIndex)
+		} else {
+			rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(*v))
+		}
+	case int16:
+		rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(v))
+	case *int16:
+		if v == nil {
+			C.sqlite3_bind_null(stmt, bindIndex)
+		} else {
+			rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(*v))
+		}
+	case int32:
+		rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(v))
+	case *int32:
+		if v == nil {
+			C.sqlite3_bind_null(stmt, bindIndex)
+		} else {
+			rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(*v))
+		}
+	case uint:
+		if uint64(v) > math.MaxInt64 {
+			return RangeError{Index: i, Value: v, Type: "int64"}
+		}
+		rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(v))
+	case *uint:
+		if v == nil {
+			C.sqlite3_bind_null(stmt, bindIndex)
+		} else {
+			return s.bind(i, *v)
+		}
+	case uint8:
+		rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(v))
+	case *uint8:
+		if v == nil {
+			C.sqlite3_bind_null(stmt, bindIndex)
+		} else {
+			rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(*v))
+		}
+	case uint16:
+		rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(int64(v)))
+	case *uint16:
+		if v == nil {
+			C.sqlite3_bind_null(stmt, bindIndex)
+		} else {
+			rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(int64(*v)))
+		}
+	case uint32:
+		rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(int64(v)))
+	case *uint32:
+		if v == nil {
+			C.sqlite3_bind_null(stmt, bindIndex)
+		} else {
+			rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(int64(*v)))
+		}
+	case uint64:
+		// SQLite integers are signed 64 bit
+		if v > math.MaxInt64 {
+			return RangeError{Index: i, Value: v, Type: "int64"}
+		}
+		rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(int64(v)))
+	case *uint64:
+		if v == nil {
+			C.sqlite3_bind_null(stmt, bindIndex)
+		} else {
+			return s.bind(i, *v)
+		}
+	case int64:
+		rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(v))
+	case *int64:
+		if v == nil {
+			C.sqlite3_bind_null(stmt, bindIndex)
+		} else {
+			rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(*v))
+		}
+	case float32:
+		rc = C.sqlite3_bind_double(stmt, bindIndex, C.double(v))
+	case *float32:
+		if v == nil {
+			C.sqlite3_bind_null(stmt, bindIndex)
+		} else {
+			rc = C.sqlite3_bind_double(stmt, bindIndex, C.double(*v))
+		}
+	case float64:
+		rc = C.sqlite3_bind_double(stmt, bindIndex, C.double(v))
+	case *float64:
+		if v == nil {
+			C.sqlite3_bind_null(stmt, bindIndex)
+		} else {
+			rc = C.sqlite3_bind_double(stmt, bindIndex, C.double(*v))
+		}
+	case bool:
+		var sqliteBool int64
+		if v {
+			sqliteBool = 1
+		}
+		rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(sqliteBool))
+	case *bool:
+		if v == nil {
+			C.sqlite3_bind_null(stmt, bindIndex)
+		} else {
 			var sqliteBool int64
-			if v {
+			if *v {
 				sqliteBool = 1
 			}
 			rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(sqliteBool))
-		case *bool:
-			if v == nil {
-				C.sqlite3_bind_null(stmt, bindIndex)
-			} else {
-				var sqliteBool int64
-				if *v {
-					sqliteBool = 1
-				}
-				rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(sqliteBool))
-			}
-		case []byte:
-			if len(v) == 0 {
+		}
+	case []byte:
+		if len(v) == 0 {
+			rc = C.sqlite3_bind_zeroblob(stmt, bindIndex, 0)
+		} else {
+			rc = C.sqlite3_bind_blob(stmt, bindIndex, cBytes(v), C.int(len(v)), C.SQLITE_TRANSIENT)
+		}
+	case *[]byte:
+		if v == nil {
+			C.sqlite3_bind_null(stmt, bindIndex)
+		} else {
+			vv := *v
+			if len(vv) == 0 {
 				rc = C.sqlite3_bind_zeroblob(stmt, bindIndex, 0)
 			} else {
-				rc = C.sqlite3_bind_blob(stmt, bindIndex, cBytes(v), C.int(len(v)), C.SQLITE_TRANSIENT)
+				rc = C.sqlite3_bind_blob(stmt, bindIndex, cBytes(vv), C.int(len(vv)), C.SQLITE_TRANSIENT)
 			}
-		case *[]byte:
-			if v == nil {
-				C.sqlite3_bind_null(stmt, bindIndex)
-			} else {
-				vv := *v
-				if len(vv) == 0 {
-					rc = C.sqlite3_bind_zeroblob(stmt, bindIndex, 0)
-				} else {
-					rc = C.sqlite3_bind_blob(stmt, bindIndex, cBytes(vv), C.int(len(vv)), C.SQLITE_TRANSIENT)
-				}
-			}
-		case time.Time:
-			rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(v.Unix()))
-		case *time.Time:
-			if v == nil {
-				C.sqlite3_bind_null(stmt, bindIndex)
-			} else {
-				rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64((*v).Unix()))
-			}
-		default:
-			return Error{Code: C.SQLITE_MISUSE, Message: fmt.Sprintf("unsupported type %T (index: %d)", v, i)}
 		}
-		if rc != C.SQLITE_OK {
-			return errorFromCode(s.db, rc)
+	case time.Time:
+		return s.bindTime(i, v)
+	case *time.Time:
+		if v == nil {
+			C.sqlite3_bind_null(stmt, bindIndex)
+		} else {
+			return s.bindTime(i, *v)
+		}
+	case ListArg:
+		rc = s.bindList(bindIndex, v)
+	case jsonBinder:
+		// a nil *JSON[T] satisfies jsonBinder, but calling marshalJSON on it
+		// would panic
+		if isNilPointer(v) {
+			rc = C.sqlite3_bind_null(stmt, bindIndex)
+			break
+		}
+		return s.bindJSON(i, v)
+	case optionBinder:
+		// likewise for a nil *Option[T]
+		if isNilPointer(v) {
+			rc = C.sqlite3_bind_null(stmt, bindIndex)
+			break
+		}
+		value, valid := v.bindValue()
+		if !valid {
+			rc = C.sqlite3_bind_null(stmt, bindIndex)
+		} else {
+			return s.bind(i, value)
 		}
+	default:
+		return Error{Code: C.SQLITE_MISUSE, Message: fmt.Sprintf("unsupported type %T (index: %d)", v, i)}
+	}
+	if rc != C.SQLITE_OK {
+		return errorFromCode(s.db, rc)
+	}
+	return nil
+}
+
+func isNilPointer(v any) bool {
+	rv := reflect.ValueOf(v)
+	return rv.Kind() == reflect.Pointer && rv.IsNil()
+}
+
+func (s *Stmt) bindTime(i int, t time.Time) error {
+	stmt := s.stmt
+	bindIndex := C.int(i + 1)
+
+	var rc C.int
+	switch f := s.timeFormat; f {
+	case TimeText:
+		v := t.UTC().Format(timeTextLayout)
+		rc = C.sqlite3_bind_text(stmt, bindIndex, cStr(v), C.int(len(v)), C.SQLITE_TRANSIENT)
+	case TimeJulianDay:
+		rc = C.sqlite3_bind_double(stmt, bindIndex, C.double(toJulianDay(t)))
+	default:
+		if f == TimeUnixNano && (t.Before(minUnixNano) || t.After(maxUnixNano)) {
+			return RangeError{Index: i, Value: t, Type: f.String()}
+		}
+		rc = C.sqlite3_bind_int64(stmt, bindIndex, C.sqlite3_int64(f.toInt(t)))
+	}
+	if rc != C.SQLITE_OK {
+		return errorFromCode(s.db, rc)
 	}
 	return nil
 }
@@ -216,42 +436,66 @@ func (s *Stmt) Map() (map[string]any, error) {
 
 func (s *Stmt) MapInto(m map[string]any) error {
 	names := s.ColumnNames()
-	for i, tpe := range s.columnTypes {
-		name := names[i]
-		switch tpe {
-		case C.SQLITE_NULL:
-			m[name] = nil
-			break
-		case C.SQLITE_INTEGER:
-			m[name] = s.ColumnInt(i)
-			break
-		case C.SQLITE_TEXT:
-			var err error
-			m[name], err = s.ColumnText(i)
-			if err != nil {
-				return err
-			}
-			break
-		case C.SQLITE_FLOAT:
-			m[name] = s.ColumnDouble(i)
-			break
-		case C.SQLITE_BLOB:
-			value, err := s.ColumnBytes(i)
-			if err != nil {
-				return err
-			}
-			// erase the type
-			if value == nil {
-				m[name] = nil
-			} else {
-				m[name] = value
-			}
-			break
+	for i := range s.columnTypes {
+		value, err := s.value(i)
+		if err != nil {
+			return err
 		}
+		m[names[i]] = value
 	}
 	return nil
 }
 
+// Fills dst with the current row's values, as returned by Value. dst should
+// have a length of at least ColumnCount(), any extra entries are left as-is.
+func (s *Stmt) Values(dst []any) error {
+	if len(dst) < s.columnCount {
+		return Error{Code: C.SQLITE_MISUSE, Message: fmt.Sprintf("values needs %d slots, got %d", s.columnCount, len(dst))}
+	}
+	for i := range s.columnTypes {
+		value, err := s.value(i)
+		if err != nil {
+			return err
+		}
+		dst[i] = value
+	}
+	return nil
+}
+
+// The value of column i based on its type in the current row: nil, int,
+// float64, string or []byte. Returns nil if the value could not be read
+// (which only happens when SQLite fails to allocate memory).
+func (s *Stmt) Value(i int) any {
+	value, _ := s.value(i)
+	return value
+}
+
+func (s *Stmt) value(i int) (any, error) {
+	switch s.columnTypes[i] {
+	case C.SQLITE_INTEGER:
+		return s.ColumnInt(i), nil
+	case C.SQLITE_TEXT:
+		return s.ColumnText(i)
+	case C.SQLITE_FLOAT:
+		return s.ColumnDouble(i), nil
+	case C.SQLITE_BLOB:
+		value, err := s.ColumnBytes(i)
+		if err != nil {
+			return nil, err
+		}
+		// erase the type
+		if value == nil {
+			return nil, nil
+		}
+		return value, nil
+	}
+	return nil, nil
+}
+
+func (s *Stmt) ColumnCount() int {
+	return s.columnCount
+}
+
 func (s *Stmt) Scan(dst ...any) error {
 	for i, v := range dst {
 		if err := s.scan(i, v); err != nil {
@@ -261,6 +505,26 @@ func (s *Stmt) Scan(dst ...any) error {
 	return nil
 }
 
+// Binds args and returns the statement's rows. Closing the Rows resets the
+// statement (and clears its bindings) rather than finalizing it, so the
+// statement can be queried again.
+func (s *Stmt) Query(args ...any) Rows {
+	return Rows{Stmt: s, err: s.rebind(args), reuse: true}
+}
+
+// Like Query, but for a single row. Like Conn.Row, the statement is reset
+// once the row is scanned.
+func (s *Stmt) QueryRow(args ...any) Row {
+	return Row{Stmt: s, err: s.rebind(args), reuse: true}
+}
+
+// Resets the statement, in case it was left mid-query, and binds args.
+func (s *Stmt) rebind(args []any) error {
+	s.Reset()
+	s.ClearBindings()
+	return s.Bind(args)
+}
+
 func (s *Stmt) Row(dst ...any) (bool, error) {
 	hasRow, err := s.Step()
 	if err != nil {
@@ -278,6 +542,8 @@ func (s *Stmt) Row(dst ...any) (bool, error) {
 }
 
 func (s *Stmt) Reset() error {
+	s.poisonRawBuffers()
+	s.checkSchema = true
 	if rc := C.sqlite3_reset(s.stmt); rc != C.SQLITE_OK {
 		return errorFromCode(s.db, rc)
 	}
@@ -292,21 +558,51 @@ func (s *Stmt) ClearBindings() error {
 }
 
 func (s *Stmt) Step() (bool, error) {
+	s.poisonRawBuffers()
 	stmt := s.stmt
 	rc := C.sqlite3_step(stmt)
 	if rc == C.SQLITE_ROW {
+		if s.checkSchema {
+			s.checkReprepared()
+		}
 		C.column_types(stmt, s.cColumnTypes, s.cColumnCount)
 		return true, nil
 	}
 
 	if rc == C.SQLITE_DONE {
+		// stepping again starts a new execution
+		s.checkSchema = true
 		return false, nil
 	}
 
-	return false, errorFromCode(s.db, rc)
+	return false, s.stepError(rc)
+}
+
+// Called on the first row of a statement which is being re-executed (e.g.
+// taken from the cache, or reset). SQLite transparently re-prepares a
+// statement when the schema changes, which can change its columns.
+func (s *Stmt) checkReprepared() {
+	s.checkSchema = false
+	n := C.sqlite3_stmt_status(s.stmt, C.SQLITE_STMTSTATUS_REPREPARE, 0)
+	if n == s.reprepares {
+		return
+	}
+	s.reprepares = n
+	if cache := s.cache; cache != nil {
+		cache.stats.Invalidations += 1
+	}
+
+	cColumnCount := C.sqlite3_column_count(s.stmt)
+	columnTypes := make([]byte, int(cColumnCount))
+	s.columnNames = nil
+	s.columnTypes = columnTypes
+	s.columnCount = int(cColumnCount)
+	s.cColumnCount = cColumnCount
+	s.cColumnTypes = (*C.uchar)(cBytes(columnTypes))
 }
 
 func (s *Stmt) StepToCompletion() error {
+	s.poisonRawBuffers()
 	stmt := s.stmt
 	for {
 		rc := C.sqlite3_step(stmt)
@@ -316,12 +612,30 @@ func (s *Stmt) StepToCompletion() error {
 		if rc == C.SQLITE_DONE {
 			break
 		}
-		return errorFromCode(s.db, rc)
+		return s.stepError(rc)
 
 	}
 	return nil
 }
 
+func (s *Stmt) stepError(rc C.int) error {
+	if rc&0xff == C.SQLITE_SCHEMA {
+		// couldn't be re-prepared, don't put it back in the cache
+		s.discard = true
+	}
+	return errorFromCode(s.db, rc)
+}
+
+// Makes row, values buffered by ExecReturning, the current row. With nil, the
+// statement's own row is read again.
+func (s *Stmt) setRow(row **C.sqlite3_value) {
+	s.poisonRawBuffers()
+	s.row = row
+	if row != nil {
+		C.value_types(row, s.cColumnTypes, s.cColumnCount)
+	}
+}
+
 func (s *Stmt) ColumnTypes() []byte {
 	return s.columnTypes
 }
@@ -338,19 +652,29 @@ func (s *Stmt) scan(i int, v any) error {
 			*v = &n
 		}
 	case *int:
-		*v = s.ColumnInt(i)
+		*v, err = columnSigned[int](s, i)
 	case **int:
-		if s.columnTypes[i] != C.SQLITE_NULL {
-			n := int(s.ColumnInt64(i))
-			*v = &n
-		}
+		err = scanPointer(s, i, v, columnSigned[int])
+	case *int8:
+		*v, err = columnSigned[int8](s, i)
+	case **int8:
+		err = scanPointer(s, i, v, columnSigned[int8])
+	case *int16:
+		*v, err = columnSigned[int16](s, i)
+	case **int16:
+		err = scanPointer(s, i, v, columnSigned[int16])
+	case *int32:
+		*v, err = columnSigned[int32](s, i)
+	case **int32:
+		err = scanPointer(s, i, v, columnSigned[int32])
 	case *int64:
-		*v = s.ColumnInt64(i)
+		*v, err = columnSigned[int64](s, i)
 	case **int64:
-		if s.columnTypes[i] != C.SQLITE_NULL {
-			n := s.ColumnInt64(i)
-			*v = &n
-		}
+		err = scanPointer(s, i, v, columnSigned[int64])
+	case *float32:
+		*v, err = s.columnFloat32(i)
+	case **float32:
+		err = scanPointer(s, i, v, (*Stmt).columnFloat32)
 	case *float64:
 		*v = s.ColumnDouble(i)
 	case **float64:
@@ -380,35 +704,43 @@ func (s *Stmt) scan(i int, v any) error {
 			}
 		}
 	case *RawBytes:
-		*v, err = s.ColumnRawBytes(i)
+		if s.columnTypes[i] == C.SQLITE_TEXT {
+			*v, err = s.ColumnRawText(i)
+		} else {
+			*v, err = s.ColumnRawBytes(i)
+		}
 	case *time.Time:
-		*v = time.Unix(s.ColumnInt64(i), 0)
+		*v, err = s.ColumnTime(i)
 	case **time.Time:
 		if s.columnTypes[i] != C.SQLITE_NULL {
-			n := time.Unix(s.ColumnInt64(i), 0)
+			var n time.Time
+			n, err = s.ColumnTime(i)
 			*v = &n
 		}
+	case *uint:
+		*v, err = columnUnsigned[uint](s, i)
+	case **uint:
+		err = scanPointer(s, i, v, columnUnsigned[uint])
+	case *uint8:
+		*v, err = columnUnsigned[uint8](s, i)
+	case **uint8:
+		err = scanPointer(s, i, v, columnUnsigned[uint8])
 	case *uint16:
-		*v = uint16(s.ColumnInt64(i))
+		*v, err = columnUnsigned[uint16](s, i)
 	case **uint16:
-		if s.columnTypes[i] != C.SQLITE_NULL {
-			n := uint16(s.ColumnInt64(i))
-			*v = &n
-		}
+		err = scanPointer(s, i, v, columnUnsigned[uint16])
 	case *uint32:
-		*v = uint32(s.ColumnInt64(i))
+		*v, err = columnUnsigned[uint32](s, i)
 	case **uint32:
-		if s.columnTypes[i] != C.SQLITE_NULL {
-			n := uint32(s.ColumnInt64(i))
-			*v = &n
-		}
+		err = scanPointer(s, i, v, columnUnsigned[uint32])
 	case *uint64:
-		*v = uint64(s.ColumnInt64(i))
+		*v, err = columnUnsigned[uint64](s, i)
 	case **uint64:
-		if s.columnTypes[i] != C.SQLITE_NULL {
-			n := uint64(s.ColumnInt64(i))
-			*v = &n
-		}
+		err = scanPointer(s, i, v, columnUnsigned[uint64])
+	case jsonScanner:
+		err = v.scanJSON(s, i)
+	case optionScanner:
+		err = v.scanOption(s, i)
 	default:
 		return Error{Code: C.SQLITE_MISUSE, Message: fmt.Sprintf("cannot scan into %T (index: %d)", v, i)}
 	}
@@ -418,17 +750,74 @@ func (s *Stmt) scan(i int, v any) error {
 	return nil
 }
 
+func (s *Stmt) columnFloat32(i int) (float32, error) {
+	n := s.ColumnDouble(i)
+	if math.Abs(n) > math.MaxFloat32 && !math.IsInf(n, 0) {
+		return 0, RangeError{Index: i, Value: n, Type: "float32"}
+	}
+	return float32(n), nil
+}
+
+func columnSigned[T int | int8 | int16 | int32 | int64](s *Stmt, i int) (T, error) {
+	n, ok := s.columnInteger(i)
+	if !ok || int64(T(n)) != n {
+		return 0, s.columnRangeError(i, fmt.Sprintf("%T", T(0)))
+	}
+	return T(n), nil
+}
+
+func columnUnsigned[T uint | uint8 | uint16 | uint32 | uint64](s *Stmt, i int) (T, error) {
+	n, ok := s.columnInteger(i)
+	if !ok || n < 0 || uint64(T(n)) != uint64(n) {
+		return 0, s.columnRangeError(i, fmt.Sprintf("%T", T(0)))
+	}
+	return T(n), nil
+}
+
+// Like ColumnInt64, but a real has to be integral and within int64's range,
+// rather than being truncated (or clamped) by SQLite.
+func (s *Stmt) columnInteger(i int) (int64, bool) {
+	if s.columnTypes[i] != C.SQLITE_FLOAT {
+		return s.ColumnInt64(i), true
+	}
+	f := s.ColumnDouble(i)
+	// NaN isn't equal to its truncation, and MaxInt64 rounds up to 2^63
+	if f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return 0, false
+	}
+	return int64(f), true
+}
+
+func (s *Stmt) columnRangeError(i int, tpe string) RangeError {
+	if s.columnTypes[i] == C.SQLITE_FLOAT {
+		return RangeError{Index: i, Value: s.ColumnDouble(i), Type: tpe}
+	}
+	return RangeError{Index: i, Value: s.ColumnInt64(i), Type: tpe}
+}
+
+func scanPointer[T any](s *Stmt, i int, v **T, column func(*Stmt, int) (T, error)) error {
+	if s.columnTypes[i] == C.SQLITE_NULL {
+		return nil
+	}
+	n, err := column(s, i)
+	if err != nil {
+		return err
+	}
+	*v = &n
+	return nil
+}
+
 func (s *Stmt) ColumnBytes(i int) ([]byte, error) {
 	if s.columnTypes[i] == C.SQLITE_NULL {
 		return nil, nil
 	}
 
-	n := C.sqlite3_column_bytes(s.stmt, C.int(i))
+	n := C.column_bytes(s.stmt, s.row, C.int(i))
 	if n == 0 {
 		return nil, nil
 	}
 
-	p := C.sqlite3_column_blob(s.stmt, C.int(i))
+	p := C.column_blob(s.stmt, s.row, C.int(i))
 	if p == nil {
 		db := s.db
 		rc := C.sqlite3_errcode(db)
@@ -443,45 +832,135 @@ func (s *Stmt) ColumnRawBytes(i int) (RawBytes, error) {
 		return nil, nil
 	}
 
-	n := int(C.sqlite3_column_bytes(s.stmt, C.int(i)))
+	n := int(C.column_bytes(s.stmt, s.row, C.int(i)))
 	if n == 0 {
 		return nil, nil
 	}
 
-	p := C.sqlite3_column_blob(s.stmt, C.int(i))
+	p := C.column_blob(s.stmt, s.row, C.int(i))
 	if p == nil {
 		db := s.db
 		rc := C.sqlite3_errcode(db)
 		return nil, errorFromCode(db, rc)
 	}
 
+	return s.rawBuffer(p, n), nil
+}
+
+// Like ColumnRawBytes, but for text: the returned slice is owned by sqlite and
+// only valid until the next call on the statement. Null is returned as nil,
+// an empty text as an empty (non-nil) slice.
+func (s *Stmt) ColumnRawText(i int) (RawBytes, error) {
+	if s.columnTypes[i] == C.SQLITE_NULL {
+		return nil, nil
+	}
+
+	// sqlite3_column_text must be called before sqlite3_column_bytes
+	p := C.column_text(s.stmt, s.row, C.int(i))
+	if p == nil {
+		db := s.db
+		rc := C.sqlite3_errcode(db)
+		if rc == C.SQLITE_NOMEM {
+			return nil, errorFromCode(db, rc)
+		}
+		// an empty blob
+		return RawBytes{}, nil
+	}
+
+	n := int(C.column_bytes(s.stmt, s.row, C.int(i)))
+	return s.rawBuffer(unsafe.Pointer(p), n), nil
+}
+
+// Like ColumnText, but the string isn't copied out of sqlite's memory. It
+// has the same lifetime as ColumnRawText: it must not be used after the next
+// call on the statement (and must be copied if it needs to be kept).
+func (s *Stmt) ColumnUnsafeString(i int) (string, error) {
+	b, err := s.ColumnRawText(i)
+	if err != nil {
+		return "", err
+	}
+	return b2s(b), nil
+}
+
+func (s *Stmt) rawBuffer(p unsafe.Pointer, n int) RawBytes {
 	var b RawBytes
 	h := (*reflect.SliceHeader)(unsafe.Pointer(&b))
 	h.Data = uintptr(p)
 	h.Len = n
 	h.Cap = n
-	return b, nil
+
+	if s.debugRaw {
+		// We can't poison sqlite's own memory (it might be the page cache), so
+		// in debug mode, we hand out a copy that we can poison later.
+		b = append(make(RawBytes, 0, n), b...)
+		s.rawBuffers = append(s.rawBuffers, b)
+	}
+	return b
+}
+
+func (s *Stmt) poisonRawBuffers() {
+	if len(s.rawBuffers) == 0 {
+		return
+	}
+	for _, b := range s.rawBuffers {
+		for i := range b {
+			b[i] = RawBufferPoison
+		}
+	}
+	s.rawBuffers = s.rawBuffers[:0]
+}
+
+// The subtype of the value, e.g. 'J' for JSON produced by the JSON1 functions
+func (s *Stmt) columnSubtype(i int) int {
+	return int(C.sqlite3_value_subtype(C.column_value(s.stmt, s.row, C.int(i))))
 }
 
 func (s *Stmt) ColumnDouble(i int) float64 {
-	return float64(C.sqlite3_column_double(s.stmt, C.int(i)))
+	return float64(C.column_double(s.stmt, s.row, C.int(i)))
 }
 
 func (s *Stmt) ColumnInt(i int) int {
-	return int(C.sqlite3_column_int64(s.stmt, C.int(i)))
+	return int(C.column_int64(s.stmt, s.row, C.int(i)))
 }
 
 func (s *Stmt) ColumnInt64(i int) int64 {
-	return int64(C.sqlite3_column_int64(s.stmt, C.int(i)))
+	return int64(C.column_int64(s.stmt, s.row, C.int(i)))
+}
+
+// Integers and reals are interpreted using the connection's TimeFormat. When
+// the TimeFormat isn't one of the unix formats, numbers are treated the way
+// SQLite's 'auto' modifier treats them (a julian day if it's in range, else
+// unix seconds). Text can be in any of the formats supported by SQLite's date
+// functions.
+func (s *Stmt) ColumnTime(i int) (time.Time, error) {
+	switch s.columnTypes[i] {
+	case C.SQLITE_NULL:
+		// this is what we've always returned for null
+		return time.Unix(0, 0), nil
+	case C.SQLITE_FLOAT:
+		return s.timeFormat.fromFloat(s.ColumnDouble(i)), nil
+	case C.SQLITE_TEXT:
+		value, err := s.ColumnText(i)
+		if err != nil {
+			return time.Time{}, err
+		}
+		t, ok := parseTime(value)
+		if !ok {
+			return time.Time{}, Error{Code: C.SQLITE_MISMATCH, Message: fmt.Sprintf("invalid time %q (index: %d)", value, i)}
+		}
+		return t, nil
+	default:
+		return s.timeFormat.fromInt(s.ColumnInt64(i)), nil
+	}
 }
 
 func (s *Stmt) ColumnText(i int) (string, error) {
-	n := C.sqlite3_column_bytes(s.stmt, C.int(i))
+	n := C.column_bytes(s.stmt, s.row, C.int(i))
 	if n == 0 {
 		return "", nil
 	}
 
-	p := (*C.char)(unsafe.Pointer(C.sqlite3_column_text(s.stmt, C.int(i))))
+	p := (*C.char)(unsafe.Pointer(C.column_text(s.stmt, s.row, C.int(i))))
 	if p == nil {
 		db := s.db
 		rc := C.sqlite3_errcode(db)
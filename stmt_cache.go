@@ -0,0 +1,123 @@
+package sqlite
+
+/*
+#include "sqlite3.h"
+*/
+import "C"
+
+import (
+	"container/list"
+)
+
+type StmtCacheStats struct {
+	// Number of statements currently cached (statements in use aren't)
+	Size int
+
+	Hits   int
+	Misses int
+
+	// Statements finalized to make room for more recently used ones
+	Evictions int
+
+	// Cached statements which SQLite re-prepared because the schema changed,
+	// or which were dropped because they could no longer be re-prepared
+	Invalidations int
+}
+
+// An LRU of prepared statements keyed by their SQL. A statement is removed
+// from the cache while it's in use and put back when it's closed, so the
+// same SQL can be used concurrently (e.g. nested Rows), each getting its own
+// statement.
+type stmtCache struct {
+	size    int
+	lru     *list.List
+	entries map[string]*list.Element
+	stats   StmtCacheStats
+
+	// set when the connection is closed, statements which were in use are
+	// then finalized rather than put back
+	closed bool
+}
+
+func newStmtCache(size int) *stmtCache {
+	return &stmtCache{
+		size:    size,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element, size),
+	}
+}
+
+func (c *stmtCache) get(sql []byte) *Stmt {
+	// the compiler doesn't allocate for a string(sql) map lookup
+	e, ok := c.entries[string(sql)]
+	if !ok {
+		c.stats.Misses += 1
+		return nil
+	}
+	c.stats.Hits += 1
+
+	s := c.lru.Remove(e).(*Stmt)
+	delete(c.entries, s.sql)
+	s.checkSchema = true
+	return s
+}
+
+// Resets the statement and puts it back in the cache. Like Stmt.Close,
+// returns the error of the statement's last step, if any.
+func (c *stmtCache) put(s *Stmt) error {
+	stmt := s.stmt
+	rc := C.sqlite3_reset(stmt)
+	C.sqlite3_clear_bindings(stmt)
+
+	var err error
+	if rc != C.SQLITE_OK {
+		err = errorFromCode(s.db, rc)
+	}
+
+	if s.discard {
+		c.stats.Invalidations += 1
+		C.sqlite3_finalize(stmt)
+		return err
+	}
+
+	if c.closed {
+		C.sqlite3_finalize(stmt)
+		return err
+	}
+
+	if _, exists := c.entries[s.sql]; exists {
+		// the same SQL was in use more than once at the same time
+		C.sqlite3_finalize(stmt)
+		return err
+	}
+
+	c.entries[s.sql] = c.lru.PushFront(s)
+	if c.lru.Len() > c.size {
+		oldest := c.lru.Remove(c.lru.Back()).(*Stmt)
+		delete(c.entries, oldest.sql)
+		C.sqlite3_finalize(oldest.stmt)
+		c.stats.Evictions += 1
+	}
+	return err
+}
+
+func (c *stmtCache) clear() {
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		C.sqlite3_finalize(e.Value.(*Stmt).stmt)
+	}
+	c.lru.Init()
+	c.entries = make(map[string]*list.Element, c.size)
+}
+
+// Finalizes the cached statements, and any statement in use once it's put
+// back.
+func (c *stmtCache) close() {
+	c.closed = true
+	c.clear()
+}
+
+func (c *stmtCache) statistics() StmtCacheStats {
+	stats := c.stats
+	stats.Size = c.lru.Len()
+	return stats
+}
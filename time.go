@@ -0,0 +1,179 @@
+package sqlite
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+// How time.Time values are stored. The configured format is used when binding
+// and to interpret numeric columns when scanning. Text columns are always
+// parsed using any of the formats understood by SQLite's date functions.
+type TimeFormat int
+
+const (
+	// integer, seconds since the unix epoch (the default)
+	TimeUnix TimeFormat = iota
+
+	// integer, milliseconds since the unix epoch
+	TimeUnixMilli
+
+	// integer, microseconds since the unix epoch
+	TimeUnixMicro
+
+	// integer, nanoseconds since the unix epoch
+	TimeUnixNano
+
+	// text, RFC3339 in UTC with 9 fractional digits (e.g.
+	// 2023-02-16T06:20:55.123000000Z), so that values sort chronologically
+	TimeText
+
+	// real, fractional days since noon in Greenwich on November 24, 4714 B.C.
+	TimeJulianDay
+)
+
+// Fixed-width, so that the text sorts like the times do
+const timeTextLayout = "2006-01-02T15:04:05.000000000Z07:00"
+
+var (
+	// The range of times TimeUnixNano can represent
+	minUnixNano = time.Unix(0, math.MinInt64)
+	maxUnixNano = time.Unix(0, math.MaxInt64)
+)
+
+const (
+	julianUnixEpoch = 2440587.5
+
+	// The upper bound SQLite's 'auto' modifier uses to decide whether a
+	// numeric value is a julian day or unix seconds.
+	julianAutoMax = 5373484.5
+)
+
+var timeLayouts = []string{
+	"2006-01-02 15:04:05Z07:00",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04Z07:00",
+	"2006-01-02 15:04",
+	"2006-01-02",
+	"15:04:05Z07:00",
+	"15:04:05",
+	"15:04Z07:00",
+	"15:04",
+}
+
+func (f TimeFormat) String() string {
+	switch f {
+	case TimeUnix:
+		return "unix"
+	case TimeUnixMilli:
+		return "unix_milli"
+	case TimeUnixMicro:
+		return "unix_micro"
+	case TimeUnixNano:
+		return "unix_nano"
+	case TimeText:
+		return "text"
+	case TimeJulianDay:
+		return "julian_day"
+	}
+	return "unknown"
+}
+
+func (f TimeFormat) toInt(t time.Time) int64 {
+	switch f {
+	case TimeUnixMilli:
+		return t.UnixMilli()
+	case TimeUnixMicro:
+		return t.UnixMicro()
+	case TimeUnixNano:
+		return t.UnixNano()
+	}
+	return t.Unix()
+}
+
+func (f TimeFormat) fromInt(n int64) time.Time {
+	switch f {
+	case TimeUnixMilli:
+		return time.UnixMilli(n)
+	case TimeUnixMicro:
+		return time.UnixMicro(n)
+	case TimeUnixNano:
+		return time.Unix(0, n)
+	case TimeUnix:
+		return time.Unix(n, 0)
+	}
+	return fromAuto(float64(n))
+}
+
+func (f TimeFormat) fromFloat(n float64) time.Time {
+	switch f {
+	case TimeUnixMilli:
+		return fromUnixFloat(n, time.Millisecond)
+	case TimeUnixMicro:
+		return fromUnixFloat(n, time.Microsecond)
+	case TimeUnixNano:
+		return time.Unix(0, int64(n))
+	case TimeUnix:
+		return fromUnixFloat(n, time.Second)
+	}
+	return fromAuto(n)
+}
+
+func toJulianDay(t time.Time) float64 {
+	// UnixNano overflows outside of 1678-2262
+	return float64(t.Unix())/86400 + float64(t.Nanosecond())/float64(24*time.Hour) + julianUnixEpoch
+}
+
+func fromJulianDay(jd float64) time.Time {
+	// Like SQLite, we only keep millisecond precision (a float64 can't
+	// reliably represent more than that at this magnitude anyways).
+	ms := math.Round((jd - julianUnixEpoch) * 86400000)
+	return time.UnixMilli(int64(ms))
+}
+
+func fromUnixFloat(n float64, unit time.Duration) time.Time {
+	// split so that the fractional part doesn't lose precision when scaled,
+	// and the whole part into seconds so that it doesn't overflow
+	whole, frac := math.Modf(n)
+	perSecond := int64(time.Second / unit)
+	sec, rem := int64(whole)/perSecond, int64(whole)%perSecond
+	return time.Unix(sec, rem*int64(unit)+int64(math.Round(frac*float64(unit))))
+}
+
+// Mimics SQLite's 'auto' modifier
+func fromAuto(n float64) time.Time {
+	if n >= 0 && n < julianAutoMax {
+		return fromJulianDay(n)
+	}
+	return fromUnixFloat(n, time.Second)
+}
+
+// Parses any of the time value formats supported by SQLite's date functions.
+// Values without a timezone are treated as UTC, values without a date are
+// on 2000-01-01 (as SQLite does).
+func parseTime(value string) (time.Time, bool) {
+	if value == "now" {
+		return time.Now(), true
+	}
+
+	if len(value) > 10 && value[10] == 'T' {
+		value = value[:10] + " " + value[11:]
+	}
+
+	for _, layout := range timeLayouts {
+		t, err := time.Parse(layout, value)
+		if err != nil {
+			continue
+		}
+		if t.Year() == 0 {
+			t = t.AddDate(2000, 0, 0)
+		}
+		return t, true
+	}
+
+	if jd, err := strconv.ParseFloat(value, 64); err == nil {
+		return fromJulianDay(jd), true
+	}
+
+	return time.Time{}, false
+}